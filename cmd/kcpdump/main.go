@@ -0,0 +1,360 @@
+// kcpdump prints the frames of kcp-go streams seen on a UDP port.
+//
+// It binds a UDP port, sniffs the traffic of a port (linux only) or reads a
+// pcap file, and decodes every datagram with the frame and segment decoders
+// of the kcp package, so the output stays in sync with the wire format.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	kcp "github.com/ldcsoftware/kcp-go"
+	gouuid "github.com/satori/go.uuid"
+)
+
+var (
+	listenAddr = flag.String("listen", "", "bind the udp address and decode every datagram received")
+	sniffPort  = flag.Int("sniff", 0, "sniff the udp traffic of the port on all interfaces (linux only, needs CAP_NET_RAW)")
+	pcapFile   = flag.String("pcap", "", "read datagrams from a pcap file")
+	pcapPort   = flag.Int("port", 0, "only decode datagrams from or to the port when reading a pcap file")
+	uuidFilter = flag.String("uuid", "", "only print frames of the stream uuid")
+	flagFilter = flag.String("flag", "", "only print frames carrying the flags, comma separated: trigger,replica,primary,path,psh,syn,fin,hrt,rst,rbd,pth")
+	quiet      = flag.Bool("quiet", false, "do not print frames, only the summary")
+	statsEvery = flag.Duration("stats", 0, "print the summary periodically, 0 prints it at exit only")
+)
+
+func checkError(err error) {
+	if err != nil {
+		log.Println("checkError", err)
+		os.Exit(-1)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	filter, err := newFrameFilter(*uuidFilter, *flagFilter)
+	checkError(err)
+	d := newDumper(filter, !*quiet)
+
+	if *statsEvery > 0 {
+		go func() {
+			for range time.Tick(*statsEvery) {
+				d.summary(os.Stdout)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		switch {
+		case *pcapFile != "":
+			checkError(readPcap(*pcapFile, *pcapPort, d.handle))
+		case *sniffPort != 0:
+			checkError(sniff(*sniffPort, d.handle))
+		case *listenAddr != "":
+			checkError(listen(*listenAddr, d.handle))
+		default:
+			flag.Usage()
+			os.Exit(2)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case <-done:
+	}
+	d.summary(os.Stdout)
+}
+
+func listen(addr string, handle datagramHandler) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		handle(time.Now(), from, laddr, buf[:n])
+	}
+}
+
+type datagramHandler func(ts time.Time, src, dst *net.UDPAddr, data []byte)
+
+var dataFlagNames = map[byte]string{
+	kcp.PSH: "psh",
+	kcp.SYN: "syn",
+	kcp.FIN: "fin",
+	kcp.HRT: "hrt",
+	kcp.RST: "rst",
+	kcp.RBD: "rbd",
+	kcp.PTH: "pth",
+}
+
+var cmdNames = map[uint8]string{
+	kcp.IKCP_CMD_PUSH: "push",
+	kcp.IKCP_CMD_ACK:  "ack",
+	kcp.IKCP_CMD_WASK: "wask",
+	kcp.IKCP_CMD_WINS: "wins",
+}
+
+type frameFilter struct {
+	uuid    gouuid.UUID
+	anyUUID bool
+	frame   map[string]bool
+	data    map[byte]bool
+}
+
+func newFrameFilter(uuid, flags string) (*frameFilter, error) {
+	f := &frameFilter{anyUUID: true, frame: map[string]bool{}, data: map[byte]bool{}}
+	if uuid != "" {
+		u, err := gouuid.FromString(uuid)
+		if err != nil {
+			return nil, err
+		}
+		f.uuid = u
+		f.anyUUID = false
+	}
+	if flags == "" {
+		return f, nil
+	}
+	for _, name := range strings.Split(flags, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "trigger", "replica", "primary", "path":
+			f.frame[name] = true
+		default:
+			found := false
+			for flag, flagName := range dataFlagNames {
+				if flagName == name {
+					f.data[flag] = true
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown flag %q", name)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *frameFilter) match(hdr *kcp.FrameHeader, dataFlags map[byte]bool) bool {
+	if !f.anyUUID && hdr.UUID != f.uuid {
+		return false
+	}
+	if len(f.frame) == 0 && len(f.data) == 0 {
+		return true
+	}
+	if (f.frame["trigger"] && hdr.Trigger) || (f.frame["replica"] && hdr.Replica) || (f.frame["primary"] && hdr.PrimaryReceived) ||
+		(f.frame["path"] && hdr.Path) {
+		return true
+	}
+	for flag := range dataFlags {
+		if f.data[flag] {
+			return true
+		}
+	}
+	return false
+}
+
+// snWindow bounds the sequence numbers remembered to detect retransmissions
+const snWindow = 1 << 16
+
+type flowStats struct {
+	frames   uint64
+	replicas uint64
+	pushs    uint64
+	retrans  uint64
+	acks     uint64
+	bytes    uint64
+	maxSn    uint32
+	sns      map[uint32]struct{}
+}
+
+type streamStats struct {
+	first, last time.Time
+	flows       map[string]*flowStats
+}
+
+type dumper struct {
+	filter  *frameFilter
+	verbose bool
+	errs    uint64
+	streams map[gouuid.UUID]*streamStats
+	ch      chan func()
+}
+
+func newDumper(filter *frameFilter, verbose bool) *dumper {
+	d := &dumper{
+		filter:  filter,
+		verbose: verbose,
+		streams: make(map[gouuid.UUID]*streamStats),
+		ch:      make(chan func()),
+	}
+	go func() {
+		for fn := range d.ch {
+			fn()
+		}
+	}()
+	return d
+}
+
+func (d *dumper) handle(ts time.Time, src, dst *net.UDPAddr, data []byte) {
+	data = append([]byte(nil), data...)
+	d.ch <- func() { d.decode(ts, src, dst, data) }
+}
+
+func (d *dumper) decode(ts time.Time, src, dst *net.UDPAddr, data []byte) {
+	hdr, payload, err := kcp.DecodeFrameHeader(data)
+	if err != nil {
+		d.errs++
+		return
+	}
+
+	var segs []string
+	dataFlags := make(map[byte]bool)
+	var pushSns []uint32
+	var acks uint64
+	// path frames carry no KCP segments
+	if hdr.Path {
+		payload = nil
+	}
+	err = kcp.DecodeSegments(payload, func(seg *kcp.SegmentHeader, segData []byte) {
+		desc := fmt.Sprintf("[%v conv:%v sn:%v una:%v wnd:%v ts:%v frg:%v len:%v",
+			cmdNames[seg.Cmd], seg.Conv, seg.Sn, seg.Una, seg.Wnd, seg.Ts, seg.Frg, seg.Len)
+		switch seg.Cmd {
+		case kcp.IKCP_CMD_PUSH:
+			pushSns = append(pushSns, seg.Sn)
+			// every message written by UDPStream starts with its data flag
+			if len(segData) > 0 {
+				dataFlags[segData[0]] = true
+				name, ok := dataFlagNames[segData[0]]
+				if !ok {
+					name = fmt.Sprintf("0x%02x", segData[0])
+				}
+				desc += fmt.Sprintf(" data:%v datalen:%v", name, len(segData)-1)
+			}
+		case kcp.IKCP_CMD_ACK:
+			acks++
+		}
+		segs = append(segs, desc+"]")
+	})
+	if err != nil {
+		d.errs++
+	}
+
+	if !d.filter.match(&hdr, dataFlags) {
+		return
+	}
+
+	st, ok := d.streams[hdr.UUID]
+	if !ok {
+		st = &streamStats{first: ts, flows: make(map[string]*flowStats)}
+		d.streams[hdr.UUID] = st
+	}
+	st.last = ts
+	flowKey := src.String() + "->" + dst.String()
+	flow, ok := st.flows[flowKey]
+	if !ok {
+		flow = &flowStats{sns: make(map[uint32]struct{})}
+		st.flows[flowKey] = flow
+	}
+	flow.frames++
+	flow.acks += acks
+	flow.bytes += uint64(len(data))
+	if hdr.Replica {
+		flow.replicas++
+	} else {
+		// replicas repeat the sn of their primary copy, only primary copies
+		// tell whether a segment has been retransmitted
+		for _, sn := range pushSns {
+			flow.pushs++
+			if _, ok := flow.sns[sn]; ok {
+				flow.retrans++
+				continue
+			}
+			flow.sns[sn] = struct{}{}
+			if int32(sn-flow.maxSn) > 0 {
+				flow.maxSn = sn
+			}
+		}
+		if len(flow.sns) > snWindow {
+			for sn := range flow.sns {
+				if int32(flow.maxSn-sn) > snWindow/2 {
+					delete(flow.sns, sn)
+				}
+			}
+		}
+	}
+
+	if d.verbose {
+		var flags []string
+		if hdr.Trigger {
+			flags = append(flags, "trigger")
+		}
+		if hdr.Replica {
+			flags = append(flags, "replica")
+		}
+		if hdr.PrimaryReceived {
+			flags = append(flags, "primary")
+		}
+		if hdr.Path {
+			flags = append(flags, "path")
+		}
+		fmt.Printf("%v %v uuid:%v fv:%v flags:%v len:%v %v\n",
+			ts.Format("15:04:05.000000"), flowKey, hdr.UUID, hdr.Version, strings.Join(flags, "|"), len(data), strings.Join(segs, " "))
+	}
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func (d *dumper) summary(w *os.File) {
+	done := make(chan struct{})
+	d.ch <- func() {
+		defer close(done)
+		uuids := make([]gouuid.UUID, 0, len(d.streams))
+		for uuid := range d.streams {
+			uuids = append(uuids, uuid)
+		}
+		sort.Slice(uuids, func(i, j int) bool { return d.streams[uuids[i]].first.Before(d.streams[uuids[j]].first) })
+
+		fmt.Fprintf(w, "------------- kcpdump summary streams:%v decode errors:%v -------------\n", len(uuids), d.errs)
+		for _, uuid := range uuids {
+			st := d.streams[uuid]
+			fmt.Fprintf(w, "stream uuid:%v duration:%v\n", uuid, st.last.Sub(st.first))
+			for key, flow := range st.flows {
+				fmt.Fprintf(w, "  %v frames:%v bytes:%v pushs:%v acks:%v retrans:%v retrans_ratio:%.4f replicas:%v replica_ratio:%.4f\n",
+					key, flow.frames, flow.bytes, flow.pushs, flow.acks, flow.retrans, ratio(flow.retrans, flow.pushs),
+					flow.replicas, ratio(flow.replicas, flow.frames))
+			}
+		}
+	}
+	<-done
+}
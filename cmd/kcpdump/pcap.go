@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	errPcapMagic    = errors.New("err pcap magic")
+	errPcapLinkType = errors.New("err pcap link type not support")
+)
+
+// link types of the pcap global header
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	protoUDP      = 17
+)
+
+// readPcap reads a classic libpcap file and calls handle for every udp
+// datagram from or to port, any port if port is 0
+func readPcap(file string, port int, handle datagramHandler) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var global [24]byte
+	if _, err := io.ReadFull(f, global[:]); err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder
+	nano := false
+	switch binary.LittleEndian.Uint32(global[:4]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	default:
+		return errPcapMagic
+	}
+	linkType := order.Uint32(global[20:24]) & 0x0fffffff
+
+	var rec [16]byte
+	buf := make([]byte, 65536)
+	for {
+		if _, err := io.ReadFull(f, rec[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		sec := int64(order.Uint32(rec[0:4]))
+		frac := int64(order.Uint32(rec[4:8]))
+		inclLen := int(order.Uint32(rec[8:12]))
+		if inclLen > len(buf) {
+			buf = make([]byte, inclLen)
+		}
+		if _, err := io.ReadFull(f, buf[:inclLen]); err != nil {
+			return err
+		}
+		if !nano {
+			frac *= 1000
+		}
+		ts := time.Unix(sec, frac)
+
+		packet, ok, err := stripLinkHeader(linkType, buf[:inclLen])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if src, dst, data, ok := parseIPUDP(packet); ok {
+			if port == 0 || src.Port == port || dst.Port == port {
+				handle(ts, src, dst, data)
+			}
+		}
+	}
+}
+
+// stripLinkHeader returns the ip packet carried by a link layer frame
+func stripLinkHeader(linkType uint32, frame []byte) ([]byte, bool, error) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return frame, true, nil
+	case linkTypeNull, linkTypeLoop:
+		if len(frame) < 4 {
+			return nil, false, nil
+		}
+		return frame[4:], true, nil
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false, nil
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN {
+			if len(frame) < 4 {
+				return nil, false, nil
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+		return frame, etherType == etherTypeIPv4 || etherType == etherTypeIPv6, nil
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false, nil
+		}
+		return frame[16:], true, nil
+	case linkTypeSLL2:
+		if len(frame) < 20 {
+			return nil, false, nil
+		}
+		return frame[20:], true, nil
+	}
+	return nil, false, errPcapLinkType
+}
+
+// parseIPUDP returns the addresses and payload of an udp datagram carried by
+// an ipv4 or ipv6 packet, fragments and ipv6 extension headers are skipped
+func parseIPUDP(packet []byte) (src, dst *net.UDPAddr, data []byte, ok bool) {
+	if len(packet) < 1 {
+		return
+	}
+	var srcIP, dstIP net.IP
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl || packet[9] != protoUDP {
+			return
+		}
+		// neither a later fragment nor the first one of a fragmented datagram
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		if total := int(binary.BigEndian.Uint16(packet[2:4])); total >= ihl && total <= len(packet) {
+			packet = packet[:total]
+		}
+		packet = packet[ihl:]
+	case 6:
+		if len(packet) < 40 || packet[6] != protoUDP {
+			return
+		}
+		srcIP, dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		packet = packet[40:]
+	default:
+		return
+	}
+
+	if len(packet) < 8 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(packet[4:6]))
+	if length < 8 || length > len(packet) {
+		return
+	}
+	src = &net.UDPAddr{IP: append(net.IP(nil), srcIP...), Port: int(binary.BigEndian.Uint16(packet[0:2]))}
+	dst = &net.UDPAddr{IP: append(net.IP(nil), dstIP...), Port: int(binary.BigEndian.Uint16(packet[2:4]))}
+	return src, dst, packet[8:length], true
+}
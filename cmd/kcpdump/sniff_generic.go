@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func sniff(port int, handle datagramHandler) error {
+	return errors.New("sniff is only supported on linux, use -pcap with a capture file instead")
+}
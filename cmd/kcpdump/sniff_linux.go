@@ -0,0 +1,44 @@
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+const ethPAll = 0x0003
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sniff captures the ip packets of every interface with a packet socket and
+// calls handle for every udp datagram from or to port
+func sniff(port int, handle datagramHandler) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPAll)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		// loopback traffic is seen twice, once outgoing and once incoming
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING && ll.Hatype == syscall.ARPHRD_LOOPBACK {
+			continue
+		}
+		if src, dst, data, ok := parseIPUDP(buf[:n]); ok {
+			if src.Port == port || dst.Port == port {
+				handle(time.Now(), src, dst, data)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package kcp
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// Streams returns the streams of the transport, opened or accepted, not yet cleaned
+func (t *UDPTransport) Streams() []*UDPStream {
+	streams := make([]*UDPStream, 0)
+	t.streamm.IterCb(func(key gouuid.UUID, v interface{}) {
+		streams = append(streams, v.(*UDPStream))
+	})
+	return streams
+}
+
+// StreamInfo is the state of a stream rendered by DebugHandler
+type StreamInfo struct {
+	*StreamStats
+	StateName string
+	Locals    []string
+	Remotes   []string
+	Tunnels   []string
+	Idle      time.Duration // since the last packet received
+}
+
+// Info returns the state of the stream for diagnosis
+func (s *UDPStream) Info() *StreamInfo {
+	info := &StreamInfo{StreamStats: s.Stats()}
+	info.StateName = stateName(info.State)
+	info.Idle = time.Since(time.Unix(0, atomic.LoadInt64(&s.stats.lastInput)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range s.locals {
+		info.Locals = append(info.Locals, addr.String())
+	}
+	for _, addr := range s.remotes {
+		info.Remotes = append(info.Remotes, addr.String())
+	}
+	for _, tunnel := range s.tunnels {
+		info.Tunnels = append(info.Tunnels, tunnel.LocalAddr().String())
+	}
+	return info
+}
+
+// DebugHandler lists the streams of the transports for on-call diagnosis, as JSON with
+// ?format=json or "Accept: application/json", as HTML otherwise. POST ?rst=<uuid> closes
+// the stream, sending RST to the peer
+type DebugHandler struct {
+	transports []*UDPTransport
+}
+
+// NewDebugHandler creates a handler listing the streams of the transports
+func NewDebugHandler(transports ...*UDPTransport) *DebugHandler {
+	return &DebugHandler{transports: transports}
+}
+
+// ServeHTTP implements http.Handler
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		h.serveRst(w, r)
+		return
+	}
+
+	infos := make([]*StreamInfo, 0)
+	for _, t := range h.transports {
+		for _, s := range t.Streams() {
+			infos = append(infos, s.Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Idle < infos[j].Idle
+	})
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(infos); err != nil {
+			DefaultLogger.Log(WARN, "DebugHandler::ServeHTTP", "remote", r.RemoteAddr, "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, infos); err != nil {
+		DefaultLogger.Log(WARN, "DebugHandler::ServeHTTP", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+func (h *DebugHandler) serveRst(w http.ResponseWriter, r *http.Request) {
+	uuid, err := gouuid.FromString(r.FormValue("rst"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range h.transports {
+		if s, ok := t.streamm.Get(uuid); ok {
+			DefaultLogger.Log(WARN, "DebugHandler::serveRst", "remote", r.RemoteAddr, "uuid", uuid)
+			s.(*UDPStream).Close()
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+	http.Error(w, "stream not found", http.StatusNotFound)
+}
+
+var debugTemplate = template.Must(template.New("streams").Parse(`<!DOCTYPE html>
+<html><head><title>kcp streams</title></head><body>
+<p>{{len .}} streams</p>
+<table border="1" cellspacing="0" cellpadding="2">
+<tr><th>uuid</th><th>accepted</th><th>state</th><th>locals</th><th>remotes</th><th>tunnels</th><th>srtt</th><th>cwnd</th><th>waitsnd</th><th>parallel</th><th>idle</th><th></th></tr>
+{{range .}}<tr><td>{{.UUID}}</td><td>{{.Accepted}}</td><td>{{.StateName}}</td><td>{{.Locals}}</td><td>{{.Remotes}}</td><td>{{.Tunnels}}</td><td>{{.Srtt}}</td><td>{{.Cwnd}}</td><td>{{.WaitSnd}}</td><td>{{.ParallelStatus}}</td><td>{{.Idle}}</td>
+<td><form method="post"><input type="hidden" name="rst" value="{{.UUID}}"><input type="submit" value="rst"></form></td></tr>
+{{end}}</table>
+</body></html>
+`))
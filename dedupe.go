@@ -0,0 +1,95 @@
+package kcp
+
+import "sync/atomic"
+
+// copySlots is the number of segments received remembered by sn to time their next copy
+const copySlots = 1024
+
+// CopyStats is the accounting of the copies of the data segments received, primary or replica,
+// to tell whether the replicas pay for their bandwidth
+type CopyStats struct {
+	FirstPrimarySegs uint64 // segments received first in a primary copy
+	FirstReplicaSegs uint64 // segments received first in a replica, which won the race
+	DupPrimarySegs   uint64 // primary copies of segments received before, by a replica or a retransmission
+	DupReplicaSegs   uint64 // replicas of segments received before, wasted
+	UsefulReplicas   uint64 // replica packets carrying a segment received first
+	WastedReplicas   uint64 // replica packets carrying data segments all received before
+}
+
+func (c *CopyStats) add(replica bool, newSegs, repeatSegs int) {
+	if !replica {
+		c.FirstPrimarySegs += uint64(newSegs)
+		c.DupPrimarySegs += uint64(repeatSegs)
+		return
+	}
+	c.FirstReplicaSegs += uint64(newSegs)
+	c.DupReplicaSegs += uint64(repeatSegs)
+	if newSegs > 0 {
+		c.UsefulReplicas++
+	} else if repeatSegs > 0 {
+		c.WastedReplicas++
+	}
+}
+
+// copySlot is the first copy received of a segment
+type copySlot struct {
+	sn      uint32
+	ts      uint32
+	pending bool // its next copy is not received yet
+}
+
+// dedupe tells the data segments of the frames input to KCP received first from the ones
+// received before, and times the next copy of the first ones, see CopyStats
+type dedupe struct {
+	// of the frame input
+	replica    bool
+	current    uint32
+	newSegs    int
+	repeatSegs int
+
+	CopyStats
+	slots []copySlot // by sn, allocated on the first segment
+	hist  *Histograms
+}
+
+// begin starts the frame input at current
+func (d *dedupe) begin(replica bool, current uint32) {
+	d.replica = replica
+	d.current = current
+	d.newSegs = 0
+	d.repeatSegs = 0
+}
+
+// segment is told by KCP.Input the data segment sn received, repeat if it was received before
+func (d *dedupe) segment(sn uint32, repeat bool) {
+	if d.slots == nil {
+		d.slots = make([]copySlot, copySlots)
+	}
+	slot := &d.slots[sn%copySlots]
+	if !repeat {
+		d.newSegs++
+		*slot = copySlot{sn: sn, ts: d.current, pending: true}
+		return
+	}
+	d.repeatSegs++
+	if slot.pending && slot.sn == sn {
+		slot.pending = false
+		statCopyGap(d.hist, int64(_itimediff(d.current, slot.ts)))
+	}
+}
+
+// end accounts the frame input to the stream and to ps, nil if its path is unknown
+func (d *dedupe) end(ps *pathStat) {
+	if d.newSegs == 0 && d.repeatSegs == 0 {
+		return
+	}
+	d.add(d.replica, d.newSegs, d.repeatSegs)
+	if ps != nil {
+		ps.copies.add(d.replica, d.newSegs, d.repeatSegs)
+	}
+	if d.replica && d.newSegs > 0 {
+		atomic.AddUint64(&DefaultSnmp.UsefulReplicas, 1)
+	} else if d.replica {
+		atomic.AddUint64(&DefaultSnmp.WastedReplicas, 1)
+	}
+}
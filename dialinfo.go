@@ -0,0 +1,289 @@
+package kcp
+
+import (
+	"errors"
+	"io"
+)
+
+// DialInfo DV2 extends the DV1 SYN with a trailing extension area, DV1 acceptors ignore the
+// trailing bytes so they still accept a DV2 SYN
+// ---dial info DV2---
+// DV1 dial info
+// version uint8 (DV2) + length uint16 + (type uint8 + length uint16 + value)...
+//
+// a DV2 acceptor queues a SYN carrying the agreed set as its first message, with the same
+// extension area but without the DV1 part, a DV1 dialer never receives it
+const (
+	DV2 = DV1 + 1
+)
+
+// Features negotiated in the SYN handshake, the agreed set is the intersection of both sides
+const (
+	FeatureSACK uint32 = 1 << iota
+	FeatureFEC
+	FeatureEncryption
+	FeatureDatagram
+)
+
+// type of the dial info extension TLVs
+const (
+	dialTlvMtu byte = iota + 1
+	dialTlvSndWnd
+	dialTlvRcvWnd
+	dialTlvInterval
+	dialTlvFeatures
+	dialTlvPayload
+	dialTlvMetadata
+	dialTlvTicket
+	dialTlvPathKey
+)
+
+// DialParamsPayloadMax is the max size of DialParams.Payload
+const DialParamsPayloadMax = 1024
+
+// OpenMetadataMax is the max size of the metadata of OpenWithPayload
+const OpenMetadataMax = 512
+
+var (
+	errDialPayload  = errors.New("err dial payload too large")
+	errOpenMetadata = errors.New("err open metadata too large")
+)
+
+// DialParams are the stream parameters negotiated in the SYN handshake, in the view of
+// the dialer, zero values are not proposed
+type DialParams struct {
+	Mtu      int
+	SndWnd   int // dialer to acceptor window
+	RcvWnd   int // acceptor to dialer window
+	Interval int
+	Features uint32
+	Payload  []byte // opaque to the library, the one of the peer once negotiated
+	Metadata []byte // only carried by the SYN of OpenWithPayload, not negotiated
+	Ticket   []byte // resumption ticket, issued in the SYN reply or presented in the SYN of Resume
+
+	pathKey []byte // key of the path responses, issued in the SYN reply, see checkPath
+}
+
+func encodeDialTlv16u(p []byte, typ byte, v int) []byte {
+	if v <= 0 {
+		return p
+	}
+	if v > 0xFFFF {
+		v = 0xFFFF
+	}
+	p = append(p, typ, 2, 0, 0, 0)
+	encode16u(p[len(p)-2:], uint16(v))
+	return p
+}
+
+// encodeDialExt appends the extension area of params to p
+func encodeDialExt(p []byte, params *DialParams) ([]byte, error) {
+	if len(params.Payload) > DialParamsPayloadMax {
+		return nil, errDialPayload
+	}
+	if len(params.Metadata) > OpenMetadataMax {
+		return nil, errOpenMetadata
+	}
+	start := len(p)
+	p = append(p, DV2, 0, 0)
+	p = encodeDialTlv16u(p, dialTlvMtu, params.Mtu)
+	p = encodeDialTlv16u(p, dialTlvSndWnd, params.SndWnd)
+	p = encodeDialTlv16u(p, dialTlvRcvWnd, params.RcvWnd)
+	p = encodeDialTlv16u(p, dialTlvInterval, params.Interval)
+	if params.Features != 0 {
+		p = append(p, dialTlvFeatures, 4, 0, 0, 0, 0, 0)
+		encode32u(p[len(p)-4:], params.Features)
+	}
+	if len(params.Payload) > 0 {
+		p = append(p, dialTlvPayload, 0, 0)
+		encode16u(p[len(p)-2:], uint16(len(params.Payload)))
+		p = append(p, params.Payload...)
+	}
+	if len(params.Metadata) > 0 {
+		p = append(p, dialTlvMetadata, 0, 0)
+		encode16u(p[len(p)-2:], uint16(len(params.Metadata)))
+		p = append(p, params.Metadata...)
+	}
+	if len(params.Ticket) > 0 {
+		p = append(p, dialTlvTicket, 0, 0)
+		encode16u(p[len(p)-2:], uint16(len(params.Ticket)))
+		p = append(p, params.Ticket...)
+	}
+	if len(params.pathKey) > 0 {
+		p = append(p, dialTlvPathKey, 0, 0)
+		encode16u(p[len(p)-2:], uint16(len(params.pathKey)))
+		p = append(p, params.pathKey...)
+	}
+	encode16u(p[start+1:], uint16(len(p)-start-3))
+	return p, nil
+}
+
+// decodeDialExt decodes the extension area at the head of buf, unknown TLVs are skipped
+func decodeDialExt(buf []byte) (params *DialParams, err error) {
+	var version byte
+	var extLen uint16
+	if buf, err = decode8u(buf, &version); err != nil {
+		return nil, err
+	}
+	if version != DV2 {
+		return nil, errDialVersionNotSupport
+	}
+	if buf, err = decode16u(buf, &extLen); err != nil {
+		return nil, err
+	}
+	if len(buf) < int(extLen) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf = buf[:extLen]
+
+	params = &DialParams{}
+	for len(buf) > 0 {
+		var typ byte
+		var vlen, v16 uint16
+		if buf, err = decode8u(buf, &typ); err != nil {
+			return nil, err
+		}
+		if buf, err = decode16u(buf, &vlen); err != nil {
+			return nil, err
+		}
+		if len(buf) < int(vlen) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := buf[:vlen]
+		buf = buf[vlen:]
+
+		switch typ {
+		case dialTlvMtu, dialTlvSndWnd, dialTlvRcvWnd, dialTlvInterval:
+			if _, err = decode16u(value, &v16); err != nil {
+				return nil, err
+			}
+			switch typ {
+			case dialTlvMtu:
+				params.Mtu = int(v16)
+			case dialTlvSndWnd:
+				params.SndWnd = int(v16)
+			case dialTlvRcvWnd:
+				params.RcvWnd = int(v16)
+			case dialTlvInterval:
+				params.Interval = int(v16)
+			}
+		case dialTlvFeatures:
+			if _, err = decode32u(value, &params.Features); err != nil {
+				return nil, err
+			}
+		case dialTlvPayload:
+			params.Payload = append([]byte(nil), value...)
+		case dialTlvMetadata:
+			params.Metadata = append([]byte(nil), value...)
+		case dialTlvTicket:
+			params.Ticket = append([]byte(nil), value...)
+		case dialTlvPathKey:
+			params.pathKey = append([]byte(nil), value...)
+		}
+	}
+	return params, nil
+}
+
+func minParam(a, b int) int {
+	if a == 0 {
+		return b
+	} else if b == 0 || a < b {
+		return a
+	}
+	return b
+}
+
+// negotiate returns the agreed set of the proposal of the dialer and the local params of the
+// acceptor, both in the view of the dialer, each value is the smaller one and the features
+// are the common ones
+func negotiate(proposal, local *DialParams) *DialParams {
+	return &DialParams{
+		Mtu:      minParam(proposal.Mtu, local.Mtu),
+		SndWnd:   minParam(proposal.SndWnd, local.SndWnd),
+		RcvWnd:   minParam(proposal.RcvWnd, local.RcvWnd),
+		Interval: minParam(proposal.Interval, local.Interval),
+		Features: proposal.Features & local.Features,
+	}
+}
+
+// localDialParams returns the current params of the stream, in the view of the dialer
+func (s *UDPStream) localDialParams() *DialParams {
+	params := &DialParams{
+		Mtu:      int(s.kcp.mtu),
+		SndWnd:   int(s.kcp.snd_wnd),
+		RcvWnd:   int(s.kcp.rcv_wnd),
+		Interval: int(s.kcp.interval),
+		Features: s.features,
+		Payload:  s.dialPayload,
+	}
+	if s.accepted {
+		params.SndWnd, params.RcvWnd = params.RcvWnd, params.SndWnd
+	} else {
+		params.Metadata = s.openMeta
+		params.Ticket = presentTicket(s.ticket, s.uuid)
+	}
+	return params
+}
+
+// applyDialParams applies the agreed set to the stream, payload is the one of the peer
+func (s *UDPStream) applyDialParams(agreed *DialParams, payload []byte) {
+	if agreed.Mtu > 0 && agreed.Mtu < int(s.kcp.mtu) {
+		s.kcp.SetMtu(agreed.Mtu)
+	}
+	sndwnd, rcvwnd := agreed.SndWnd, agreed.RcvWnd
+	if s.accepted {
+		sndwnd, rcvwnd = rcvwnd, sndwnd
+	}
+	s.kcp.WndSize(sndwnd, rcvwnd)
+	if agreed.Interval > 0 {
+		s.kcp.NoDelay(-1, agreed.Interval, -1, -1)
+	}
+	negotiated := *agreed
+	negotiated.Payload = payload
+	s.negotiated = &negotiated
+}
+
+// Negotiated returns the parameters agreed in the SYN handshake, in the view of the dialer, with
+// the payload of the peer, nil if the peer only speaks DV1 or the reply has not arrived yet
+func (s *UDPStream) Negotiated() *DialParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.negotiated
+}
+
+// OpenMetadata returns the metadata the dialer passed to OpenWithPayload, available on the
+// accepted stream once Accept returns it, nil if none was sent
+func (s *UDPStream) OpenMetadata() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openMeta
+}
+
+// recvSynReply consumes the SYN reply of a DV2 acceptor, the first message it queues
+func (s *UDPStream) recvSynReply() {
+	if len(s.kcp.rcv_queue) == 0 {
+		return
+	}
+	seg := &s.kcp.rcv_queue[0]
+	if len(seg.data) == 0 || seg.data[0] != SYN {
+		s.synReplyWait = false
+		return
+	}
+	size := s.kcp.PeekSize()
+	if size <= 0 { // wait for the rest fragments
+		return
+	}
+	s.synReplyWait = false
+	buf := make([]byte, size)
+	s.kcp.Recv(buf)
+	agreed, err := decodeDialExt(buf[1:])
+	if err != nil {
+		s.log.Log(WARN, "UDPStream::recvSynReply", "err", err)
+		return
+	}
+	s.applyDialParams(agreed, agreed.Payload)
+	s.ticket = agreed.Ticket
+	s.pathKey = agreed.pathKey
+	s.log.Log(INFO, "UDPStream::recvSynReply", "mtu", agreed.Mtu, "sndwnd", agreed.SndWnd, "rcvwnd", agreed.RcvWnd,
+		"interval", agreed.Interval, "features", agreed.Features)
+}
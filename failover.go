@@ -0,0 +1,119 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// PathFailoverUnacked is the number of packets sent on the primary path without hearing from it
+// for PathFailoverTimeout, or of write errors of its tunnel, before another path takes over
+var PathFailoverUnacked = 32
+
+// PathFailoverTimeout is the time without hearing from the primary path before it fails over,
+// once PathFailoverUnacked packets are sent on it
+var PathFailoverTimeout = 3 * time.Second
+
+// heard records the path is heard from by tunnel at now
+func (ps *pathStat) heard(tunnel *UDPTunnel, now time.Time) {
+	ps.lastInput = now
+	ps.unacked = 0
+	if tunnel != nil {
+		ps.outErrs = atomic.LoadUint64(&tunnel.stats.outErrs)
+	}
+}
+
+// pathFailed returns why path is found dead, its tunnel closed, its pings lost, its tunnel
+// failing to write or nothing heard for the packets sent, "" if it is not, with the lock held
+func (s *UDPStream) pathFailed(path int, now time.Time) string {
+	tunnel := s.tunnels[path]
+	if tunnel != nil && tunnel.isClosed() {
+		return "closed"
+	} else if !s.pathAlive(path) {
+		return "pings"
+	}
+	ps := s.pathStat(path)
+	if tunnel != nil && atomic.LoadUint64(&tunnel.stats.outErrs)-ps.outErrs >= uint64(PathFailoverUnacked) {
+		return "write errors"
+	} else if ps.unacked >= PathFailoverUnacked && now.Sub(ps.lastInput) >= PathFailoverTimeout {
+		return "unacked"
+	}
+	return ""
+}
+
+// checkPrimary moves the primary copies to the best path alive if the first one failed and tells
+// the peer to do the same on the reverse path, it is called on flush
+func (s *UDPStream) checkPrimary() {
+	now := time.Now()
+	s.mu.Lock()
+	if s.state != StateEstablish || s.stripe != nil || len(s.tunnels) < 2 {
+		s.mu.Unlock()
+		return
+	}
+	reason := s.pathFailed(0, now)
+	if reason == "" {
+		s.mu.Unlock()
+		return
+	}
+	path := -1
+	for i := 1; i < len(s.tunnels); i++ {
+		if p := s.replicaPath(i); s.pathFailed(p, now) == "" {
+			path = p
+			break
+		}
+	}
+	if path < 0 {
+		s.mu.Unlock()
+		return
+	}
+	from := s.locals[0]
+	s.promotePath(path)
+	local, remote := s.locals[0].String(), s.remotes[0].String()
+	tell := s.negotiated != nil
+	s.mu.Unlock()
+
+	s.log.Log(WARN, "UDPStream::checkPrimary failover", "reason", reason, "from", from, "local", local, "remote", remote)
+	atomic.AddUint64(&s.stats.pathFailovers, 1)
+	atomic.AddUint64(&DefaultSnmp.PathFailovers, 1)
+	if tell {
+		// the write may wait for the window, not on the flush
+		go func() {
+			if err := s.writePath(pathPrimary, local, remote); err != nil {
+				s.log.Log(WARN, "UDPStream::checkPrimary", "err", err)
+			}
+		}()
+	}
+}
+
+// promotePath moves path first so that it carries the primary copies, the others keep their
+// order. The slices may be shared with the selector so they are copied
+func (s *UDPStream) promotePath(path int) {
+	order := make([]int, 0, len(s.tunnels))
+	order = append(order, path)
+	for i := range s.tunnels {
+		if i != path {
+			order = append(order, i)
+		}
+	}
+	tunnels := make([]*UDPTunnel, len(order))
+	locals := make([]*net.UDPAddr, len(order))
+	remotes := make([]*net.UDPAddr, len(order))
+	var stats []pathStat
+	if len(s.pathStats) == len(s.tunnels) {
+		stats = make([]pathStat, len(order))
+	}
+	for i, j := range order {
+		tunnels[i], locals[i], remotes[i] = s.tunnels[j], s.locals[j], s.remotes[j]
+		if stats != nil {
+			stats[i] = s.pathStats[j]
+		}
+	}
+	s.tunnels, s.locals, s.remotes = tunnels, locals, remotes
+	s.pathStats = stats
+	s.pathProbes = nil
+	s.replicaOrder = nil
+	s.resetStripe()
+	// a fresh start for the new primary, the health of the paths is kept
+	s.pathStat(0).heard(s.tunnels[0], time.Now())
+	s.rankPaths()
+}
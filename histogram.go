@@ -0,0 +1,194 @@
+package kcp
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	// each power of two range is split into 1<<histSubBits linear buckets,
+	// so a recorded value is off by at most 1/(1<<histSubBits) of itself
+	histSubBits = 3
+	histSubSize = 1 << histSubBits
+
+	// HistogramMaxValue is the largest value with its own bucket, larger values are counted in the last one
+	HistogramMaxValue = 1<<20 - 1
+
+	histBuckets = (20 - histSubBits + 1) << histSubBits
+)
+
+// Histogram is a lock-free HDR-style histogram of non-negative values, the buckets
+// are log-linear so that the precision is relative to the value recorded
+type Histogram struct {
+	counts [histBuckets]uint64
+	sum    uint64
+	max    uint64
+}
+
+func histBucket(v uint64) int {
+	if v > HistogramMaxValue {
+		v = HistogramMaxValue
+	}
+	if v < histSubSize {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v)) - histSubBits - 1
+	return int(shift+1)<<histSubBits + int(v>>shift) - histSubSize
+}
+
+// histBucketBound returns the highest value counted in the bucket idx
+func histBucketBound(idx int) uint64 {
+	if idx < histSubSize {
+		return uint64(idx)
+	}
+	shift := uint(idx>>histSubBits) - 1
+	lower := uint64(histSubSize+idx&(histSubSize-1)) << shift
+	return lower + 1<<shift - 1
+}
+
+// Record adds the value v to the histogram, negative values are recorded as 0
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	atomic.AddUint64(&h.counts[histBucket(uint64(v))], 1)
+	atomic.AddUint64(&h.sum, uint64(v))
+	atomicSetMax(&h.max, uint64(v))
+}
+
+// Snapshot returns a copy of the current values of the histogram
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	hs := &HistogramSnapshot{}
+	for i := range h.counts {
+		hs.counts[i] = atomic.LoadUint64(&h.counts[i])
+		hs.Count += hs.counts[i]
+	}
+	hs.Sum = atomic.LoadUint64(&h.sum)
+	hs.Max = atomic.LoadUint64(&h.max)
+	return hs
+}
+
+// SnapshotReset returns a copy of the current values and resets them to zero,
+// calling it periodically gives the distribution of each window without losing samples
+func (h *Histogram) SnapshotReset() *HistogramSnapshot {
+	hs := &HistogramSnapshot{}
+	for i := range h.counts {
+		hs.counts[i] = atomic.SwapUint64(&h.counts[i], 0)
+		hs.Count += hs.counts[i]
+	}
+	hs.Sum = atomic.SwapUint64(&h.sum, 0)
+	hs.Max = atomic.SwapUint64(&h.max, 0)
+	return hs
+}
+
+// Reset values to zero
+func (h *Histogram) Reset() {
+	h.SnapshotReset()
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram
+type HistogramSnapshot struct {
+	counts [histBuckets]uint64
+	Count  uint64 // number of values recorded
+	Sum    uint64 // sum of values recorded
+	Max    uint64 // max value recorded
+}
+
+// Mean returns the average of the values recorded
+func (hs *HistogramSnapshot) Mean() float64 {
+	if hs.Count == 0 {
+		return 0
+	}
+	return float64(hs.Sum) / float64(hs.Count)
+}
+
+// Percentile returns the value below which the fraction q of the values fall, q is in [0, 1]
+func (hs *HistogramSnapshot) Percentile(q float64) uint64 {
+	if hs.Count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(hs.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range hs.counts {
+		seen += n
+		if seen >= rank {
+			if v := histBucketBound(i); v < hs.Max {
+				return v
+			}
+			return hs.Max
+		}
+	}
+	return hs.Max
+}
+
+// CountLE returns the number of values recorded less than or equal to v,
+// values sharing a bucket with v are all counted
+func (hs *HistogramSnapshot) CountLE(v uint64) uint64 {
+	if v >= hs.Max {
+		return hs.Count
+	}
+	last := histBucket(v)
+	var n uint64
+	for i := 0; i <= last; i++ {
+		n += hs.counts[i]
+	}
+	return n
+}
+
+// Histograms holds the latency distributions in ms, DefaultHistograms holds the global
+// ones and each stream has its own if TransportOption.StreamHistograms is set
+type Histograms struct {
+	Rtt      Histogram   // rtt samples taken from acks
+	Rto      Histogram   // rto updated after each rtt sample
+	DialTime Histogram   // cost from sending or receiving SYN to establish
+	AckCost  []Histogram // cost from first transmission to ack, indexed by xmit-1
+	CopyGap  Histogram   // from the first copy of a segment received to the next one
+}
+
+func newHistograms() *Histograms {
+	return &Histograms{AckCost: make([]Histogram, STAT_XMIT_MAX)}
+}
+
+// Reset values to zero
+func (hs *Histograms) Reset() {
+	hs.Rtt.Reset()
+	hs.Rto.Reset()
+	hs.DialTime.Reset()
+	hs.CopyGap.Reset()
+	for i := range hs.AckCost {
+		hs.AckCost[i].Reset()
+	}
+}
+
+// DefaultHistograms is the global latency distributions collector
+var DefaultHistograms = newHistograms()
+
+// Histograms returns the latency distributions of the stream, nil unless
+// TransportOption.StreamHistograms is set. It is safe to use concurrently
+func (s *UDPStream) Histograms() *Histograms {
+	return s.hist
+}
+
+func statRtt(h *Histograms, rtt int) {
+	DefaultHistograms.Rtt.Record(int64(rtt))
+	if h != nil {
+		h.Rtt.Record(int64(rtt))
+	}
+}
+
+func statDialTime(h *Histograms, ms int64) {
+	DefaultHistograms.DialTime.Record(ms)
+	if h != nil {
+		h.DialTime.Record(ms)
+	}
+}
+
+func statCopyGap(h *Histograms, ms int64) {
+	DefaultHistograms.CopyGap.Record(ms)
+	if h != nil {
+		h.CopyGap.Record(ms)
+	}
+}
@@ -0,0 +1,171 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// InputOverload is what a tunnel does with a datagram received when the input queues it tries
+// are full, the zero value blocks as the tunnels always did
+type InputOverload int
+
+const (
+	InputBlock      InputOverload = iota // waits for room, stalling the reads of the tunnel
+	InputDropNewest                      // drops the datagram received
+	InputDropOldest                      // drops the oldest datagram queued to make room for it
+)
+
+// InputDispatch is how a tunnel spreads the datagrams received over its input queues, the
+// TunnelProcessor queues of its own, or with InputByStream the TunnelProcessor queues shared
+// by all the tunnels of the transport
+type InputDispatch int
+
+const (
+	InputRoundRobin InputDispatch = iota // the queues in turn, trying InputTime of them
+	InputByStream                        // the queue of the stream by the hash of its uuid
+)
+
+type inputMsg struct {
+	data   []byte
+	tunnel *UDPTunnel
+	addr   net.Addr
+	stream *UDPStream // of the datagram when queued, nil if unknown
+}
+
+// queueInput queues the datagram received by tunnel to one of queues, see InputDispatch. The datagrams of the unknown streams are only queued
+// below InputOpenLimit and the ones of a stream below InputStreamLimit pending, so that the
+// established streams and each of them get their share under overload. The stream is only
+// looked up if one of the limits is set
+func (t *UDPTransport) queueInput(queues []chan *inputMsg, poll *int, data []byte, tunnel *UDPTunnel, addr net.Addr) {
+	msg := &inputMsg{data: data, tunnel: tunnel, addr: addr}
+	var uuid gouuid.UUID
+	copy(uuid[:], data)
+	open := false // of an unknown stream, under InputOpenLimit
+	if t.InputStreamLimit > 0 || t.InputOpenLimit > 0 {
+		if s, ok := t.streamm.Get(uuid); !ok {
+			open = t.InputOpenLimit > 0 && uuid != gouuid.Nil
+		} else if t.InputStreamLimit > 0 {
+			msg.stream = s.(*UDPStream)
+			if pending := atomic.AddInt32(&msg.stream.inputPending, 1); pending > int32(t.InputStreamLimit) {
+				t.dropInput(msg, &DefaultSnmp.InputStreamDrops)
+				return
+			}
+		}
+	}
+
+	var queue chan *inputMsg
+	tries := t.InputTime
+	if t.InputDispatch == InputByStream {
+		tries = 1
+	}
+	for i := 0; i < tries; i++ {
+		queue = t.inputQueue(queues, poll, uuid)
+		if open && len(queue) >= t.InputOpenLimit {
+			continue
+		}
+		select {
+		case queue <- msg:
+			return
+		default:
+		}
+	}
+	if open {
+		t.dropInput(msg, &DefaultSnmp.InputOpenDrops)
+		return
+	}
+
+	switch t.InputOverload {
+	case InputBlock:
+		select {
+		case queue <- msg:
+		case <-tunnel.die:
+			t.doneInput(msg)
+		case <-t.die:
+			t.doneInput(msg)
+		}
+		return
+	case InputDropOldest:
+		select {
+		case old := <-queue:
+			t.dropInput(old, &DefaultSnmp.InputOldestDrops)
+		default:
+		}
+		select {
+		case queue <- msg:
+			return
+		default:
+		}
+	}
+	t.dropInput(msg, &DefaultSnmp.InputFullDrops)
+}
+
+// tunnelQueues returns the input queues of a new tunnel, TunnelProcessor queues of its own, left
+// to NewTunnel to start until the tunnel closes, or with InputByStream the ones shared by all
+// the tunnels, started on first use until the transport closes, with the tunnel lock held
+func (t *UDPTransport) tunnelQueues() []chan *inputMsg {
+	if t.InputDispatch != InputByStream {
+		queues := make([]chan *inputMsg, t.TunnelProcessor)
+		for i := range queues {
+			queues[i] = make(chan *inputMsg, t.InputQueue)
+		}
+		return queues
+	}
+	if len(t.inputQueues) == 0 {
+		for i := 0; i < t.TunnelProcessor; i++ {
+			queue := make(chan *inputMsg, t.InputQueue)
+			t.inputQueues = append(t.inputQueues, queue)
+			go t.processInput(queue, t.die)
+		}
+	}
+	return t.inputQueues
+}
+
+// inputQueue returns the queue of the datagram of the stream uuid out of queues, the next one
+// from *poll in turn unless InputByStream
+func (t *UDPTransport) inputQueue(queues []chan *inputMsg, poll *int, uuid gouuid.UUID) chan *inputMsg {
+	if t.InputDispatch == InputByStream {
+		// the datagrams of a stream are input in order by a single goroutine, whatever the
+		// tunnel they are received by
+		return queues[int(fnv32(uuid)%uint32(len(queues)))]
+	}
+	queue := queues[*poll%len(queues)]
+	*poll++
+	return queue
+}
+
+// dropInput drops msg counting it by reason
+func (t *UDPTransport) dropInput(msg *inputMsg, reason *uint64) {
+	atomic.AddUint64(reason, 1)
+	atomic.AddUint64(&msg.tunnel.stats.inDrops, 1)
+	t.doneInput(msg)
+}
+
+// doneInput releases msg once handled or dropped
+func (t *UDPTransport) doneInput(msg *inputMsg) {
+	if msg.stream != nil {
+		atomic.AddInt32(&msg.stream.inputPending, -1)
+	}
+	xmitBuf.Put(msg.data)
+}
+
+// processInput handles the datagrams of queue until die closes, releasing the ones left
+func (t *UDPTransport) processInput(queue chan *inputMsg, die chan struct{}) {
+	for {
+		select {
+		case msg := <-queue:
+			t.handleInput(msg.data, msg.tunnel, msg.addr)
+			t.doneInput(msg)
+		case <-die:
+			for {
+				select {
+				case msg := <-queue:
+					t.doneInput(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
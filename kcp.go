@@ -2,6 +2,8 @@ package kcp
 
 import (
 	"encoding/binary"
+	"errors"
+	"io"
 	"math"
 	"sync"
 	"sync/atomic"
@@ -38,6 +40,10 @@ const (
 	mtuLimit = 1500
 )
 
+var (
+	errInvalidSegment = errors.New("invalid segment")
+)
+
 var (
 	// a system-wide packet buffer shared among sending, receiving and FEC
 	// to mitigate high-frequency memory allocation for packets, bytes from xmitBuf
@@ -60,8 +66,9 @@ func currentMs() (uint32, uint64) {
 	return uint32(sinceMs), sinceMs
 }
 
-// output_callback is a prototype which ought capture conn and call conn.Write
-type output_callback func(buf []byte, size int, current uint64, xmitMax, delayts uint32)
+// output_callback is a prototype which ought capture conn and call conn.Write, pushSegs is the
+// number of data segments in buf
+type output_callback func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int)
 
 /* encode 8 bits unsigned int */
 func ikcp_encode8u(p []byte, c byte) []byte {
@@ -153,6 +160,45 @@ func (seg *segment) encode(ptr []byte) []byte {
 	return ptr
 }
 
+// SegmentHeader is the decoded form of a KCP segment header
+type SegmentHeader struct {
+	Conv uint32
+	Cmd  uint8
+	Frg  uint8
+	Wnd  uint16
+	Ts   uint32
+	Sn   uint32
+	Una  uint32
+	Len  uint32
+}
+
+// DecodeSegments walks through the KCP segments packed in data and calls fn
+// for each of them with the segment header and payload, it stops at the first
+// malformed segment and returns an error
+func DecodeSegments(data []byte, fn func(hdr *SegmentHeader, payload []byte)) error {
+	var hdr SegmentHeader
+	for len(data) >= IKCP_OVERHEAD {
+		data = ikcp_decode32u(data, &hdr.Conv)
+		data = ikcp_decode8u(data, &hdr.Cmd)
+		data = ikcp_decode8u(data, &hdr.Frg)
+		data = ikcp_decode16u(data, &hdr.Wnd)
+		data = ikcp_decode32u(data, &hdr.Ts)
+		data = ikcp_decode32u(data, &hdr.Sn)
+		data = ikcp_decode32u(data, &hdr.Una)
+		data = ikcp_decode32u(data, &hdr.Len)
+		if len(data) < int(hdr.Len) {
+			return io.ErrUnexpectedEOF
+		}
+		if hdr.Cmd != IKCP_CMD_PUSH && hdr.Cmd != IKCP_CMD_ACK &&
+			hdr.Cmd != IKCP_CMD_WASK && hdr.Cmd != IKCP_CMD_WINS {
+			return errInvalidSegment
+		}
+		fn(&hdr, data[:hdr.Len])
+		data = data[hdr.Len:]
+	}
+	return nil
+}
+
 // KCP defines a single KCP connection
 type KCP struct {
 	conv, mtu, mss, state                  uint32
@@ -168,6 +214,8 @@ type KCP struct {
 
 	fastresend     int32
 	nocwnd, stream int32
+	pathCwnd       uint32 // the sum of the path windows of a striping stream used as cwnd, 0 if not striping
+	ackAlone       bool   // acks and window probes are flushed in packets of their own
 
 	snd_queue []segment
 	rcv_queue []segment
@@ -180,6 +228,14 @@ type KCP struct {
 	buffer   []byte
 	reserved int
 	output   output_callback
+
+	// statistics of this connection, DefaultSnmp holds the global ones
+	inSegs, outSegs                   uint64
+	lostSegs, repeatSegs              uint64
+	fastRetransSegs, earlyRetransSegs uint64
+	hist                              *Histograms  // latency distributions of this connection, may be nil
+	tracer                            StreamTracer // may be nil
+	dedupe                            *dedupe      // accounting of the copies of the segments received, may be nil
 }
 
 type ackItem struct {
@@ -307,9 +363,56 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	if count > 0 {
 		kcp.rcv_queue = kcp.remove_front(kcp.rcv_queue, count)
 	}
+	kcp.fillRcvQueue(fast_recover)
+	return
+}
 
+// RecvControls removes from the receive queue the messages whose first byte is accepted by
+// control and passes them to recv in order, the other messages keep their order for Recv. It
+// is for the message mode, recv may not keep the message after the call
+func (kcp *KCP) RecvControls(control func(flag byte) bool, recv func(msg []byte)) {
+	var buf []byte
+	for {
+		fast_recover := len(kcp.rcv_queue) >= int(kcp.rcv_wnd)
+		kept, removed := 0, 0
+		for k := 0; k < len(kcp.rcv_queue); {
+			// a message is the segments from k to the one with frg 0
+			end := k
+			for end < len(kcp.rcv_queue) && kcp.rcv_queue[end].frg != 0 {
+				end++
+			}
+			if end == len(kcp.rcv_queue) || len(kcp.rcv_queue[k].data) == 0 || !control(kcp.rcv_queue[k].data[0]) {
+				for ; k <= end && k < len(kcp.rcv_queue); k++ {
+					kcp.rcv_queue[kept] = kcp.rcv_queue[k]
+					kept++
+				}
+				continue
+			}
+			buf = buf[:0]
+			for ; k <= end; k++ {
+				buf = append(buf, kcp.rcv_queue[k].data...)
+				kcp.delSegment(&kcp.rcv_queue[k])
+				removed++
+			}
+			recv(buf)
+		}
+		if removed == 0 {
+			return
+		}
+		for k := kept; k < len(kcp.rcv_queue); k++ {
+			kcp.rcv_queue[k] = segment{}
+		}
+		kcp.rcv_queue = kcp.rcv_queue[:kept]
+		// the room made may bring more messages
+		kcp.fillRcvQueue(fast_recover)
+	}
+}
+
+// fillRcvQueue moves the segments received in order from rcv_buf to rcv_queue, fast_recover if
+// the queue was full before
+func (kcp *KCP) fillRcvQueue(fast_recover bool) {
 	// move available data from rcv_buf -> rcv_queue
-	count = 0
+	count := 0
 	for k := range kcp.rcv_buf {
 		seg := &kcp.rcv_buf[k]
 		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue)+count < int(kcp.rcv_wnd) {
@@ -331,7 +434,6 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
 	}
-	return
 }
 
 // Send is user/upper level send, returns below zero for error
@@ -425,7 +527,8 @@ func (kcp *KCP) update_ack(rtt int32) {
 	rto = uint32(kcp.rx_srtt) + _imax_(kcp.interval, uint32(kcp.rx_rttvar)<<2)
 	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, kcp.rx_maxrto)
 
-	statRto(int(kcp.rx_rto))
+	statRtt(kcp.hist, int(rtt))
+	statRto(kcp.hist, int(kcp.rx_rto))
 }
 
 func (kcp *KCP) shrink_buf() {
@@ -450,7 +553,7 @@ func (kcp *KCP) parse_ack(sn, current uint32) {
 			// have to shift the segments behind forward,
 			// which is an expensive operation for large window
 			if seg.acked == 0 && seg.fts != 0 {
-				statAckCost(int(seg.xmit), int(_itimediff(current, seg.fts)))
+				statAckCost(kcp.hist, int(seg.xmit), int(_itimediff(current, seg.fts)))
 			}
 			seg.acked = 1
 			kcp.delSegment(seg)
@@ -483,7 +586,7 @@ func (kcp *KCP) parse_una(una, current uint32) {
 		seg := &kcp.snd_buf[k]
 		if _itimediff(una, seg.sn) > 0 {
 			if seg.acked == 0 && seg.fts != 0 {
-				statAckCost(int(seg.xmit), int(_itimediff(current, seg.fts)))
+				statAckCost(kcp.hist, int(seg.xmit), int(_itimediff(current, seg.fts)))
 			}
 			kcp.delSegment(seg)
 			count++
@@ -686,8 +789,12 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 				}
 			}
 			if repeat {
+				kcp.repeatSegs++
 				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
 			}
+			if kcp.dedupe != nil {
+				kcp.dedupe.segment(sn, repeat)
+			}
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
 			// tell remote my window size
@@ -701,6 +808,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		inSegs++
 		data = data[length:]
 	}
+	kcp.inSegs += inSegs
 	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
 
 	// update rtt with the latest ts
@@ -755,7 +863,9 @@ func (kcp *KCP) wnd_unused() uint16 {
 
 func (kcp *KCP) calc_cwnd() uint32 {
 	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
-	if kcp.nocwnd == 0 {
+	if kcp.nocwnd == 0 && kcp.pathCwnd != 0 {
+		cwnd = _imin_(kcp.pathCwnd, cwnd)
+	} else if kcp.nocwnd == 0 {
 		cwnd = _imin_(kcp.cwnd, cwnd)
 	}
 	return cwnd
@@ -776,6 +886,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	var current64 uint64
 	var xmitMax uint32
 	var delayts uint32
+	var pushSegs int
 
 	makeBuffer := func() {
 		buffer = xmitBuf.Get().([]byte)[:kcp.mtu]
@@ -789,10 +900,11 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 		size := len(buffer) - len(ptr)
 		if size+space > int(kcp.mtu) {
-			kcp.output(buffer, size, current64, xmitMax, delayts)
+			kcp.output(buffer, size, current64, xmitMax, delayts, pushSegs)
 			makeBuffer()
 			xmitMax = 0
 			delayts = 0
+			pushSegs = 0
 		}
 	}
 
@@ -800,9 +912,10 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	flushBuffer := func() {
 		size := len(buffer) - len(ptr)
 		if size > kcp.reserved {
-			kcp.output(buffer, size, current64, xmitMax, delayts)
+			kcp.output(buffer, size, current64, xmitMax, delayts, pushSegs)
 			xmitMax = 0
 			delayts = 0
+			pushSegs = 0
 		}
 	}
 
@@ -813,6 +926,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
 			ptr = seg.encode(ptr)
+			kcp.outSegs++
 			xmit := kcp.incre_ackxmit(seg.sn)
 			if xmit > xmitMax {
 				xmitMax = xmit
@@ -855,6 +969,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		seg.cmd = IKCP_CMD_WASK
 		makeSpace(IKCP_OVERHEAD)
 		ptr = seg.encode(ptr)
+		kcp.outSegs++
 	}
 
 	// flush window probing commands
@@ -862,10 +977,20 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		seg.cmd = IKCP_CMD_WINS
 		makeSpace(IKCP_OVERHEAD)
 		ptr = seg.encode(ptr)
+		kcp.outSegs++
 	}
 
 	kcp.probe = 0
 
+	// output the acks and window probes before the data is packed
+	if kcp.ackAlone && cap(buffer) != 0 && len(buffer)-len(ptr) > kcp.reserved {
+		kcp.output(buffer, len(buffer)-len(ptr), current64, xmitMax, delayts, pushSegs)
+		buffer, ptr = nil, nil
+		xmitMax = 0
+		delayts = 0
+		pushSegs = 0
+	}
+
 	// calculate window size
 	cwnd := kcp.calc_cwnd()
 
@@ -936,6 +1061,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			segment.fastack = 0
 			segment.resendts = current + segment.rto
 			lostSegs++
+			if kcp.tracer != nil {
+				kcp.tracer.RtoFired(segment.sn, segment.xmit, segment.rto)
+			}
 		}
 
 		if needsend {
@@ -950,6 +1078,8 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			need := IKCP_OVERHEAD + len(segment.data)
 			makeSpace(need)
 			ptr = segment.encode(ptr)
+			kcp.outSegs++
+			pushSegs++
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
 
@@ -976,13 +1106,16 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	// counter updates
 	sum := lostSegs
 	if lostSegs > 0 {
+		kcp.lostSegs += lostSegs
 		atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
 	}
 	if fastRetransSegs > 0 {
+		kcp.fastRetransSegs += fastRetransSegs
 		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
 		sum += fastRetransSegs
 	}
 	if earlyRetransSegs > 0 {
+		kcp.earlyRetransSegs += earlyRetransSegs
 		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
 		sum += earlyRetransSegs
 	}
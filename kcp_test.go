@@ -3,15 +3,23 @@ package kcp
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -40,6 +48,15 @@ func (sel *TestSelector) Add(tunnel *UDPTunnel) {
 	sel.tunnels = append(sel.tunnels, tunnel)
 }
 
+func (sel *TestSelector) Remove(tunnel *UDPTunnel) {
+	for i, t := range sel.tunnels {
+		if t == tunnel {
+			sel.tunnels = append(sel.tunnels[:i:i], sel.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
 func (sel *TestSelector) PickAddrs(count int) (locals, remotes []string) {
 	return sel.locals[:count], sel.remotes[:count]
 }
@@ -191,18 +208,18 @@ func TestSNMP(t *testing.T) {
 	DefaultSnmp.Reset()
 	Logf(INFO, "DefaultSnmp.ToSlice:%v", DefaultSnmp.ToSlice())
 
-	statRto(20)
+	statRto(nil, 20)
 	assert.Equal(t, uint64(20), DefaultSnmp.RtoMax)
-	statRto(30)
+	statRto(nil, 30)
 	assert.Equal(t, uint64(30), DefaultSnmp.RtoMax)
 
-	statAckCost(1, 20)
+	statAckCost(nil, 1, 20)
 	assert.Equal(t, uint64(0), DefaultSnmp.AckCostMax)
-	statAckCost(2, 20)
+	statAckCost(nil, 2, 20)
 	assert.Equal(t, uint64(20), DefaultSnmp.AckCostMax)
-	statAckCost(3, 30)
+	statAckCost(nil, 3, 30)
 	assert.Equal(t, uint64(30), DefaultSnmp.AckCostMax)
-	statAckCost(STAT_XMIT_MAX+1, 40)
+	statAckCost(nil, STAT_XMIT_MAX+1, 40)
 	assert.Equal(t, uint64(30), DefaultSnmp.AckCostMax)
 
 	statXmitInterval(1, 20)
@@ -242,6 +259,172 @@ func TestSNMP(t *testing.T) {
 	assert.Equal(t, currEstab, DefaultSnmp.CurrEstab)
 }
 
+func TestHistogram(t *testing.T) {
+	for v := uint64(0); v <= HistogramMaxValue; v++ {
+		idx := histBucket(v)
+		if v > histBucketBound(idx) || (idx > 0 && v <= histBucketBound(idx-1)) {
+			t.Fatalf("value %v out of bucket %v", v, idx)
+		}
+	}
+	assert.Equal(t, histBuckets-1, histBucket(HistogramMaxValue+1))
+
+	h := &Histogram{}
+	for v := int64(1); v <= 1000; v++ {
+		h.Record(v)
+	}
+	h.Record(-1)
+	hs := h.Snapshot()
+	assert.Equal(t, uint64(1001), hs.Count)
+	assert.Equal(t, uint64(1000), hs.Max)
+	assert.Equal(t, uint64(0), hs.Percentile(0))
+	assert.Equal(t, uint64(1000), hs.Percentile(1))
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		p := float64(hs.Percentile(q))
+		assert.InDelta(t, q*1000, p, q*1000/histSubSize+1, "q:%v", q)
+	}
+	assert.Equal(t, uint64(11), hs.CountLE(10))
+	assert.Equal(t, hs.Count, hs.CountLE(1000))
+
+	hs = h.SnapshotReset()
+	assert.Equal(t, uint64(1001), hs.Count)
+	assert.Equal(t, uint64(0), h.Snapshot().Count)
+	assert.Equal(t, uint64(0), h.Snapshot().Percentile(0.5))
+
+	statAckCost(nil, 1, 30)
+	assert.True(t, DefaultHistograms.AckCost[0].Snapshot().Count > 0)
+
+	go echoServer()
+	// the option is shared by both transports
+	clientTransport.StreamHistograms = true
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	clientTransport.StreamHistograms = false
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	err = echoTester(stream, 1024, 10)
+	assert.NoError(t, err)
+
+	sh := stream.Histograms()
+	assert.True(t, sh.Rtt.Snapshot().Count > 0)
+	assert.True(t, sh.Rto.Snapshot().Count > 0)
+	assert.Equal(t, uint64(1), sh.DialTime.Snapshot().Count)
+	assert.True(t, sh.AckCost[0].Snapshot().Count > 0)
+	assert.True(t, DefaultHistograms.DialTime.Snapshot().Count > 0)
+
+	go echoServer()
+	stream2, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	defer stream2.Close()
+	assert.Nil(t, stream2.Histograms())
+}
+
+type testLogHandler struct {
+	lvl     LogLevel
+	records []string
+}
+
+func (h *testLogHandler) Enabled(lvl LogLevel) bool {
+	return lvl >= h.lvl
+}
+
+func (h *testLogHandler) Handle(lvl LogLevel, msg string, kvs []interface{}) {
+	h.records = append(h.records, fmt.Sprint(lvl, " ", msg, " ", kvs))
+}
+
+func TestLogger(t *testing.T) {
+	assert.Equal(t, "DEBUG", DEBUG.String())
+	assert.Equal(t, "FATAL", FATAL.String())
+
+	h := &testLogHandler{lvl: INFO}
+	l := NewHandlerLogger(h)
+	sl := l.With("uuid", 1, "accepted", true)
+	sl.Log(DEBUG, "UDPStream::heartbeat")
+	sl.Log(INFO, "UDPStream::Close", "once", true)
+	l.With("tunnel", "127.0.0.1:1").Log(ERROR, "UDPTunnel::notifyReadError", "err", io.EOF)
+	assert.Equal(t, []string{
+		"INFO UDPStream::Close [uuid 1 accepted true once true]",
+		"ERROR UDPTunnel::notifyReadError [tunnel 127.0.0.1:1 err EOF]",
+	}, h.records)
+
+	ql := NewLevelLogger(l, ERROR).With("uuid", 2)
+	assert.False(t, ql.Enabled(WARN))
+	ql.Log(WARN, "UDPStream::reset")
+	ql.Log(ERROR, "UDPStream::reset")
+	assert.Equal(t, 3, len(h.records))
+	assert.Equal(t, "ERROR UDPStream::reset [uuid 2]", h.records[2])
+
+	var logs []string
+	oldLogf := Logf
+	Logf = func(lvl LogLevel, f string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(f, args...))
+	}
+	DefaultLogger.With("uuid", 3).Log(INFO, "UDPStream::Close", "once", false, "odd")
+	assert.True(t, DefaultLogger.Enabled(DEBUG))
+	// nothing is formatted without Logf
+	Logf = nil
+	assert.False(t, DefaultLogger.Enabled(ERROR))
+	DefaultLogger.Log(ERROR, "UDPStream::Close", "once", false)
+	Logf = oldLogf
+	assert.Equal(t, []string{"UDPStream::Close uuid:3 once:false !BADKEY:odd"}, logs)
+}
+
+func TestQlogTracer(t *testing.T) {
+	var buf bytes.Buffer
+	qt := NewQlogTracer(&buf, "client")
+	clientTransport.Tracer = qt
+	defer func() {
+		clientTransport.Tracer = nil
+	}()
+
+	go echoServer()
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	err = echoTester(stream, 1024, 10)
+	assert.NoError(t, err)
+	stream.Close()
+	assert.NoError(t, qt.Err())
+
+	names := make(map[string]int)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for i, line := range lines {
+		var ev map[string]interface{}
+		err := json.Unmarshal([]byte(line), &ev)
+		assert.NoError(t, err, line)
+		if i == 0 {
+			assert.Equal(t, "NDJSON", ev["qlog_format"])
+			continue
+		}
+		assert.Equal(t, stream.GetUUID().String(), ev["group_id"])
+		names[ev["name"].(string)]++
+	}
+	for _, name := range []string{"kcp:stream_created", "kcp:dial_started", "kcp:control_sent",
+		"kcp:established", "kcp:flushed", "kcp:closed"} {
+		assert.True(t, names[name] > 0, name)
+	}
+}
+
+func TestParallelTriggeredTrace(t *testing.T) {
+	var buf bytes.Buffer
+	opt := (&TransportOption{Tracer: NewQlogTracer(&buf, "client")}).SetDefault()
+	uuid, _ := gouuid.NewV4()
+	// nobody listens, the stream is only fed the frames below
+	s, err := newUDPStream(uuid, false, []string{"127.0.0.1:27001", "127.0.0.1:27002"}, clientSel, func(gouuid.UUID) {}, opt)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	// the second trigger extends the parallel period started by the first
+	for i := 0; i < 2; i++ {
+		frame := encodeTestPacket(IKCP_CMD_ACK, 0)
+		s.encodeFrameHeader(frame, 0)
+		s.setFrameReplicaTrigger(frame)
+		s.input(frame, nil, nil)
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&s.stats.parallels))
+	assert.Equal(t, 1, strings.Count(buf.String(), `"kcp:parallel_triggered"`))
+	assert.Contains(t, buf.String(), `"by_peer":true`)
+}
+
 func TestTransportOption(t *testing.T) {
 	opt := &TransportOption{
 		DialTimeout: time.Second,
@@ -266,23 +449,1048 @@ func TestTransportOption(t *testing.T) {
 	}
 }
 
+func TestTransportStreamOption(t *testing.T) {
+	// shared by both transports, windows are symmetric to survive the negotiation
+	clientTransport.StreamOption = &StreamOption{
+		Nodelay:         1,
+		Interval:        15,
+		Resend:          2,
+		Nc:              1,
+		SndWnd:          512,
+		RcvWnd:          512,
+		Mtu:             1200,
+		DeadLink:        30,
+		ParallelDelayMs: 300,
+		AckNoDelayCount: 8,
+		UseParallel:     true,
+	}
+	defer func() {
+		clientTransport.StreamOption = nil
+	}()
+
+	go echoServer()
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	stream.mu.Lock()
+	assert.Equal(t, uint32(1), stream.kcp.nodelay)
+	assert.Equal(t, uint32(15), stream.kcp.interval)
+	assert.Equal(t, int32(2), stream.kcp.fastresend)
+	assert.Equal(t, uint32(512), stream.kcp.snd_wnd)
+	assert.Equal(t, uint32(512), stream.kcp.rcv_wnd)
+	assert.Equal(t, uint32(1200), stream.kcp.mtu)
+	assert.Equal(t, uint32(30), stream.kcp.dead_link)
+	policy, ok := stream.parallelPolicy()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), policy.DelayMs)
+	assert.Equal(t, uint32(DefaultParallelIntervalMs), policy.IntervalMs)
+	assert.Equal(t, uint32(8), stream.ackNoDelayCount)
+	assert.Equal(t, float32(DefaultAckNoDelayRatio), stream.ackNoDelayRatio)
+	assert.True(t, policy.Always)
+	stream.mu.Unlock()
+
+	// the fields of SetNoDelay left zero are kept, -1 sets them to zero
+	stream.SetOption(&StreamOption{SndWnd: 256, RcvWnd: 256})
+	stream.SetOption(&StreamOption{Resend: -1, Nc: -1})
+	stream.mu.Lock()
+	assert.Equal(t, uint32(1), stream.kcp.nodelay)
+	assert.Equal(t, uint32(15), stream.kcp.interval)
+	assert.Equal(t, int32(0), stream.kcp.fastresend)
+	assert.Equal(t, int32(0), stream.kcp.nocwnd)
+	assert.Equal(t, uint32(256), stream.kcp.snd_wnd)
+	stream.mu.Unlock()
+
+	opt := new(TransportOption).SetDefault()
+	opt.TunnelOption = &TunnelOption{ReadBuffer: 1024 * 1024}
+	tunnel, err := newUDPTunnel("127.0.0.1:0", opt, nil)
+	assert.NoError(t, err)
+	tunnel.Close()
+}
+
 func TestDialInfoEncode(t *testing.T) {
 	uuid, err := gouuid.NewV1()
 	assert.NoError(t, err)
 
 	s1 := &UDPStream{
-		uuid: uuid,
+		uuid:        uuid,
+		kcp:         NewKCP(1, nil),
+		features:    FeatureSACK | FeatureDatagram,
+		dialPayload: []byte("hello"),
 	}
 
 	locals := []string{"127.0.0.1:1234", "127.0.0.1:1235"}
 	buf, err := s1.encodeDialInfo(locals)
 	assert.NoError(t, err)
-	decodeLocals, err := s1.decodeDialInfo(buf)
+	decodeLocals, ext, err := s1.decodeDialInfo(buf)
 	assert.NoError(t, err)
 
 	assert.Equal(t, len(locals), len(decodeLocals))
 	assert.Equal(t, locals[0], decodeLocals[0])
 	assert.Equal(t, locals[1], decodeLocals[1])
+	assert.Equal(t, IKCP_MTU_DEF, ext.Mtu)
+	assert.Equal(t, IKCP_WND_SND, ext.SndWnd)
+	assert.Equal(t, IKCP_WND_RCV, ext.RcvWnd)
+	assert.Equal(t, FeatureSACK|FeatureDatagram, ext.Features)
+	assert.Equal(t, []byte("hello"), ext.Payload)
+	assert.Nil(t, ext.Metadata)
+
+	s1.openMeta = []byte("example.com:443")
+	buf, err = s1.encodeDialInfo(locals)
+	assert.NoError(t, err)
+	_, ext, err = s1.decodeDialInfo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("example.com:443"), ext.Metadata)
+	s1.openMeta = make([]byte, OpenMetadataMax+1)
+	_, err = s1.encodeDialInfo(locals)
+	assert.Equal(t, errOpenMetadata, err)
+	s1.openMeta = nil
+
+	// DV1 dial info carries no extension area
+	dv1Len := 2 + len(locals) + len(locals[0]) + len(locals[1])
+	assert.Equal(t, DV2, buf[dv1Len])
+	decodeLocals, ext, err = s1.decodeDialInfo(buf[:dv1Len])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(decodeLocals))
+	assert.Nil(t, ext)
+
+	// unknown TLVs are skipped
+	p, err := encodeDialExt(nil, &DialParams{Mtu: 1200})
+	assert.NoError(t, err)
+	p = append(p, 0xFF, 1, 0, 0xFF)
+	binary.LittleEndian.PutUint16(p[1:], uint16(len(p)-3))
+	ext, err = decodeDialExt(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, ext.Mtu)
+	_, err = decodeDialExt(p[:len(p)-1])
+	assert.Error(t, err)
+
+	agreed := negotiate(&DialParams{Mtu: 1400, SndWnd: 32, RcvWnd: 256, Features: FeatureSACK | FeatureFEC},
+		&DialParams{Mtu: 1200, SndWnd: 128, Interval: 20, Features: FeatureSACK | FeatureEncryption})
+	assert.Equal(t, &DialParams{Mtu: 1200, SndWnd: 32, RcvWnd: 256, Interval: 20, Features: FeatureSACK}, agreed)
+}
+
+func TestDialNegotiation(t *testing.T) {
+	copt := &TransportOption{DialTimeout: time.Second * 2}
+	copt.StreamOption = &StreamOption{Nodelay: 1, Interval: 20, Resend: 2, Nc: 1, Mtu: 1400,
+		SndWnd: 128, RcvWnd: 128, Features: FeatureSACK | FeatureFEC, DialPayload: []byte("client")}
+	sopt := &TransportOption{DialTimeout: time.Second * 2}
+	sopt.StreamOption = &StreamOption{Nodelay: 1, Interval: 10, Resend: 2, Nc: 1, Mtu: 1200,
+		SndWnd: 64, RcvWnd: 256, Features: FeatureSACK | FeatureEncryption, DialPayload: []byte("server")}
+	clientTransport, clientSel, serverTransport := newTestTransports(t, 1000, copt, sopt)
+	defer clientTransport.Close()
+	defer serverTransport.Close()
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			Logf(ERROR, "TestDialNegotiation accept err:%v", err)
+		}
+		accepted <- stream
+		defer stream.Close()
+		buf := make([]byte, 65536)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = stream.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	err = echoTester(stream, 4096, 10)
+	assert.NoError(t, err)
+
+	agreed := stream.Negotiated()
+	if agreed == nil {
+		t.Fatalf("no SYN reply")
+	}
+	assert.Equal(t, 1200, agreed.Mtu)
+	assert.Equal(t, 128, agreed.SndWnd)
+	assert.Equal(t, 64, agreed.RcvWnd)
+	assert.Equal(t, 10, agreed.Interval)
+	assert.Equal(t, FeatureSACK, agreed.Features)
+	assert.Equal(t, []byte("server"), agreed.Payload)
+	stream.mu.Lock()
+	assert.Equal(t, uint32(1200), stream.kcp.mtu)
+	assert.Equal(t, uint32(128), stream.kcp.snd_wnd)
+	assert.Equal(t, uint32(64), stream.kcp.rcv_wnd)
+	stream.mu.Unlock()
+
+	serverStream := <-accepted
+	sagreed := serverStream.Negotiated()
+	assert.Equal(t, FeatureSACK, sagreed.Features)
+	assert.Equal(t, []byte("client"), sagreed.Payload)
+	serverStream.mu.Lock()
+	assert.Equal(t, uint32(128), serverStream.kcp.rcv_wnd)
+	assert.Equal(t, uint32(64), serverStream.kcp.snd_wnd)
+	serverStream.mu.Unlock()
+}
+
+func TestOpenWithPayload(t *testing.T) {
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	_, err := clientTransport.OpenWithPayload(locals, remotes, make([]byte, OpenMetadataMax+1))
+	assert.Equal(t, errOpenMetadata, err)
+
+	type acceptResult struct {
+		meta []byte
+		data []byte
+	}
+	accepted := make(chan acceptResult, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			Logf(ERROR, "TestOpenWithPayload accept err:%v", err)
+			return
+		}
+		defer stream.Close()
+		meta := stream.OpenMetadata()
+		buf := make([]byte, 64)
+		stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, _ := stream.Read(buf)
+		accepted <- acceptResult{meta: meta, data: buf[:n]}
+	}()
+
+	stream, err := clientTransport.OpenWithPayload(locals, remotes, []byte("example.com:443"))
+	assert.NoError(t, err)
+	defer stream.Close()
+	// written before the SYN is acknowledged
+	_, err = stream.Write([]byte("ping"))
+	assert.NoError(t, err)
+
+	select {
+	case res := <-accepted:
+		assert.Equal(t, []byte("example.com:443"), res.meta)
+		assert.Equal(t, []byte("ping"), res.data)
+	case <-time.After(time.Second * 5):
+		t.Fatal("accept timeout")
+	}
+}
+
+// dropFirstProxy relays the datagrams between a client and server, dropping the first one of
+// the client
+func dropFirstProxy(t *testing.T, server string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	assert.NoError(t, err)
+	go func() {
+		var client *net.UDPAddr
+		dropped := false
+		buf := make([]byte, mtuLimit)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if udpAddrEqual(addr, serverAddr) {
+				if client != nil {
+					conn.WriteToUDP(buf[:n], client)
+				}
+				continue
+			}
+			client = addr
+			if !dropped {
+				dropped = true
+				continue
+			}
+			conn.WriteToUDP(buf[:n], serverAddr)
+		}
+	}()
+	return conn
+}
+
+func TestOpenWithPayloadSynLost(t *testing.T) {
+	proxy := dropFirstProxy(t, rAddrs[0])
+	defer proxy.Close()
+
+	accepted := make(chan []byte, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		buf := make([]byte, 64)
+		stream.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, _ := stream.Read(buf)
+		accepted <- append(stream.OpenMetadata(), buf[:n]...)
+	}()
+
+	locals, _ := clientSel.PickAddrs(1)
+	stream, err := clientTransport.OpenWithPayload(locals, []string{proxy.LocalAddr().String()}, []byte("meta:"))
+	assert.NoError(t, err)
+	defer stream.Close()
+	// no congestion window, the packet written next is sent before the SYN is acknowledged and
+	// arrives first as the SYN is dropped
+	stream.SetNoDelay(1, 10, 2, 1)
+	time.Sleep(10 * time.Millisecond)
+	_, err = stream.Write([]byte("ping"))
+	assert.NoError(t, err)
+
+	select {
+	case data := <-accepted:
+		assert.Equal(t, "meta:ping", string(data))
+	case <-time.After(time.Second * 5):
+		t.Fatal("accept timeout")
+	}
+	select {
+	case <-stream.chRst:
+		t.Fatal("stream reset")
+	default:
+	}
+}
+
+func TestResumptionTicket(t *testing.T) {
+	key := []byte("ticket key")
+	uuid, err := gouuid.NewV4()
+	assert.NoError(t, err)
+	by, err := gouuid.NewV4()
+	assert.NoError(t, err)
+	now := time.Now()
+
+	issued, err := sealTicket(key, uuid, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, ticketSize, len(issued))
+	ticket := presentTicket(issued, by)
+	from, id, expire, err := openTicket(key, ticket, by, now)
+	assert.NoError(t, err)
+	assert.Equal(t, uuid, from)
+	assert.Equal(t, now.Add(time.Minute).Unix(), expire.Unix())
+
+	// the ticket presented by another stream, or issued without the secret
+	_, _, _, err = openTicket(key, ticket, uuid, now)
+	assert.Equal(t, errTicketInvalid, err)
+	_, _, _, err = openTicket(key, issued, by, now)
+	assert.Equal(t, errTicketInvalid, err)
+
+	_, _, _, err = openTicket([]byte("other key"), ticket, by, now)
+	assert.Equal(t, errTicketInvalid, err)
+	_, _, _, err = openTicket(nil, ticket, by, now)
+	assert.Equal(t, errTicketInvalid, err)
+	_, _, _, err = openTicket(key, ticket, by, now.Add(time.Hour))
+	assert.Equal(t, errTicketExpired, err)
+	_, _, _, err = openTicket(key, ticket[:ticketSize-1], by, now)
+	assert.Equal(t, errTicketInvalid, err)
+
+	cache := newTicketCache()
+	assert.True(t, cache.take(id, expire, now))
+	assert.False(t, cache.take(id, expire, now))
+	other, err := sealTicket(key, uuid, now.Add(time.Minute))
+	assert.NoError(t, err)
+	_, otherID, _, err := openTicket(key, presentTicket(other, by), by, now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, otherID)
+	// the expired ids are dropped
+	assert.True(t, cache.take(otherID, now.Add(time.Hour), now.Add(time.Minute*2)))
+	assert.Equal(t, 1, len(cache.ids))
+
+	ticket[1] ^= 0xFF
+	_, _, _, err = openTicket(key, ticket, by, now)
+	assert.Equal(t, errTicketInvalid, err)
+}
+
+func TestResume(t *testing.T) {
+	// shared by both transports
+	clientTransport.TicketKey = []byte("ticket key")
+	defer func() {
+		clientTransport.TicketKey = nil
+	}()
+
+	accepted := make(chan *UDPStream, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			stream, err := serverTransport.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- stream
+			go handleEchoClient(stream)
+		}
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	first, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer first.Close()
+	assert.NoError(t, echoTester(first, 64, 1))
+	ticket := first.ResumptionTicket()
+	assert.Equal(t, ticketSize, len(ticket))
+	assert.Equal(t, gouuid.Nil, (<-accepted).ResumedFrom())
+
+	// the dialer restarted and lost first
+	second, err := clientTransport.Resume(locals, remotes, ticket)
+	assert.NoError(t, err)
+	defer second.Close()
+	assert.NoError(t, echoTester(second, 64, 1))
+	assert.Equal(t, first.GetUUID(), (<-accepted).ResumedFrom())
+	assert.Equal(t, ticketSize, len(second.ResumptionTicket()))
+	assert.NotEqual(t, ticket, second.ResumptionTicket())
+
+	// the acceptor closed the resumed stream
+	first.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = first.Read(make([]byte, 64))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// a ticket is taken once
+	third, err := clientTransport.Resume(locals, remotes, ticket)
+	assert.NoError(t, err)
+	defer third.Close()
+	assert.NoError(t, echoTester(third, 64, 1))
+	assert.Equal(t, gouuid.Nil, (<-accepted).ResumedFrom())
+
+	_, err = clientTransport.Resume(locals, remotes, nil)
+	assert.Equal(t, errNoTicket, err)
+}
+
+func TestRebind(t *testing.T) {
+	clientTransport.TicketKey = []byte("ticket key")
+	defer func() {
+		clientTransport.TicketKey = nil
+	}()
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- stream
+		handleEchoClient(stream)
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverStream := <-accepted
+
+	// the dialer moves to new tunnels
+	newTunnels := newClientTunnels(t, 100)
+	oldTunnels := clientSel.tunnels
+	clientSel.tunnels = newTunnels
+	defer func() {
+		clientSel.tunnels = oldTunnels
+		releaseClientTunnels(newTunnels)
+	}()
+
+	ticket := stream.ResumptionTicket()
+	assert.NoError(t, stream.Rebind())
+	assert.Equal(t, newTunnels[0].LocalAddr().String(), stream.LocalAddr().String())
+	assert.NoError(t, echoTester(stream, 64, 10))
+	for i, addr := range serverStream.RemoteAddrs() {
+		assert.Equal(t, newTunnels[i].LocalAddr().String(), addr.String())
+	}
+	// the ticket is re-issued, the one presented is taken
+	assert.Equal(t, ticketSize, len(stream.ResumptionTicket()))
+	assert.NotEqual(t, ticket, stream.ResumptionTicket())
+	stream.mu.Lock()
+	stream.ticket = ticket
+	stream.mu.Unlock()
+	assert.Equal(t, errRebindRefused, stream.Rebind())
+	assert.NoError(t, echoTester(stream, 64, 1))
+
+	// an expired ticket is not presented
+	expired := append([]byte(nil), ticket...)
+	encode32u(expired[1+gouuid.Size+ticketIDSize:], uint32(time.Now().Add(-time.Minute).Unix()))
+	stream.mu.Lock()
+	stream.ticket = expired
+	stream.mu.Unlock()
+	assert.Equal(t, errTicketExpired, stream.Rebind())
+
+	stream.mu.Lock()
+	stream.ticket = nil
+	stream.mu.Unlock()
+	assert.Equal(t, errNoTicket, stream.Rebind())
+}
+
+// newClientTunnels creates ipsCount tunnels of clientTransport from lPortStart+offset, left
+// out of clientSel
+func newClientTunnels(t *testing.T, offset int) []*UDPTunnel {
+	tunnels := make([]*UDPTunnel, 0)
+	for i := 0; i < ipsCount; i++ {
+		tunnel, err := clientTransport.NewTunnel("127.0.0.1:" + strconv.Itoa(lPortStart+offset+i))
+		assert.NoError(t, err)
+		tunnels = append(tunnels, tunnel)
+	}
+	clientSel.tunnels = clientSel.tunnels[:len(clientSel.tunnels)-len(tunnels)]
+	return tunnels
+}
+
+// newTestTransports returns a client and a server transport of their own, connected by
+// ipsCount tunnels each at offset from the ports of the shared ones
+func newTestTransports(t *testing.T, offset int, copt, sopt *TransportOption) (*UDPTransport, *TestSelector, *UDPTransport) {
+	locals, remotes := make([]string, 0), make([]string, 0)
+	for i := 0; i < ipsCount; i++ {
+		locals = append(locals, "127.0.0.1:"+strconv.Itoa(lPortStart+offset+i))
+		remotes = append(remotes, "127.0.0.1:"+strconv.Itoa(rPortStart+offset+i))
+	}
+	csel, _ := NewTestSelector(locals, remotes)
+	client, err := NewUDPTransport(csel, copt)
+	assert.NoError(t, err)
+	ssel, _ := NewTestSelector(remotes, locals)
+	server, err := NewUDPTransport(ssel, sopt)
+	assert.NoError(t, err)
+	for i := 0; i < ipsCount; i++ {
+		_, err = client.NewTunnel(locals[i])
+		assert.NoError(t, err)
+		_, err = server.NewTunnel(remotes[i])
+		assert.NoError(t, err)
+	}
+	return client, csel, server
+}
+
+func releaseClientTunnels(tunnels []*UDPTunnel) {
+	for _, tunnel := range tunnels {
+		clientTransport.CloseTunnel(tunnel.LocalAddr().String())
+	}
+}
+
+func TestMigration(t *testing.T) {
+	type migration struct {
+		s        *UDPStream
+		path     int
+		from, to string
+	}
+	migrated := make(chan migration, ipsCount)
+	// shared by both transports
+	clientTransport.OnMigrate = func(s *UDPStream, path int, from, to net.Addr) {
+		migrated <- migration{s, path, from.String(), to.String()}
+	}
+	defer func() {
+		clientTransport.OnMigrate = nil
+	}()
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- stream
+		handleEchoClient(stream)
+	}()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverStream := <-accepted
+	challenges, migrations := DefaultSnmp.Copy().PathChallenges, DefaultSnmp.Copy().PathMigrations
+
+	// a NAT rebinding, the dialer sends from new addresses without telling the acceptor
+	newTunnels := newClientTunnels(t, 200)
+	defer releaseClientTunnels(newTunnels)
+	oldRemotes := serverStream.RemoteAddrs()
+	stream.mu.Lock()
+	stream.tunnels = newTunnels
+	stream.mu.Unlock()
+
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < ipsCount; i++ {
+		select {
+		case m := <-migrated:
+			assert.Equal(t, serverStream, m.s)
+			assert.Equal(t, oldRemotes[m.path].String(), m.from)
+			assert.Equal(t, newTunnels[m.path].LocalAddr().String(), m.to)
+		case <-time.After(time.Second * 5):
+			t.Fatal("migration timeout")
+		}
+		// replicas are only sent on loss, the second path needs traffic of its own
+		stream.SetUseParallel(true)
+		assert.NoError(t, echoTester(stream, 64, 1))
+	}
+	for i, addr := range serverStream.RemoteAddrs() {
+		assert.Equal(t, newTunnels[i].LocalAddr().String(), addr.String())
+	}
+	stats := serverStream.Stats()
+	assert.Equal(t, uint64(ipsCount), stats.PathMigrations)
+	assert.Equal(t, uint64(ipsCount), stats.PathChallenges)
+	assert.Equal(t, uint64(0), stream.Stats().PathMigrations)
+	assert.Equal(t, challenges+uint64(ipsCount), DefaultSnmp.Copy().PathChallenges)
+	assert.Equal(t, migrations+uint64(ipsCount), DefaultSnmp.Copy().PathMigrations)
+	assert.NoError(t, echoTester(stream, 64, 10))
+}
+
+func TestMigrationForged(t *testing.T) {
+	defer func(timeout time.Duration) {
+		PathChallengeTimeout = timeout
+	}(PathChallengeTimeout)
+	PathChallengeTimeout = time.Millisecond * 200
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- stream
+		handleEchoClient(stream)
+	}()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverStream := <-accepted
+	fails := DefaultSnmp.Copy().PathChallengeFails
+
+	// the dialer answers the challenges without the path key of the handshake
+	newTunnels := newClientTunnels(t, 800)
+	defer releaseClientTunnels(newTunnels)
+	oldRemotes := serverStream.RemoteAddrs()
+	stream.mu.Lock()
+	stream.tunnels = newTunnels
+	stream.pathKey = make([]byte, pathKeySize)
+	stream.mu.Unlock()
+
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	assert.NoError(t, echoTester(stream, 64, 1))
+	time.Sleep(PathChallengeTimeout * 2)
+	assert.Equal(t, oldRemotes, serverStream.RemoteAddrs())
+	assert.Equal(t, uint64(0), serverStream.Stats().PathMigrations)
+	assert.NotEqual(t, uint64(0), serverStream.Stats().PathChallenges)
+	assert.True(t, DefaultSnmp.Copy().PathChallengeFails > fails)
+}
+
+func TestAddRemovePath(t *testing.T) {
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- stream
+		handleEchoClient(stream)
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverStream := <-accepted
+
+	// a new interface comes up
+	newTunnels := newClientTunnels(t, 300)
+	defer releaseClientTunnels(newTunnels)
+	local := newTunnels[0].LocalAddr().String()
+	assert.NoError(t, stream.AddPath(local, remotes[0]))
+	assert.Equal(t, errPathExist, stream.AddPath(local, remotes[0]))
+	assert.Equal(t, errTunnelPick, stream.AddPath("127.0.0.1:1", remotes[0]))
+	assert.Equal(t, ipsCount+1, len(stream.LocalAddrs()))
+	assert.Equal(t, ipsCount, len(clientSel.tunnels))
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverRemotes := serverStream.RemoteAddrs()
+	assert.Equal(t, ipsCount+1, len(serverRemotes))
+	assert.Equal(t, local, serverRemotes[ipsCount].String())
+	assert.Equal(t, remotes[0], serverStream.LocalAddrs()[ipsCount].String())
+
+	// and the others fail
+	assert.NoError(t, stream.RemovePath(locals[0], remotes[0]))
+	assert.NoError(t, stream.RemovePath(locals[1], remotes[1]))
+	assert.Equal(t, errPathNotFound, stream.RemovePath(locals[1], remotes[1]))
+	assert.Equal(t, errPathLast, stream.RemovePath(local, remotes[0]))
+	assert.NoError(t, echoTester(stream, 64, 10))
+	serverRemotes = serverStream.RemoteAddrs()
+	assert.Equal(t, 1, len(serverRemotes))
+	assert.Equal(t, local, serverRemotes[0].String())
+	assert.Equal(t, local, stream.LocalAddr().String())
+}
+
+func TestPathControlsUnread(t *testing.T) {
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		// never read
+		accepted <- stream
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	serverStream := <-accepted
+	defer serverStream.Close()
+	_, err = stream.Write([]byte("unread"))
+	assert.NoError(t, err)
+
+	newTunnels := newClientTunnels(t, 700)
+	defer releaseClientTunnels(newTunnels)
+	local := newTunnels[0].LocalAddr().String()
+	assert.NoError(t, stream.AddPath(local, remotes[0]))
+	assert.Eventually(t, func() bool {
+		return len(serverStream.RemoteAddrs()) == ipsCount+1
+	}, time.Second*2, time.Millisecond*10)
+	assert.NoError(t, stream.RemovePath(locals[0], remotes[0]))
+	assert.Eventually(t, func() bool {
+		return len(serverStream.RemoteAddrs()) == ipsCount
+	}, time.Second*2, time.Millisecond*10)
+	assert.Equal(t, local, serverStream.RemoteAddrs()[ipsCount-1].String())
+
+	// the data is still read in order
+	buf := make([]byte, 16)
+	serverStream.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := serverStream.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "unread", string(buf[:n]))
+}
+
+func TestRecvControls(t *testing.T) {
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {})
+	for _, seg := range []segment{
+		{frg: 0, data: []byte{PSH, 'a'}},
+		{frg: 0, data: []byte{PTH, 1}},
+		{frg: 1, data: []byte{PSH, 'b'}},
+		{frg: 0, data: []byte{'c'}},
+		{frg: 1, data: []byte{RBD, 2}},
+		{frg: 0, data: []byte{3}},
+		{frg: 1, data: []byte{PTH, 4}}, // incomplete
+	} {
+		// the segments are released to xmitBuf
+		data := xmitBuf.Get().([]byte)[:len(seg.data)]
+		copy(data, seg.data)
+		seg.data = data
+		kcp.rcv_queue = append(kcp.rcv_queue, seg)
+	}
+	var msgs []string
+	kcp.RecvControls(isPathControl, func(msg []byte) {
+		msgs = append(msgs, fmt.Sprint(msg))
+	})
+	assert.Equal(t, []string{fmt.Sprint([]byte{PTH, 1}), fmt.Sprint([]byte{RBD, 2, 3})}, msgs)
+	assert.Equal(t, 4, len(kcp.rcv_queue))
+
+	buf := make([]byte, 16)
+	n := kcp.Recv(buf)
+	assert.Equal(t, []byte{PSH, 'a'}, buf[:n])
+	n = kcp.Recv(buf)
+	assert.Equal(t, []byte{PSH, 'b', 'c'}, buf[:n])
+	assert.Equal(t, -1, kcp.Recv(buf))
+}
+
+func TestPathFailover(t *testing.T) {
+	tunnelCnt := 3
+	uuid, _ := gouuid.NewV4()
+	s := &UDPStream{
+		uuid:       uuid,
+		log:        DefaultLogger,
+		state:      StateEstablish,
+		msgss:      make([][]ipv4.Message, 0),
+		tunnels:    make([]*UDPTunnel, tunnelCnt),
+		locals:     make([]*net.UDPAddr, tunnelCnt),
+		remotes:    make([]*net.UDPAddr, tunnelCnt),
+		headerSize: gouuid.Size + 1,
+	}
+	for i := 0; i < tunnelCnt; i++ {
+		s.locals[i] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1 + i}
+		s.remotes[i] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11 + i}
+	}
+	now := time.Now()
+	assert.Equal(t, "", s.pathFailed(0, now))
+
+	// nothing heard for the packets sent
+	ps := s.pathStat(0)
+	ps.unacked = PathFailoverUnacked
+	assert.Equal(t, "", s.pathFailed(0, now))
+	ps.lastInput = now.Add(-PathFailoverTimeout)
+	assert.Equal(t, "unacked", s.pathFailed(0, now))
+	ps.heard(nil, now)
+	assert.Equal(t, "", s.pathFailed(0, now))
+
+	// path 2 ranks first but its pings are lost too
+	s.pathStat(0).pings.lostInRow = ProbeDeadCount
+	s.pathStat(2).pings.lostInRow = ProbeDeadCount
+	s.replicaOrder = []int{2, 1}
+	assert.Equal(t, "pings", s.pathFailed(0, now))
+	s.checkPrimary()
+	assert.Equal(t, 12, s.remotes[0].Port)
+	assert.Equal(t, []int{11, 13}, []int{s.remotes[1].Port, s.remotes[2].Port})
+	assert.Equal(t, ProbeDeadCount, s.pathStats[1].pings.lostInRow)
+	assert.Equal(t, ProbeDeadCount, s.pathStats[2].pings.lostInRow)
+	assert.Equal(t, uint64(1), s.stats.pathFailovers)
+
+	// no path alive to take over
+	s.pathStat(0).pings.lostInRow = ProbeDeadCount
+	s.checkPrimary()
+	assert.Equal(t, 12, s.remotes[0].Port)
+	assert.Equal(t, uint64(1), s.stats.pathFailovers)
+}
+
+func TestPrimaryFailover(t *testing.T) {
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- stream
+		handleEchoClient(stream)
+	}()
+
+	tunnels := newClientTunnels(t, 500)
+	defer releaseClientTunnels(tunnels)
+	locals := make([]string, len(tunnels))
+	for i, tunnel := range tunnels {
+		locals[i] = tunnel.LocalAddr().String()
+	}
+	_, remotes := clientSel.PickAddrs(ipsCount)
+	selTunnels := clientSel.tunnels
+	clientSel.tunnels = tunnels
+	stream, err := clientTransport.Open(locals, remotes)
+	clientSel.tunnels = selTunnels
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	assert.NoError(t, echoTester(stream, 64, 1))
+	serverStream := <-accepted
+	failovers := DefaultSnmp.Copy().PathFailovers
+
+	// the first interface goes away
+	assert.NoError(t, clientTransport.CloseTunnel(locals[0]))
+	assert.NoError(t, echoTester(stream, 64, 10))
+	assert.Equal(t, locals[1], stream.LocalAddr().String())
+	assert.Equal(t, uint64(1), stream.Stats().PathFailovers)
+	assert.Equal(t, failovers+1, DefaultSnmp.Copy().PathFailovers)
+	assert.Equal(t, locals[1], serverStream.RemoteAddrs()[0].String())
+	assert.Equal(t, remotes[1], serverStream.LocalAddrs()[0].String())
+}
+
+func TestPathStats(t *testing.T) {
+	interval := PathPingInterval
+	PathPingInterval = time.Millisecond * 20
+	defer func() {
+		PathPingInterval = interval
+	}()
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		handleEchoClient(stream)
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, echoTester(stream, 64, 1))
+		time.Sleep(PathPingInterval)
+	}
+
+	stats := stream.PathStats()
+	assert.Equal(t, ipsCount, len(stats))
+	for i, st := range stats {
+		assert.Equal(t, locals[i], st.Local.String())
+		assert.Equal(t, remotes[i], st.Remote.String())
+		assert.True(t, st.Alive)
+		assert.True(t, st.Pongs > 0)
+		assert.True(t, st.Rtt > 0)
+		assert.True(t, st.InPkts > 0)
+	}
+	assert.True(t, stats[0].OutPkts > 0)
+	assert.Equal(t, uint64(0), stats[0].OutReplicaPkts)
+	var firstSegs uint64
+	for _, st := range stats {
+		firstSegs += st.FirstPrimarySegs + st.FirstReplicaSegs
+	}
+	st := stream.Stats()
+	assert.True(t, firstSegs > 0)
+	assert.Equal(t, st.FirstPrimarySegs+st.FirstReplicaSegs, firstSegs)
+
+	stream.SetAckPath(AckPathFastest)
+	assert.NoError(t, echoTester(stream, 1024, 64))
+}
+
+func TestDedupe(t *testing.T) {
+	d := &dedupe{hist: newHistograms()}
+	kcp := NewKCP(1, nil)
+	kcp.dedupe = d
+	ps := &pathStat{}
+	input := func(replica bool, current uint32, sn uint32) {
+		d.begin(replica, current)
+		assert.Equal(t, 0, kcp.Input(encodeTestPacket(IKCP_CMD_PUSH, sn)[FrameHeaderSize:], !replica, false))
+		d.end(ps)
+	}
+
+	input(false, 100, 0)
+	input(true, 130, 0)
+	input(true, 140, 1)
+	input(false, 150, 1)
+	input(true, 160, 1)
+	// no data segment
+	d.begin(true, 170)
+	d.end(ps)
+	expected := CopyStats{
+		FirstPrimarySegs: 1,
+		FirstReplicaSegs: 1,
+		DupPrimarySegs:   1,
+		DupReplicaSegs:   2,
+		UsefulReplicas:   1,
+		WastedReplicas:   2,
+	}
+	assert.Equal(t, expected, d.CopyStats)
+	assert.Equal(t, expected, ps.copies)
+
+	// the next copy only
+	gaps := d.hist.CopyGap.Snapshot()
+	assert.Equal(t, uint64(2), gaps.Count)
+	assert.Equal(t, uint64(30+10), gaps.Sum)
+}
+
+func TestReplicaPaths(t *testing.T) {
+	tunnelCnt := 3
+	uuid, _ := gouuid.NewV4()
+	s := &UDPStream{
+		uuid:       uuid,
+		log:        DefaultLogger,
+		msgss:      make([][]ipv4.Message, 0),
+		tunnels:    make([]*UDPTunnel, tunnelCnt),
+		remotes:    make([]*net.UDPAddr, tunnelCnt),
+		headerSize: gouuid.Size + 1,
+	}
+	s.SetUseParallel(true)
+	s.SetParallelDelayMs(200)
+	s.SetParallelIntervalMs(50)
+	_, current64 := currentMs()
+	paths, _ := s.getParallel(current64, 0, 300)
+	assert.Equal(t, 3, len(paths))
+
+	// path 1 is dead, path 2 takes the first replica
+	s.pathStat(1).pings.lostInRow = ProbeDeadCount
+	s.rankPaths()
+	assert.Equal(t, []int{2, 1}, s.replicaOrder)
+	paths, _ = s.getParallel(current64, 0, 300)
+	assert.Equal(t, 2, len(paths))
+
+	buf := make([]byte, 100)
+	s.output(buf, current64, 0, 300, 0)
+	assert.Equal(t, 1, len(s.msgss[0]))
+	assert.Equal(t, 0, len(s.msgss[1]))
+	assert.Equal(t, 1, len(s.msgss[2]))
+	assert.Equal(t, uint64(1), s.pathStats[2].outReplicaPkts)
+
+	// the primary path is dead, replicate even if the primary is received
+	s.SetUseParallel(false)
+	s.primaryReceived = true
+	s.primaryReceivedTell = true
+	policy, _ := s.parallelPolicy()
+	policy.expireMs = 0
+	s.pathStat(0).pings.lostInRow = ProbeDeadCount
+	paths, _ = s.getParallel(current64, 0, 0)
+	assert.Equal(t, 2, len(paths))
+	s.pathStat(0).pings.lostInRow = 0
+	paths, _ = s.getParallel(current64, 0, 0)
+	assert.Equal(t, 1, len(paths))
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	t1 := &UDPTunnel{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	t2 := &UDPTunnel{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}}
+	sel := NewRoundRobinSelector()
+	assert.Nil(t, sel.Pick([]string{"a"}))
+	sel.Add(t1)
+	sel.Add(t2)
+	sel.Add(t1)
+	assert.Equal(t, []*UDPTunnel{t1, t2, t1}, sel.Pick([]string{"a", "b", "c"}))
+	sel.Remove(t1)
+	assert.Equal(t, []*UDPTunnel{t2, t2}, sel.Pick([]string{"a", "b"}))
+}
+
+func TestWeightedSelector(t *testing.T) {
+	t1 := &UDPTunnel{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	t2 := &UDPTunnel{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}}
+	t3 := &UDPTunnel{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}}
+	sel := NewWeightedSelector()
+	sel.Add(t1)
+	sel.Add(t2)
+	sel.Add(t3)
+	sel.SetWeight(t1, 3)
+	sel.SetWeight(t3, 0)
+	counts := make(map[*UDPTunnel]int)
+	for i := 0; i < 100; i++ {
+		counts[sel.Pick([]string{"a"})[0]]++
+	}
+	assert.Equal(t, 75, counts[t1])
+	assert.Equal(t, 25, counts[t2])
+	assert.Equal(t, 0, counts[t3])
+
+	sel.Remove(t1)
+	sel.Remove(t2)
+	assert.Nil(t, sel.Pick([]string{"a"}))
+}
+
+func TestProber(t *testing.T) {
+	prober, err := NewProber(rAddrs[:1], time.Millisecond*20, time.Millisecond*100)
+	assert.NoError(t, err)
+	healthSel := NewHealthSelector(prober, 0.1)
+	transport, err := NewUDPTransport(healthSel, &TransportOption{Prober: prober})
+	assert.NoError(t, err)
+	_, err = NewUDPTransport(healthSel, &TransportOption{Prober: prober})
+	assert.Equal(t, errInvalidOperation, err)
+
+	var tunnels []*UDPTunnel
+	for i := 0; i < 2; i++ {
+		tunnel, err := transport.NewTunnel("127.0.0.1:" + strconv.Itoa(lPortStart+400+i))
+		assert.NoError(t, err)
+		tunnels = append(tunnels, tunnel)
+	}
+	defer func() {
+		assert.NoError(t, transport.Close())
+		assert.Equal(t, io.ErrClosedPipe, transport.Close())
+		assert.Equal(t, 0, len(transport.Tunnels()))
+		_, err := transport.Accept()
+		assert.Equal(t, io.ErrClosedPipe, err)
+		select {
+		case <-prober.die:
+		default:
+			t.Fatal("prober not closed")
+		}
+	}()
+	good, bad := tunnels[0], tunnels[1]
+	bad.Simulate(1, 0, 0)
+	rttSel := NewLowestRttSelector(prober)
+	rttSel.Add(bad)
+	rttSel.Add(good)
+
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		goodHealth, _ := prober.Health(good.LocalAddr().String(), rAddrs[0])
+		badHealth, ok := prober.Health(bad.LocalAddr().String(), rAddrs[0])
+		if goodHealth.Acked > 0 && ok && !badHealth.Alive {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	goodHealth, ok := prober.Health(good.LocalAddr().String(), rAddrs[0])
+	assert.True(t, ok)
+	assert.True(t, goodHealth.Alive)
+	assert.True(t, goodHealth.Rtt > 0)
+	assert.Equal(t, float64(0), goodHealth.Loss)
+	badHealth, ok := prober.Health(bad.LocalAddr().String(), rAddrs[0])
+	assert.True(t, ok)
+	assert.False(t, badHealth.Alive)
+	assert.Equal(t, uint64(0), badHealth.Acked)
+	assert.Equal(t, float64(1), badHealth.Loss)
+	assert.Equal(t, 2, len(prober.Healths()))
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []*UDPTunnel{good}, healthSel.Pick(rAddrs[:1]))
+		assert.Equal(t, []*UDPTunnel{good}, rttSel.Pick(rAddrs[:1]))
+	}
 }
 
 func TestFrameHeaderEncode(t *testing.T) {
@@ -328,6 +1536,48 @@ func TestFrameHeaderEncode(t *testing.T) {
 	assert.Equal(t, FV2, fv)
 }
 
+func TestFrameDecode(t *testing.T) {
+	uuid, err := gouuid.NewV4()
+	assert.NoError(t, err)
+
+	var outbuf []byte
+	s1 := &UDPStream{
+		uuid: uuid,
+	}
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {
+		outbuf = append([]byte(nil), buf[:size]...)
+	})
+	kcp.ReserveBytes(FrameHeaderSize)
+	kcp.nocwnd = 1
+	kcp.Send([]byte{PSH, 'a', 'b'})
+	kcp.flush(false)
+
+	s1.encodeFrameHeader(outbuf, FV2)
+	s1.setFrameReplica(outbuf)
+	hdr, payload, err := DecodeFrameHeader(outbuf)
+	assert.NoError(t, err)
+	assert.Equal(t, uuid, hdr.UUID)
+	assert.Equal(t, FV2, hdr.Version)
+	assert.True(t, hdr.Replica)
+	assert.False(t, hdr.Trigger)
+	assert.False(t, hdr.PrimaryReceived)
+
+	var segs []SegmentHeader
+	err = DecodeSegments(payload, func(seg *SegmentHeader, data []byte) {
+		segs = append(segs, *seg)
+		assert.Equal(t, []byte{PSH, 'a', 'b'}, data)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(segs))
+	assert.Equal(t, uint8(IKCP_CMD_PUSH), segs[0].Cmd)
+	assert.Equal(t, uint32(0), segs[0].Sn)
+	assert.Equal(t, uint32(3), segs[0].Len)
+
+	_, _, err = DecodeFrameHeader(outbuf[:gouuid.Size])
+	assert.Error(t, err)
+	assert.Error(t, DecodeSegments(payload[:IKCP_OVERHEAD+1], func(*SegmentHeader, []byte) {}))
+}
+
 func tunnelSimulate(tunnels []*UDPTunnel, loss float64, delayMin, delayMax int) {
 	for _, tunnel := range tunnels {
 		tunnel.Simulate(loss, delayMin, delayMax)
@@ -909,6 +2159,235 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestStreamStats(t *testing.T) {
+	go echoServer()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	if err != nil {
+		t.Fatalf("client open stream failed. err:%v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+
+	err = echoTester(stream, 1024, 100)
+	assert.NoError(t, err)
+
+	st := stream.Stats()
+	assert.Equal(t, stream.GetUUID(), st.UUID)
+	assert.False(t, st.Accepted)
+	assert.Equal(t, StateEstablish, st.State)
+	assert.True(t, st.BytesSent >= 1024*100)
+	assert.True(t, st.BytesReceived >= 1024*100)
+	assert.True(t, st.InPkts > 0)
+	assert.True(t, st.OutPkts > 0)
+	assert.True(t, st.InBytes > st.BytesReceived)
+	assert.True(t, st.OutBytes > st.BytesSent)
+	assert.True(t, st.InSegs > 0)
+	assert.True(t, st.OutSegs > 0)
+	assert.True(t, st.Srtt >= 0)
+	assert.True(t, st.Rto > 0)
+	assert.True(t, st.Cwnd > 0)
+	assert.True(t, st.DialTime > 0)
+	assert.Equal(t, st.FastRetransSegs+st.EarlyRetransSegs+st.LostSegs, st.RetransSegs)
+}
+
+func TestTunnelStats(t *testing.T) {
+	assert.Equal(t, 0, batchBucket(1))
+	assert.Equal(t, 2, batchBucket(3))
+	assert.Equal(t, 4, batchBucket(batchSize))
+	assert.Equal(t, len(BatchSizeBuckets)-1, batchBucket(4096))
+
+	var err error = &net.OpError{Op: "write", Err: os.NewSyscallError("sendmmsg", syscall.ENOBUFS)}
+	assert.Equal(t, syscall.ENOBUFS, errno(err))
+	writeErr := err
+	assert.Equal(t, syscall.Errno(0), errno(io.EOF))
+
+	before := make([]*TunnelStats, len(clientTunnels))
+	for i, tunnel := range clientTunnels {
+		before[i] = tunnel.Stats()
+	}
+
+	go echoServer()
+	err = echoClient(1024, 10)
+	assert.NoError(t, err)
+
+	var inPkts, outPkts, inBytes, outBytes uint64
+	for i, tunnel := range clientTunnels {
+		st := tunnel.Stats()
+		assert.Equal(t, tunnel.LocalAddr().String(), st.LocalAddr)
+		inPkts += st.InPkts - before[i].InPkts
+		outPkts += st.OutPkts - before[i].OutPkts
+		inBytes += st.InBytes - before[i].InBytes
+		outBytes += st.OutBytes - before[i].OutBytes
+	}
+	assert.True(t, inPkts > 0)
+	assert.True(t, outPkts > 0)
+	assert.True(t, inBytes > 1024*10)
+	assert.True(t, outBytes > 1024*10)
+
+	clientTunnels[0].notifyWriteError(writeErr)
+	st := clientTunnels[0].Stats()
+	assert.True(t, st.WriteErrors[syscall.ENOBUFS] >= 1)
+
+	// a datagram refused by the kernel is counted, the tunnel keeps batching
+	tunnel, err := NewUDPTunnel("127.0.0.1:"+strconv.Itoa(lPortStart+1100), nil)
+	assert.NoError(t, err)
+	defer tunnel.Close()
+	portZero := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	tunnel.output([]ipv4.Message{{Buffers: [][]byte{xmitBuf.Get().([]byte)[:8]}, Addr: portZero}})
+	time.Sleep(100 * time.Millisecond)
+	st = tunnel.Stats()
+	assert.Equal(t, 1, len(st.WriteErrors), "%v", st.WriteErrors)
+	assert.False(t, st.WriteFallback)
+	tunnel.output([]ipv4.Message{{Buffers: [][]byte{xmitBuf.Get().([]byte)[:8]}, Addr: clientTunnels[0].LocalAddr()}})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, st.OutPkts+1, tunnel.Stats().OutPkts)
+}
+
+func TestDebugHandler(t *testing.T) {
+	go echoServer()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	if err != nil {
+		t.Fatalf("client open stream failed. err:%v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	err = echoTester(stream, 1024, 10)
+	assert.NoError(t, err)
+
+	found := false
+	for _, s := range clientTransport.Streams() {
+		found = found || s == stream
+	}
+	assert.True(t, found)
+
+	h := NewDebugHandler(clientTransport)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var infos []*StreamInfo
+	err = json.Unmarshal(rec.Body.Bytes(), &infos)
+	assert.NoError(t, err)
+	var info *StreamInfo
+	for _, i := range infos {
+		if i.UUID == stream.GetUUID() {
+			info = i
+		}
+	}
+	if info == nil {
+		t.Fatalf("stream not listed")
+	}
+	assert.Equal(t, "establish", info.StateName)
+	assert.Equal(t, ipsCount, len(info.Locals))
+	assert.Equal(t, ipsCount, len(info.Remotes))
+	assert.Equal(t, ipsCount, len(info.Tunnels))
+	assert.True(t, info.Idle < time.Second)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, rec.Body.String(), stream.GetUUID().String())
+
+	form := url.Values{"rst": {stream.GetUUID().String()}}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	_, err = stream.Write([]byte{1})
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/?rst=invalid", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	go echoServer()
+
+	stream, err := clientTransport.Open(clientSel.PickAddrs(ipsCount))
+	if err != nil {
+		t.Fatalf("client open stream failed. err:%v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+	err = echoTester(stream, 1024, 10)
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(clientTunnels), len(clientTransport.Tunnels()))
+	header := DefaultSnmp.Header()
+	for i, m := range snmpMetrics {
+		assert.Equal(t, header[i], m.header)
+	}
+
+	var buf bytes.Buffer
+	err = NewPrometheusHandler(nil, clientTransport).WritePrometheus(&buf)
+	assert.NoError(t, err)
+	out := buf.String()
+	for _, name := range []string{"kcp_curr_estab ", "kcp_xmit_interval_max_ms{xmit=\"1\"} ",
+		"kcp_tunnel_write_batches_total{local=", "kcp_streams{state=\"establish\"} ",
+		"kcp_stream_srtt_ms_bucket{le=\"+Inf\"} ", "kcp_stream_cwnd_count "} {
+		assert.Contains(t, out, name)
+	}
+	families := parsePrometheus(t, out)
+	assert.Equal(t, "counter", families["kcp_tunnel_in_pkts_total"].typ)
+	for _, name := range []string{"kcp_tunnel_in_pkts_total", "kcp_tunnel_send_queue", "kcp_tunnel_read_fallback"} {
+		assert.Equal(t, len(clientTunnels), len(families[name].samples), name)
+		for _, tunnel := range clientTunnels {
+			assert.Contains(t, families[name].samples, name+"{local=\""+tunnel.LocalAddr().String()+"\"}", name)
+		}
+	}
+	assert.Equal(t, len(clientTunnels)*len(BatchSizeBuckets), len(families["kcp_tunnel_read_batches_total"].samples))
+}
+
+type promFamily struct {
+	typ     string
+	samples map[string]float64
+}
+
+// parsePrometheus parses the text exposition format strictly, a family is declared once by
+// HELP then TYPE and its samples follow it, as the Prometheus parser requires
+func parsePrometheus(t *testing.T, out string) map[string]*promFamily {
+	families := make(map[string]*promFamily)
+	var name string
+	var family *promFamily
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			name = strings.SplitN(line[len("# HELP "):], " ", 2)[0]
+			_, ok := families[name]
+			assert.False(t, ok, "family %v declared twice", name)
+			family = &promFamily{samples: make(map[string]float64)}
+			families[name] = family
+			continue
+		} else if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Split(line, " ")
+			assert.Equal(t, 4, len(fields), line)
+			assert.Equal(t, name, fields[2], line)
+			assert.Equal(t, "", family.typ, line)
+			family.typ = fields[3]
+			continue
+		}
+		fields := strings.Split(line, " ")
+		assert.Equal(t, 2, len(fields), line)
+		value, err := strconv.ParseFloat(fields[1], 64)
+		assert.NoError(t, err, line)
+		metric := strings.SplitN(fields[0], "{", 2)[0]
+		if family != nil && family.typ == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				metric = strings.TrimSuffix(metric, suffix)
+			}
+		}
+		assert.Equal(t, name, metric, "sample %v out of its family", line)
+		if family != nil {
+			_, ok := family.samples[fields[0]]
+			assert.False(t, ok, "sample %v repeated", line)
+			family.samples[fields[0]] = value
+		}
+	}
+	return families
+}
+
 func TestUUIDCompatible(t *testing.T) {
 	go echoServer()
 	go echoServer()
@@ -947,27 +2426,32 @@ func TestTryParallel(t *testing.T) {
 	uuid, _ := gouuid.NewV4()
 	s := &UDPStream{
 		uuid:       uuid,
+		log:        DefaultLogger,
 		msgss:      make([][]ipv4.Message, 0),
 		headerSize: gouuid.Size + 1,
 	}
 
 	var durationMs uint64 = 100
 	s.SetParallelDurationMs(uint32(durationMs))
+	p, ok := s.parallelPolicy()
+	assert.True(t, ok)
 
 	_, current64 := currentMs()
-	trigger := s.tryParallel(0)
+	s.primaryReceived = true
+	trigger := p.try(s.redundancyContext(current64, 0, 0))
 	assert.True(t, trigger)
-	assert.Equal(t, s.parallelExpireMs, current64+durationMs)
+	assert.False(t, s.primaryReceived)
+	assert.Equal(t, p.expireMs, current64+durationMs)
 
 	current64 += 90
-	trigger = s.tryParallel(current64)
+	trigger = p.try(s.redundancyContext(current64, 0, 0))
 	assert.False(t, trigger)
-	assert.Equal(t, s.parallelExpireMs, current64+durationMs)
+	assert.Equal(t, p.expireMs, current64+durationMs)
 
 	current64 += 20
-	trigger = s.tryParallel(current64)
+	trigger = p.try(s.redundancyContext(current64, 0, 0))
 	assert.False(t, trigger)
-	assert.Equal(t, s.parallelExpireMs, current64+durationMs)
+	assert.Equal(t, p.expireMs, current64+durationMs)
 }
 
 func TestGetParallel(t *testing.T) {
@@ -975,6 +2459,7 @@ func TestGetParallel(t *testing.T) {
 	uuid, _ := gouuid.NewV4()
 	s := &UDPStream{
 		uuid:       uuid,
+		log:        DefaultLogger,
 		msgss:      make([][]ipv4.Message, 0),
 		tunnels:    make([]*UDPTunnel, tunnelCnt),
 		remotes:    make([]*net.UDPAddr, tunnelCnt),
@@ -992,59 +2477,59 @@ func TestGetParallel(t *testing.T) {
 
 	_, current64 := currentMs()
 
-	parallel, trigger := s.getParallel(current64, 0, 150)
-	assert.Equal(t, 2, parallel)
+	paths, trigger := s.getParallel(current64, 0, 150)
+	assert.Equal(t, 2, len(paths))
 	assert.False(t, trigger)
 
 	s.primaryReceived = true
 	s.primaryReceivedTell = true
 
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 1, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 1, len(paths))
 	assert.False(t, trigger)
 
-	parallel, trigger = s.getParallel(current64, 0, 250)
-	assert.Equal(t, 2, parallel)
+	paths, trigger = s.getParallel(current64, 0, 250)
+	assert.Equal(t, 2, len(paths))
 	assert.True(t, trigger)
 
-	parallel, trigger = s.getParallel(current64, 0, 340)
-	assert.Equal(t, 2, parallel)
+	paths, trigger = s.getParallel(current64, 0, 340)
+	assert.Equal(t, 2, len(paths))
 	assert.False(t, trigger)
 
-	parallel, trigger = s.getParallel(current64, 0, 350)
-	assert.Equal(t, 3, parallel)
+	paths, trigger = s.getParallel(current64, 0, 350)
+	assert.Equal(t, 3, len(paths))
 	assert.False(t, trigger)
 
-	parallel, trigger = s.getParallel(current64, 0, 500)
-	assert.Equal(t, 3, parallel)
+	paths, trigger = s.getParallel(current64, 0, 500)
+	assert.Equal(t, 3, len(paths))
 	assert.False(t, trigger)
 
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 3, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 3, len(paths))
 	assert.False(t, trigger)
 
 	current64 += durationMs
 
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 3, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 3, len(paths))
 	assert.False(t, trigger)
 
 	s.primaryReceived = true
 	s.primaryReceivedTell = true
 
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 1, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 1, len(paths))
 	assert.False(t, trigger)
 
 	s.SetUseParallel(true)
 
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 3, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 3, len(paths))
 	assert.False(t, trigger)
 
 	s.SetUseParallel(false)
-	parallel, trigger = s.getParallel(current64, 0, 150)
-	assert.Equal(t, 1, parallel)
+	paths, trigger = s.getParallel(current64, 0, 150)
+	assert.Equal(t, 1, len(paths))
 	assert.False(t, trigger)
 }
 
@@ -1053,6 +2538,7 @@ func TestParallelOutput(t *testing.T) {
 	uuid, _ := gouuid.NewV4()
 	s := &UDPStream{
 		uuid:       uuid,
+		log:        DefaultLogger,
 		msgss:      make([][]ipv4.Message, 0),
 		tunnels:    make([]*UDPTunnel, tunnelCnt),
 		remotes:    make([]*net.UDPAddr, tunnelCnt),
@@ -1071,7 +2557,7 @@ func TestParallelOutput(t *testing.T) {
 	_, current64 := currentMs()
 
 	buf := make([]byte, 100)
-	s.output(buf, current64, 0, 0)
+	s.output(buf, current64, 0, 0, 0)
 	assert.Equal(t, 2, len(s.msgss))
 	assert.Equal(t, 1, len(s.msgss[0]))
 	assert.Equal(t, 1, len(s.msgss[1]))
@@ -1091,7 +2577,7 @@ func TestParallelOutput(t *testing.T) {
 	s.primaryReceived = true
 	s.primaryReceivedTell = true
 
-	s.output(buf, current64, 0, 0)
+	s.output(buf, current64, 0, 0, 0)
 	assert.Equal(t, 2, len(s.msgss))
 	assert.Equal(t, 2, len(s.msgss[0]))
 	assert.Equal(t, 1, len(s.msgss[1]))
@@ -1102,7 +2588,7 @@ func TestParallelOutput(t *testing.T) {
 	assert.True(t, primaryReceived)
 	assert.Equal(t, FV2, fv)
 
-	s.output(buf, current64, 0, 200)
+	s.output(buf, current64, 0, 200, 0)
 
 	assert.Equal(t, 2, len(s.msgss))
 	assert.Equal(t, 3, len(s.msgss[0]))
@@ -1120,13 +2606,13 @@ func TestParallelOutput(t *testing.T) {
 	assert.False(t, primaryReceived)
 	assert.Equal(t, FV2, fv)
 
-	s.output(buf, current64, 0, 350)
+	s.output(buf, current64, 0, 350, 0)
 	assert.Equal(t, 3, len(s.msgss))
 	assert.Equal(t, 4, len(s.msgss[0]))
 	assert.Equal(t, 3, len(s.msgss[1]))
 	assert.Equal(t, 1, len(s.msgss[2]))
 
-	s.output(buf, current64, 0, 500)
+	s.output(buf, current64, 0, 500, 0)
 	assert.Equal(t, 5, len(s.msgss[0]))
 	assert.Equal(t, 4, len(s.msgss[1]))
 	assert.Equal(t, 2, len(s.msgss[2]))
@@ -1144,13 +2630,536 @@ func TestParallelOutput(t *testing.T) {
 	assert.Equal(t, FV2, fv)
 }
 
+func TestStripePick(t *testing.T) {
+	st := newStripe(MultipathMinRtt, 2, 0)
+	st.paths[0].srtt, st.paths[0].cwnd = 50, 2
+	st.paths[1].srtt, st.paths[1].cwnd = 10, 2
+	st.sendSegs(st.pick(0, nil), []stripeSent{{0, 0}}, 0)
+	st.sendSegs(st.pick(0, nil), []stripeSent{{1, 0}}, 0)
+	st.sendSegs(st.pick(0, nil), []stripeSent{{2, 0}}, 0)
+	assert.Equal(t, uint32(1), st.paths[0].inflight)
+	assert.Equal(t, uint32(2), st.paths[1].inflight)
+	assert.Equal(t, 1, st.ackPath())
+	assert.Equal(t, uint32(4), st.cwnd())
+
+	// a segment sent again is lost on its former path
+	st.sendSegs(0, []stripeSent{{1, 100}}, 100)
+	assert.Equal(t, uint64(1), st.paths[1].lostSegs)
+	assert.Equal(t, uint32(IKCP_THRESH_MIN), st.paths[1].cwnd)
+	assert.Equal(t, uint32(2), st.paths[0].inflight)
+	assert.Equal(t, uint32(1), st.paths[1].inflight)
+
+	// the ack with the ts of the last transmission samples the RTT, the una acks the others
+	st.input(encodeTestAck(1, 100, 0), 130, 32)
+	assert.Equal(t, int32(47), st.paths[0].srtt)
+	st.input(encodeTestAck(5, 0, 3), 130, 32)
+	assert.Equal(t, 0, len(st.sent))
+	assert.Equal(t, uint32(0), st.paths[0].inflight)
+	assert.Equal(t, uint32(0), st.paths[1].inflight)
+
+	// cwnd 4 at 40ms weighs as much as cwnd 1 at 10ms
+	st = newStripe(MultipathWeighted, 2, 0)
+	st.paths[0].srtt, st.paths[0].cwnd = 40, 4
+	st.paths[1].srtt, st.paths[1].cwnd = 10, 1
+	st.sendSegs(st.pick(0, nil), []stripeSent{{0, 0}}, 0)
+	st.sendSegs(st.pick(0, nil), []stripeSent{{1, 0}}, 0)
+	assert.Equal(t, uint32(1), st.paths[0].inflight)
+	assert.Equal(t, uint32(1), st.paths[1].inflight)
+	for sn := uint32(2); sn < 8; sn++ {
+		st.sendSegs(st.pick(0, nil), []stripeSent{{sn, 0}}, 0)
+	}
+	assert.Equal(t, uint32(6), st.paths[0].inflight)
+	assert.Equal(t, uint32(2), st.paths[1].inflight)
+}
+
+func TestStripeBlackhole(t *testing.T) {
+	// a path not measured yet counts as fast as the fastest one, not faster
+	st := newStripe(MultipathMinRtt, 2, 0)
+	st.paths[0].srtt, st.paths[0].cwnd = 10, 4
+	st.paths[1].cwnd = 4
+	assert.Equal(t, 0, st.pick(0, nil))
+	st.paths[0].srtt = 20
+	assert.Equal(t, 0, st.pick(0, nil))
+	assert.Equal(t, 1, st.pick(0, func(path int) bool { return path != 0 }))
+
+	// the segments sent on path 0 are all lost, the next ones go on path 1
+	for sn := uint32(0); sn < uint32(ProbeDeadCount); sn++ {
+		st.sendSegs(0, []stripeSent{{sn, 0}}, 0)
+		st.sendSegs(1, []stripeSent{{sn, 100}}, 100)
+	}
+	st.input(encodeTestAck(0, 100, 0), 130, 32)
+	assert.Equal(t, 1, st.pick(0, nil))
+	assert.Equal(t, 1, st.pick(0, func(path int) bool { return true }))
+
+	// unless path 1 is dead too, or path 0 answers a ping again
+	assert.Equal(t, 0, st.pick(0, func(path int) bool { return path != 1 }))
+	st.heard(0)
+	assert.Equal(t, 0, st.pick(0, nil))
+}
+
+func TestMultipathStripeBlackhole(t *testing.T) {
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		handleEchoClient(stream)
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second * 10))
+	assert.NoError(t, echoTester(stream, 64, 1))
+
+	// path 1 loses all it sends from now on
+	newTunnels := newClientTunnels(t, 900)
+	defer releaseClientTunnels(newTunnels)
+	newTunnels[1].Simulate(1, 0, 0)
+	stream.SetMultipath(MultipathWeighted)
+	stream.SetWindowSize(128, 128)
+	stream.mu.Lock()
+	stream.tunnels = []*UDPTunnel{stream.tunnels[0], newTunnels[1]}
+	stream.locals = []*net.UDPAddr{stream.locals[0], newTunnels[1].LocalAddr()}
+	stream.mu.Unlock()
+	assert.NoError(t, echoTester(stream, 64*1024, 16))
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	dead := stream.stripe.paths[1]
+	assert.Equal(t, uint64(0), dead.ackedSegs)
+	assert.True(t, dead.sentSegs < 16, "sentSegs %v", dead.sentSegs)
+	assert.True(t, stream.stripe.paths[0].ackedSegs >= 256)
+}
+
+func encodeTestAck(sn, ts, una uint32) []byte {
+	seg := segment{conv: 1, cmd: IKCP_CMD_ACK, sn: sn, ts: ts, una: una}
+	buf := make([]byte, IKCP_OVERHEAD)
+	seg.encode(buf)
+	return buf
+}
+
+func TestMultipathStripe(t *testing.T) {
+	go func() {
+		stream, err := serverTransport.Accept()
+		if err != nil {
+			return
+		}
+		stream.SetMultipath(MultipathMinRtt)
+		handleEchoClient(stream)
+	}()
+
+	locals, remotes := clientSel.PickAddrs(ipsCount)
+	stream, err := clientTransport.Open(locals, remotes)
+	assert.NoError(t, err)
+	defer stream.Close()
+	stream.SetMultipath(MultipathWeighted)
+	stream.SetWindowSize(128, 128)
+	stream.SetDeadline(time.Now().Add(time.Second * 10))
+	assert.NoError(t, echoTester(stream, 64, 1))
+	stats := stream.Stats()
+	assert.NoError(t, echoTester(stream, 1024, 256))
+
+	// the handshake is replicated before the modes are set
+	after := stream.Stats()
+	assert.Equal(t, stats.OutReplicaPkts, after.OutReplicaPkts)
+	assert.Equal(t, stats.InReplicaPkts, after.InReplicaPkts)
+	stream.mu.Lock()
+	for _, path := range stream.stripe.paths {
+		assert.True(t, path.sentSegs > 0)
+		assert.True(t, path.ackedSegs > 0)
+		assert.True(t, path.srtt > 0)
+	}
+	assert.Equal(t, stream.stripe.cwnd(), stream.kcp.pathCwnd)
+	stream.mu.Unlock()
+}
+
+func encodeTestPacket(cmd uint8, sn uint32) []byte {
+	buf := make([]byte, FrameHeaderSize+IKCP_OVERHEAD+8)
+	seg := segment{conv: 1, cmd: cmd, sn: sn, data: make([]byte, 8)}
+	seg.encode(buf[FrameHeaderSize:])
+	if cmd == IKCP_CMD_ACK {
+		return buf[:FrameHeaderSize+IKCP_OVERHEAD]
+	}
+	return buf
+}
+
+func TestRedundancy(t *testing.T) {
+	tunnelCnt := 2
+	uuid, _ := gouuid.NewV4()
+	s := &UDPStream{
+		uuid:       uuid,
+		log:        DefaultLogger,
+		msgss:      make([][]ipv4.Message, 0),
+		tunnels:    make([]*UDPTunnel, tunnelCnt),
+		remotes:    make([]*net.UDPAddr, tunnelCnt),
+		headerSize: gouuid.Size + 1,
+	}
+	s.SetUseParallel(true)
+	s.SetRedundancy(RedundancyRetrans|RedundancyAcks, 0)
+	assert.Equal(t, DefaultRedundancyTailSegs, s.tailSegs)
+	_, current64 := currentMs()
+	snmp := DefaultSnmp.Copy()
+
+	s.output(encodeTestPacket(IKCP_CMD_PUSH, 0), current64, 1, 0, 1)
+	assert.Equal(t, 0, len(s.msgss[1]))
+	s.output(encodeTestPacket(IKCP_CMD_PUSH, 0), current64, 2, 0, 1)
+	assert.Equal(t, 1, len(s.msgss[1]))
+	s.output(encodeTestPacket(IKCP_CMD_ACK, 0), current64, 0, 0, 0)
+	assert.Equal(t, 2, len(s.msgss[1]))
+	assert.Equal(t, uint64(2), s.stats.outReplicaPkts)
+	delta := DefaultSnmp.Copy()
+	assert.Equal(t, uint64(FrameHeaderSize+IKCP_OVERHEAD+8), delta.ReplicaRetransBytes-snmp.ReplicaRetransBytes)
+	assert.Equal(t, uint64(FrameHeaderSize+IKCP_OVERHEAD), delta.ReplicaAckBytes-snmp.ReplicaAckBytes)
+	assert.Equal(t, snmp.ReplicaDataBytes, delta.ReplicaDataBytes)
+
+	// the last 2 segments of the flush
+	s.msgss = make([][]ipv4.Message, 0)
+	s.SetRedundancy(RedundancyTail, 2)
+	for sn := uint32(1); sn <= 3; sn++ {
+		s.output(encodeTestPacket(IKCP_CMD_PUSH, sn), current64, 1, 0, 1)
+	}
+	s.output(encodeTestPacket(IKCP_CMD_ACK, 0), current64, 0, 0, 0)
+	assert.Equal(t, 4, len(s.msgss[0]))
+	assert.Equal(t, 0, len(s.msgss[1]))
+	s.replicateTail()
+	assert.Equal(t, 0, len(s.tailPkts))
+	assert.Equal(t, 2, len(s.msgss[1]))
+	for i, sn := range []uint32{3, 2} {
+		_, _, replica, _ := s.decodeFrameHeader(s.msgss[1][i].Buffers[0])
+		assert.True(t, replica)
+		DecodeSegments(s.msgss[1][i].Buffers[0][FrameHeaderSize:], func(hdr *SegmentHeader, payload []byte) {
+			assert.Equal(t, sn, hdr.Sn)
+		})
+	}
+	assert.Equal(t, 2*uint64(FrameHeaderSize+IKCP_OVERHEAD+8), DefaultSnmp.Copy().ReplicaTailBytes-snmp.ReplicaTailBytes)
+}
+
+func TestAckPath(t *testing.T) {
+	var packets [][]uint8
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {
+		var cmds []uint8
+		DecodeSegments(buf[:size], func(hdr *SegmentHeader, payload []byte) {
+			cmds = append(cmds, hdr.Cmd)
+		})
+		packets = append(packets, cmds)
+	})
+	kcp.cwnd = 4
+	kcp.Send([]byte("data"))
+	kcp.ack_push(0, 0)
+	kcp.flush(false)
+	assert.Equal(t, [][]uint8{{IKCP_CMD_ACK, IKCP_CMD_PUSH}}, packets)
+	packets = nil
+	kcp.ackAlone = true
+	kcp.Send([]byte("data"))
+	kcp.ack_push(1, 0)
+	kcp.flush(false)
+	assert.Equal(t, [][]uint8{{IKCP_CMD_ACK}, {IKCP_CMD_PUSH}}, packets)
+
+	tunnelCnt := 3
+	uuid, _ := gouuid.NewV4()
+	s := &UDPStream{
+		uuid:       uuid,
+		log:        DefaultLogger,
+		kcp:        NewKCP(1, nil),
+		msgss:      make([][]ipv4.Message, 0),
+		tunnels:    make([]*UDPTunnel, tunnelCnt),
+		remotes:    make([]*net.UDPAddr, tunnelCnt),
+		headerSize: gouuid.Size + 1,
+	}
+	s.SetAckPath(AckPathFastest)
+	assert.True(t, s.kcp.ackAlone)
+	s.pathStat(1).pings.acked, s.pathStat(1).pings.srtt = 1, time.Millisecond*30
+	s.pathStat(2).pings.acked, s.pathStat(2).pings.srtt = 1, time.Millisecond*10
+	assert.Equal(t, 2, s.fastestPath())
+	s.SetParallelDelayMs(200)
+	s.SetParallelIntervalMs(50)
+	s.primaryReceived = true
+	s.primaryReceivedTell = true
+	_, current64 := currentMs()
+
+	// alone on the fastest path, data on the first one
+	s.output(encodeTestPacket(IKCP_CMD_ACK, 0), current64, 0, 0, 0)
+	s.output(encodeTestPacket(IKCP_CMD_PUSH, 0), current64, 0, 0, 1)
+	assert.Equal(t, 3, len(s.msgss))
+	assert.Equal(t, 1, len(s.msgss[0]))
+	assert.Equal(t, 0, len(s.msgss[1]))
+	assert.Equal(t, 1, len(s.msgss[2]))
+	_, _, replica, _ := s.decodeFrameHeader(s.msgss[2][0].Buffers[0])
+	assert.False(t, replica)
+
+	// on all paths while parallel whatever the redundancy
+	s.SetRedundancy(RedundancyRetrans, 0)
+	s.SetUseParallel(true)
+	s.output(encodeTestPacket(IKCP_CMD_ACK, 1), current64, 0, 300, 0)
+	assert.Equal(t, 2, len(s.msgss[0]))
+	assert.Equal(t, 1, len(s.msgss[1]))
+	assert.Equal(t, 2, len(s.msgss[2]))
+	_, _, replica, _ = s.decodeFrameHeader(s.msgss[0][1].Buffers[0])
+	assert.True(t, replica)
+	assert.Equal(t, []int{2, 0, 1}, s.pathsFirst([]int{0, 1, 2}, 2))
+	assert.Equal(t, []int{2, 0}, s.pathsFirst([]int{0, 1}, 2))
+}
+
+// testPolicy sends on paths and starts a parallel period on every trigger of the peer
+type testPolicy struct {
+	paths  []int
+	inputs int
+}
+
+func (p *testPolicy) Output(ctx *RedundancyContext) (paths []int, trigger bool) {
+	return p.paths, ctx.Delayts > 0
+}
+
+func (p *testPolicy) Input(ctx *RedundancyContext) (trigger bool) {
+	p.inputs++
+	return ctx.Trigger
+}
+
+func TestRedundancyPolicy(t *testing.T) {
+	tunnelCnt := 3
+	uuid, _ := gouuid.NewV4()
+	h := &testLogHandler{lvl: WARN}
+	s := &UDPStream{
+		uuid:       uuid,
+		log:        NewHandlerLogger(h),
+		msgss:      make([][]ipv4.Message, 0),
+		tunnels:    make([]*UDPTunnel, tunnelCnt),
+		remotes:    make([]*net.UDPAddr, tunnelCnt),
+		headerSize: gouuid.Size + 1,
+	}
+	policy := &testPolicy{paths: []int{2, 1}}
+	s.SetRedundancyPolicy(policy)
+	s.SetParallelDelayMs(100) // no ParallelPolicy to apply to
+	s.SetUseParallel(true)
+	assert.Equal(t, []string{
+		"WARNING UDPStream::SetParallelDelayMs [err err not parallel policy]",
+		"WARNING UDPStream::SetUseParallel [err err not parallel policy]",
+	}, h.records)
+	_, current64 := currentMs()
+
+	s.output(encodeTestPacket(IKCP_CMD_PUSH, 0), current64, 1, 0, 1)
+	s.output(encodeTestPacket(IKCP_CMD_PUSH, 1), current64, 2, 10, 1)
+	assert.Equal(t, 3, len(s.msgss))
+	assert.Equal(t, 0, len(s.msgss[0]))
+	assert.Equal(t, 2, len(s.msgss[1]))
+	assert.Equal(t, 2, len(s.msgss[2]))
+	_, trigger, replica, _ := s.decodeFrameHeader(s.msgss[2][0].Buffers[0])
+	assert.False(t, trigger)
+	assert.False(t, replica)
+	_, trigger, replica, _ = s.decodeFrameHeader(s.msgss[2][1].Buffers[0])
+	assert.True(t, trigger)
+	assert.False(t, replica)
+	_, _, replica, _ = s.decodeFrameHeader(s.msgss[1][1].Buffers[0])
+	assert.True(t, replica)
+	assert.Equal(t, uint64(1), s.stats.parallels)
+	assert.True(t, s.parallelStatus)
+
+	s.SetRedundancyPolicy(nil)
+	_, ok := s.parallelPolicy()
+	assert.True(t, ok)
+}
+
+func TestStreamTimers(t *testing.T) {
+	sched := NewTimedSched(1)
+	defer sched.Close()
+	tunnels := newClientTunnels(t, 600)
+	defer releaseClientTunnels(tunnels)
+
+	sel := &TestSelector{tunnels: tunnels}
+	// nobody listens, the segments are sent and never acked
+	remotes := []string{"127.0.0.1:27001", "127.0.0.1:27002"}
+	cleaned := make(chan gouuid.UUID, 16)
+	opt := (&TransportOption{Sched: sched}).SetDefault()
+
+	goroutines := runtime.NumGoroutine()
+	streams := make([]*UDPStream, 0, 16)
+	for i := 0; i < 16; i++ {
+		uuid, _ := gouuid.NewV4()
+		stream, err := newUDPStream(uuid, false, remotes, sel, func(uuid gouuid.UUID) { cleaned <- uuid }, opt)
+		assert.NoError(t, err)
+		streams = append(streams, stream)
+	}
+	// the streams share the goroutines of sched, the ones of other tests may come and go but
+	// far fewer than one a stream
+	assert.True(t, runtime.NumGoroutine() < goroutines+len(streams)/2, "goroutines %v, were %v", runtime.NumGoroutine(), goroutines)
+
+	for _, stream := range streams {
+		stream.SetWriteDelay(false)
+		_, err := stream.Write([]byte("ping"))
+		assert.NoError(t, err)
+	}
+	// the flushes scheduled send the segments and retransmit them
+	time.Sleep(500 * time.Millisecond)
+	for _, stream := range streams {
+		stream.mu.Lock()
+		outSegs := stream.kcp.outSegs
+		stream.mu.Unlock()
+		assert.True(t, outSegs >= 2, "outSegs %v", outSegs)
+	}
+
+	for _, stream := range streams {
+		stream.Close()
+	}
+	for range streams {
+		select {
+		case <-cleaned:
+		case <-time.After(CleanTimeout + 2*time.Second):
+			t.Fatal("stream not cleaned")
+		}
+	}
+	for _, stream := range streams {
+		stream.timers.mu.Lock()
+		assert.True(t, stream.timers.cleaned)
+		stream.timers.mu.Unlock()
+	}
+}
+
+func TestInputOverload(t *testing.T) {
+	opt := (&TransportOption{InputQueue: 4, TunnelProcessor: 1, InputTime: 1, InputOverload: InputDropNewest, InputOpenLimit: 2,
+		InputStreamLimit: 3}).SetDefault()
+	tr := &UDPTransport{TransportOption: opt, streamm: NewConcurrentMap(), die: make(chan struct{}),
+		inputQueues: []chan *inputMsg{make(chan *inputMsg, opt.InputQueue)}}
+	tunnel := &UDPTunnel{}
+	uuid, _ := gouuid.NewV4()
+	stream := &UDPStream{uuid: uuid}
+	tr.streamm.Set(uuid, stream)
+
+	frame := func(uuid gouuid.UUID) []byte {
+		data := xmitBuf.Get().([]byte)[:mtuLimit]
+		copy(data, uuid[:])
+		return data
+	}
+	unknown, _ := gouuid.NewV4()
+	before := DefaultSnmp.Copy()
+	drops := func() (full, oldest, open, streams uint64) {
+		snmp := DefaultSnmp.Copy()
+		return snmp.InputFullDrops - before.InputFullDrops, snmp.InputOldestDrops - before.InputOldestDrops,
+			snmp.InputOpenDrops - before.InputOpenDrops, snmp.InputStreamDrops - before.InputStreamDrops
+	}
+	poll := 0
+
+	// the new streams keep half of the queue to the established ones
+	for i := 0; i < 3; i++ {
+		tr.queueInput(tr.inputQueues, &poll, frame(unknown), tunnel, nil)
+	}
+	full, oldest, open, streams := drops()
+	assert.Equal(t, []uint64{0, 0, 1, 0}, []uint64{full, oldest, open, streams})
+
+	for i := 0; i < 3; i++ {
+		tr.queueInput(tr.inputQueues, &poll, frame(uuid), tunnel, nil)
+	}
+	full, oldest, open, streams = drops()
+	assert.Equal(t, []uint64{1, 0, 1, 0}, []uint64{full, oldest, open, streams})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stream.inputPending))
+
+	// the oldest datagram, of the unknown stream, makes room
+	tr.InputOverload = InputDropOldest
+	tr.queueInput(tr.inputQueues, &poll, frame(uuid), tunnel, nil)
+	full, oldest, open, streams = drops()
+	assert.Equal(t, []uint64{1, 1, 1, 0}, []uint64{full, oldest, open, streams})
+	assert.Equal(t, int32(3), atomic.LoadInt32(&stream.inputPending))
+
+	// the stream has its share pending
+	tr.queueInput(tr.inputQueues, &poll, frame(uuid), tunnel, nil)
+	full, oldest, open, streams = drops()
+	assert.Equal(t, []uint64{1, 1, 1, 1}, []uint64{full, oldest, open, streams})
+	assert.Equal(t, uint64(4), atomic.LoadUint64(&tunnel.stats.inDrops))
+
+	queue := tr.inputQueues[0]
+	assert.Equal(t, 4, len(queue))
+	for len(queue) > 0 {
+		tr.doneInput(<-queue)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stream.inputPending))
+
+	// without limits the stream is not looked up, and a full queue blocks by default
+	assert.Equal(t, InputBlock, new(TransportOption).SetDefault().InputOverload)
+	tr.InputOpenLimit, tr.InputStreamLimit = 0, 0
+	tr.queueInput(tr.inputQueues, &poll, frame(uuid), tunnel, nil)
+	msg := <-queue
+	assert.Nil(t, msg.stream)
+	tr.doneInput(msg)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stream.inputPending))
+
+	// a datagram blocked on a full queue is released once the transport closes
+	tr.InputOverload, tr.InputStreamLimit = InputBlock, 8
+	for len(queue) < cap(queue) {
+		queue <- &inputMsg{data: frame(unknown), tunnel: tunnel}
+	}
+	blocked := make(chan struct{})
+	go func() {
+		tr.queueInput(tr.inputQueues, &poll, frame(uuid), tunnel, nil)
+		close(blocked)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stream.inputPending))
+	close(tr.die)
+	<-blocked
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stream.inputPending))
+	for len(queue) > 0 {
+		tr.doneInput(<-queue)
+	}
+}
+
+func TestInputByStream(t *testing.T) {
+	for _, dispatch := range []InputDispatch{InputRoundRobin, InputByStream} {
+		opt := (&TransportOption{TunnelProcessor: 4, InputDispatch: dispatch}).SetDefault()
+		tr := &UDPTransport{TransportOption: opt, streamm: NewConcurrentMap(), die: make(chan struct{})}
+		// the queues of two tunnels, shared by stream
+		first, second := tr.tunnelQueues(), tr.tunnelQueues()
+		assert.Equal(t, opt.TunnelProcessor, len(first))
+		assert.Equal(t, opt.TunnelProcessor, len(second))
+		assert.Equal(t, dispatch == InputByStream, first[0] == second[0])
+		close(tr.die)
+	}
+
+	// the queues of a tunnel of its own stop with it, released
+	opt := (&TransportOption{TunnelProcessor: 1}).SetDefault()
+	tr := &UDPTransport{TransportOption: opt, streamm: NewConcurrentMap(), die: make(chan struct{})}
+	queues := tr.tunnelQueues()
+	tunnel := &UDPTunnel{die: make(chan struct{})}
+	queues[0] <- &inputMsg{data: xmitBuf.Get().([]byte)[:mtuLimit], tunnel: tunnel}
+	close(tunnel.die)
+	tr.processInput(queues[0], tunnel.die)
+	assert.Equal(t, 0, len(queues[0]))
+	assert.Equal(t, 0, len(tr.inputQueues))
+
+	opt = (&TransportOption{TunnelProcessor: 4, InputDispatch: InputByStream}).SetDefault()
+	tr = &UDPTransport{TransportOption: opt, streamm: NewConcurrentMap()}
+	for i := 0; i < opt.TunnelProcessor; i++ {
+		tr.inputQueues = append(tr.inputQueues, make(chan *inputMsg, opt.InputQueue))
+	}
+	tunnels := []*UDPTunnel{{}, {}}
+	polls := []int{0, 0}
+
+	// the datagrams of a stream go to a single queue, whatever the tunnel and the poll
+	for i := 0; i < 8; i++ {
+		uuid, _ := gouuid.NewV4()
+		want := tr.inputQueues[int(fnv32(uuid)%uint32(opt.TunnelProcessor))]
+		for j := 0; j < 3; j++ {
+			for k, tunnel := range tunnels {
+				data := xmitBuf.Get().([]byte)[:mtuLimit]
+				copy(data, uuid[:])
+				tr.queueInput(tr.inputQueues[:opt.TunnelProcessor], &polls[k], data, tunnel, nil)
+				assert.Equal(t, 2*j+k+1, len(want))
+			}
+		}
+		for len(want) > 0 {
+			tr.doneInput(<-want)
+		}
+	}
+	assert.Equal(t, []int{0, 0}, polls)
+}
+
 func TestKcpFlush(t *testing.T) {
 	// var current uint32
 	var xmitMax int
 	var delayts int
 	var outputcnt int
 
-	ouput := func(buf []byte, size int, current_ uint64, xmitMax_, delayts_ uint32) {
+	ouput := func(buf []byte, size int, current_ uint64, xmitMax_, delayts_ uint32, pushSegs_ int) {
 		// current = current_
 		xmitMax = int(xmitMax_)
 		delayts = int(delayts_)
@@ -1477,7 +3486,7 @@ func TestUDPFileTransfer(t *testing.T) {
 }
 
 func TestAckXmit(t *testing.T) {
-	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32) {})
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {})
 	for i := 0; i < IKCP_WND_RCV+2; i++ {
 		kcp.ack_push(uint32(i), 0)
 	}
@@ -1520,8 +3529,25 @@ func TestAckXmit(t *testing.T) {
 	}
 }
 
+func TestFlushPushSegs(t *testing.T) {
+	var segs []int
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {
+		segs = append(segs, pushSegs)
+	})
+	kcp.ReserveBytes(FrameHeaderSize)
+	kcp.cwnd = 8
+	kcp.ackAlone = true
+	kcp.ack_push(1, 0)
+	for i := 0; i < 3; i++ {
+		kcp.Send(make([]byte, 8))
+	}
+	kcp.flush(false)
+	// the acks alone then the data in a packet
+	assert.Equal(t, []int{0, 3}, segs)
+}
+
 func BenchmarkFlush(b *testing.B) {
-	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32) {})
+	kcp := NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {})
 	kcp.snd_buf = make([]segment, 1024)
 	for k := range kcp.snd_buf {
 		current, _ := currentMs()
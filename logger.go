@@ -0,0 +1,108 @@
+package kcp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Logger is a leveled logger with key/value fields, kvs are alternating keys and values.
+// A Logger is settable per transport by TransportOption.Logger, the streams and tunnels
+// of the transport log through it with their uuid, accepted and tunnel fields attached
+type Logger interface {
+	// Enabled reports whether messages at lvl are logged, callers may skip building expensive fields
+	Enabled(lvl LogLevel) bool
+	// Log logs msg with the fields of the logger followed by kvs
+	Log(lvl LogLevel, msg string, kvs ...interface{})
+	// With returns a Logger which includes kvs in each message
+	With(kvs ...interface{}) Logger
+}
+
+// LogHandler handles a log record, it is what a log/slog Handler looks like without
+// the context, so any structured logging backend can be adapted with NewHandlerLogger
+type LogHandler interface {
+	Enabled(lvl LogLevel) bool
+	Handle(lvl LogLevel, msg string, kvs []interface{})
+}
+
+// DefaultLogger formats the fields as "key:value" after msg and logs through Logf,
+// it is used by the transports without TransportOption.Logger
+var DefaultLogger Logger = NewHandlerLogger(logfHandler{})
+
+type handlerLogger struct {
+	h   LogHandler
+	kvs []interface{}
+}
+
+// NewHandlerLogger creates a Logger on h
+func NewHandlerLogger(h LogHandler) Logger {
+	return &handlerLogger{h: h}
+}
+
+func (l *handlerLogger) Enabled(lvl LogLevel) bool {
+	return l.h.Enabled(lvl)
+}
+
+func (l *handlerLogger) Log(lvl LogLevel, msg string, kvs ...interface{}) {
+	if !l.h.Enabled(lvl) {
+		return
+	}
+	if len(l.kvs) > 0 {
+		kvs = append(l.kvs[:len(l.kvs):len(l.kvs)], kvs...)
+	}
+	l.h.Handle(lvl, msg, kvs)
+}
+
+func (l *handlerLogger) With(kvs ...interface{}) Logger {
+	return &handlerLogger{h: l.h, kvs: append(l.kvs[:len(l.kvs):len(l.kvs)], kvs...)}
+}
+
+type levelLogger struct {
+	Logger
+	lvl LogLevel
+}
+
+// NewLevelLogger creates a Logger on l which drops the messages below lvl,
+// so that a single noisy transport can be quieted without changing the others
+func NewLevelLogger(l Logger, lvl LogLevel) Logger {
+	return &levelLogger{Logger: l, lvl: lvl}
+}
+
+func (l *levelLogger) Enabled(lvl LogLevel) bool {
+	return lvl >= l.lvl && l.Logger.Enabled(lvl)
+}
+
+func (l *levelLogger) Log(lvl LogLevel, msg string, kvs ...interface{}) {
+	if lvl < l.lvl {
+		return
+	}
+	l.Logger.Log(lvl, msg, kvs...)
+}
+
+func (l *levelLogger) With(kvs ...interface{}) Logger {
+	return &levelLogger{Logger: l.Logger.With(kvs...), lvl: l.lvl}
+}
+
+// logfHandler keeps the output of Logf, e.g. "UDPStream::Close uuid:xx accepted:false once:true"
+type logfHandler struct{}
+
+func (logfHandler) Enabled(lvl LogLevel) bool {
+	return Logf != nil
+}
+
+func (logfHandler) Handle(lvl LogLevel, msg string, kvs []interface{}) {
+	logf := Logf
+	if logf == nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(kvs); i += 2 {
+		b.WriteByte(' ')
+		if i+1 < len(kvs) {
+			fmt.Fprintf(&b, "%v:%v", kvs[i], kvs[i+1])
+		} else {
+			fmt.Fprintf(&b, "!BADKEY:%v", kvs[i])
+		}
+	}
+	logf(lvl, "%s", b.String())
+}
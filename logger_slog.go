@@ -0,0 +1,43 @@
+// +build go1.21
+
+package kcp
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelFatal is the slog level of FATAL messages
+const LevelFatal = slog.LevelError + 4
+
+type slogHandler struct {
+	h slog.Handler
+}
+
+// NewSlogLogger creates a Logger on a log/slog Handler
+func NewSlogLogger(h slog.Handler) Logger {
+	return NewHandlerLogger(slogHandler{h: h})
+}
+
+func slogLevel(lvl LogLevel) slog.Level {
+	switch lvl {
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	}
+	return LevelFatal
+}
+
+func (sh slogHandler) Enabled(lvl LogLevel) bool {
+	return sh.h.Enabled(context.Background(), slogLevel(lvl))
+}
+
+func (sh slogHandler) Handle(lvl LogLevel, msg string, kvs []interface{}) {
+	l := slog.New(sh.h)
+	l.Log(context.Background(), slogLevel(lvl), msg, kvs...)
+}
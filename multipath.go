@@ -0,0 +1,386 @@
+package kcp
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+)
+
+// multipath modes of a stream, see SetMultipath
+const (
+	MultipathReplicate = iota // send on the first path, replicated on the others when parallel
+	MultipathMinRtt           // stripe the packets, each on the path of the lowest RTT with room in its window
+	MultipathWeighted         // stripe the packets in proportion to cwnd/srtt of the paths with room
+)
+
+// stripeMss is the segment size of the window arithmetic of the paths, only the ratios matter
+const stripeMss = IKCP_MTU_DEF
+
+// stripePath is the congestion state of a path of a striping stream, in segments as KCP
+type stripePath struct {
+	srtt      int32 // ms, 0 until the first sample
+	rttvar    int32
+	cwnd      uint32
+	ssthresh  uint32
+	incr      uint32
+	inflight  uint32
+	recoverTs uint32 // the window is reduced once per loss event, until then
+	credit    int    // of the weighted scheduling
+
+	sentSegs  uint64
+	ackedSegs uint64
+	lostSegs  uint64
+	lostInRow int // segments lost since the last ack or pong, see usable
+}
+
+// stripeSeg is a push segment in flight, by the path and ts of its last transmission
+type stripeSeg struct {
+	path int
+	ts   uint32
+}
+
+// stripeSent is a push segment in a packet to send
+type stripeSent struct {
+	sn uint32
+	ts uint32
+}
+
+// stripe schedules the packets of a stream across its paths, each path has a congestion window
+// and the KCP window is their sum. The segments are tracked by sn to credit the acks to the path
+// they were sent on, a segment sent again is taken as lost on the path it was sent on before
+type stripe struct {
+	mode  int
+	paths []stripePath
+	sent  map[uint32]stripeSeg
+	una   uint32
+}
+
+func newStripe(mode, n int, una uint32) *stripe {
+	st := &stripe{mode: mode}
+	st.reset(n, una)
+	return st
+}
+
+// reset starts over with n paths, the segments in flight are forgotten
+func (st *stripe) reset(n int, una uint32) {
+	st.paths = make([]stripePath, n)
+	for i := range st.paths {
+		st.paths[i].cwnd = 1
+		st.paths[i].ssthresh = IKCP_THRESH_INIT
+	}
+	st.sent = make(map[uint32]stripeSeg)
+	st.una = una
+}
+
+// cwnd returns the sum of the path windows
+func (st *stripe) cwnd() (cwnd uint32) {
+	for i := range st.paths {
+		cwnd += st.paths[i].cwnd
+	}
+	return cwnd
+}
+
+// pick returns the path of the next packet carrying data, the least loaded one if no window
+// has room. A path not measured yet counts with the lowest RTT of the others so that it is
+// tried, or the RTT of the stream, defaultRtt, if none is measured. The paths not usable are
+// skipped unless none is, alive tells the paths alive by the pings, all if nil
+func (st *stripe) pick(defaultRtt int32, alive func(path int) bool) int {
+	unmeasured := int32(0)
+	for i := range st.paths {
+		if srtt := st.paths[i].srtt; srtt > 0 && (unmeasured == 0 || srtt < unmeasured) {
+			unmeasured = srtt
+		}
+	}
+	if unmeasured == 0 {
+		unmeasured = defaultRtt
+	}
+	if unmeasured <= 0 {
+		unmeasured = IKCP_RTO_DEF
+	}
+	skip := make([]bool, len(st.paths))
+	skipped := 0
+	for i := range st.paths {
+		if !st.usable(i, alive) {
+			skip[i] = true
+			skipped++
+		}
+	}
+	if skipped == len(st.paths) {
+		skip = make([]bool, len(st.paths))
+	}
+	srtt := func(p *stripePath) int32 {
+		if p.srtt <= 0 {
+			return unmeasured
+		}
+		return p.srtt
+	}
+	best := -1
+	switch st.mode {
+	case MultipathMinRtt:
+		for i := range st.paths {
+			p := &st.paths[i]
+			if skip[i] || p.inflight >= p.cwnd {
+				continue
+			}
+			if best < 0 || srtt(p) < srtt(&st.paths[best]) {
+				best = i
+			}
+		}
+	case MultipathWeighted:
+		total := 0
+		for i := range st.paths {
+			p := &st.paths[i]
+			if skip[i] || p.inflight >= p.cwnd {
+				continue
+			}
+			weight := int(p.cwnd*1000) / int(srtt(p))
+			if weight < 1 {
+				weight = 1
+			}
+			p.credit += weight
+			total += weight
+			if best < 0 || p.credit > st.paths[best].credit {
+				best = i
+			}
+		}
+		if best >= 0 {
+			st.paths[best].credit -= total
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	for i := range st.paths {
+		if skip[i] {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		p, b := &st.paths[i], &st.paths[best]
+		if uint64(p.inflight)*uint64(b.cwnd) < uint64(b.inflight)*uint64(p.cwnd) {
+			best = i
+		}
+	}
+	return best
+}
+
+// usable returns false for a path dead by the pings, or which lost ProbeDeadCount segments in
+// a row, it is tried again once a pong comes back on it
+func (st *stripe) usable(path int, alive func(path int) bool) bool {
+	if st.paths[path].lostInRow >= ProbeDeadCount {
+		return false
+	}
+	return alive == nil || alive(path)
+}
+
+// heard takes a pong received on path as a sign of life, see usable
+func (st *stripe) heard(path int) {
+	if path < len(st.paths) {
+		st.paths[path].lostInRow = 0
+	}
+}
+
+// ackPath returns the path of the lowest RTT to carry a packet of acks only
+func (st *stripe) ackPath() int {
+	best := 0
+	for i := range st.paths {
+		if st.paths[i].srtt > 0 && (st.paths[best].srtt <= 0 || st.paths[i].srtt < st.paths[best].srtt) {
+			best = i
+		}
+	}
+	return best
+}
+
+// sendSegs records the push segments segs sent on path at current
+func (st *stripe) sendSegs(path int, segs []stripeSent, current uint32) {
+	p := &st.paths[path]
+	for _, sent := range segs {
+		if seg, ok := st.sent[sent.sn]; ok {
+			st.lose(seg.path, current)
+		}
+		st.sent[sent.sn] = stripeSeg{path: path, ts: sent.ts}
+		p.inflight++
+		p.sentSegs++
+	}
+}
+
+// lose takes a segment in flight on path as lost, the window is halved once per RTT
+func (st *stripe) lose(path int, current uint32) {
+	p := &st.paths[path]
+	if p.inflight > 0 {
+		p.inflight--
+	}
+	p.lostSegs++
+	p.lostInRow++
+	if _itimediff(current, p.recoverTs) < 0 {
+		return
+	}
+	p.ssthresh = p.cwnd / 2
+	if p.ssthresh < IKCP_THRESH_MIN {
+		p.ssthresh = IKCP_THRESH_MIN
+	}
+	p.cwnd = p.ssthresh
+	p.incr = p.cwnd * stripeMss
+	p.recoverTs = current + uint32(p.srtt)
+}
+
+// ack credits the ack of sn to the path it was sent on, ts is echoed by the ack and gives an
+// RTT sample of the path if it is the one of the last transmission, ts is 0 for una
+func (st *stripe) ack(sn, ts, current, wnd uint32) {
+	seg, ok := st.sent[sn]
+	if !ok {
+		return
+	}
+	delete(st.sent, sn)
+	p := &st.paths[seg.path]
+	if p.inflight > 0 {
+		p.inflight--
+	}
+	p.ackedSegs++
+	p.lostInRow = 0
+	if ts != 0 && ts == seg.ts {
+		if rtt := _itimediff(current, ts); rtt >= 0 {
+			p.updateRtt(rtt)
+		}
+	}
+
+	// as KCP does for the stream, see KCP.Input
+	if p.cwnd >= wnd {
+		return
+	}
+	const mss = stripeMss
+	if p.cwnd < p.ssthresh {
+		p.cwnd++
+		p.incr += mss
+	} else {
+		if p.incr < mss {
+			p.incr = mss
+		}
+		p.incr += (mss*mss)/p.incr + (mss / 16)
+		if (p.cwnd+1)*mss <= p.incr {
+			p.cwnd = (p.incr + mss - 1) / mss
+		}
+	}
+	if p.cwnd > wnd {
+		p.cwnd = wnd
+		p.incr = wnd * mss
+	}
+}
+
+func (p *stripePath) updateRtt(rtt int32) {
+	if rtt < 1 {
+		rtt = 1 // keep 0 for not measured
+	}
+	if p.srtt == 0 {
+		p.srtt = rtt
+		p.rttvar = rtt >> 1
+		return
+	}
+	delta := rtt - p.srtt
+	p.srtt += delta >> 3
+	if delta < 0 {
+		delta = -delta
+	}
+	p.rttvar += (delta - p.rttvar) >> 2
+}
+
+// input credits the acks and the una of the segments received from the peer to the paths
+func (st *stripe) input(data []byte, current, wnd uint32) {
+	una := st.una
+	DecodeSegments(data, func(hdr *SegmentHeader, payload []byte) {
+		if hdr.Cmd == IKCP_CMD_ACK {
+			st.ack(hdr.Sn, hdr.Ts, current, wnd)
+		}
+		if _itimediff(hdr.Una, una) > 0 {
+			una = hdr.Una
+		}
+	})
+	n := _itimediff(una, st.una)
+	if n <= 0 {
+		return
+	}
+	if int(n) <= len(st.sent) {
+		for sn := st.una; sn != una; sn++ {
+			st.ack(sn, 0, current, wnd)
+		}
+	} else {
+		for sn := range st.sent {
+			if _itimediff(sn, una) < 0 {
+				st.ack(sn, 0, current, wnd)
+			}
+		}
+	}
+	st.una = una
+}
+
+// SetMultipath sets how the packets are sent across the paths, one of MultipathReplicate,
+// MultipathMinRtt and MultipathWeighted. The striping modes send each packet on a single path
+// and do not replicate, the peer needs no support of them
+func (s *UDPStream) SetMultipath(mode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mode == MultipathReplicate {
+		s.stripe = nil
+		s.kcp.pathCwnd = 0
+		return
+	}
+	if s.stripe == nil {
+		s.stripe = newStripe(mode, len(s.tunnels), s.kcp.snd_una)
+	}
+	s.stripe.mode = mode
+	s.kcp.pathCwnd = s.stripe.cwnd()
+	if s.parallelStatus {
+		s.parallelStatus = false
+		atomic.AddUint64(&DefaultSnmp.ParallelStatuss, ^uint64(0))
+	}
+}
+
+// resetStripe starts the path windows over after the paths changed, with the lock held
+func (s *UDPStream) resetStripe() {
+	if s.stripe != nil {
+		s.stripe.reset(len(s.tunnels), s.kcp.snd_una)
+		s.kcp.pathCwnd = s.stripe.cwnd()
+	}
+}
+
+// outputStripe sends a packet on the path picked by the scheduler of the stripe
+func (s *UDPStream) outputStripe(buf []byte, current64 uint64) {
+	if current64 == 0 {
+		_, current64 = currentMs()
+	}
+	current := uint32(current64)
+	st := s.stripe
+
+	var segs []stripeSent
+	DecodeSegments(buf[s.headerSize:], func(hdr *SegmentHeader, payload []byte) {
+		if hdr.Cmd == IKCP_CMD_PUSH {
+			segs = append(segs, stripeSent{hdr.Sn, hdr.Ts})
+		}
+	})
+	var path int
+	if len(segs) == 0 {
+		path = s.fastestPath()
+	} else {
+		path = st.pick(s.kcp.rx_srtt, s.pathAlive)
+		st.sendSegs(path, segs, current)
+		s.kcp.pathCwnd = st.cwnd()
+	}
+	for i := len(s.msgss); i <= path; i++ {
+		s.msgss = append(s.msgss, make([]ipv4.Message, 0))
+	}
+
+	copy(buf, s.uuid[:])
+	s.encodeFrameHeader(buf[:s.headerSize], FV2)
+	if s.primaryReceivedTell {
+		s.setFramePrimaryReceived(buf)
+	}
+	s.msgss[path] = append(s.msgss[path], ipv4.Message{Buffers: [][]byte{buf}, Addr: s.remotes[path]})
+	ps := s.pathStat(path)
+	ps.outPkts++
+	ps.unacked++
+
+	atomic.AddUint64(&s.stats.outPkts, 1)
+	atomic.AddUint64(&s.stats.outBytes, uint64(len(buf)))
+}
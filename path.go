@@ -0,0 +1,606 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+	"golang.org/x/net/ipv4"
+)
+
+// ---path frame---
+// frame header (FRAME_FLAG_PATH) + type uint8 + data [8]byte + mac [8]byte + zero padding
+//
+// a frame carrying no KCP segments, sent to a single address to validate it before a path
+// of the stream moves to it, the peer echoes the data of a challenge in a response with the
+// mac of the uuid and the data keyed by the path key of the SYN reply, so only the peer which
+// took part in the handshake can move a path. The mac is zero in the other frames. It is
+// padded to the smallest frame the tunnels read
+const (
+	pathChallenge byte = iota + 1
+	pathResponse
+	pathProbeReq // sent by Prober with uuid.Nil
+	pathProbeAck // answered by any transport
+	pathPing     // sent on each path by a stream, see PathStats
+	pathPong
+)
+
+const (
+	pathDataSize  = 8
+	pathMacSize   = 8
+	pathKeySize   = 16
+	pathFrameSize = gouuid.Size + IKCP_OVERHEAD
+)
+
+// PathChallengeTimeout is the time to wait for a path response before the challenge fails,
+// a ping unanswered in it is lost
+var PathChallengeTimeout = time.Second
+
+// PathPingInterval is the interval of the pings sent on each path while a stream sends
+var PathPingInterval = time.Second
+
+// MigrateCallback is called when the path of a stream moves from one remote to another,
+// without the stream lock held
+type MigrateCallback func(s *UDPStream, path int, from, to net.Addr)
+
+type pathProbe struct {
+	addr   *net.UDPAddr
+	data   [pathDataSize]byte
+	sentAt time.Time
+}
+
+func isPathFrame(data []byte) bool {
+	return len(data) > gouuid.Size && data[gouuid.Size]&FRAME_FLAG_PATH != 0
+}
+
+// newPathKey returns a random path key, issued by the acceptor in the SYN reply
+func newPathKey() ([]byte, error) {
+	key := make([]byte, pathKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// pathMac returns the mac of the response to the challenge data of the stream uuid
+func pathMac(key []byte, uuid gouuid.UUID, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(uuid[:])
+	mac.Write(data)
+	return mac.Sum(nil)[:pathMacSize]
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+// sendPathFrame sends a path frame of the stream uuid to addr by tunnel, bypassing KCP
+func sendPathFrame(tunnel *UDPTunnel, addr *net.UDPAddr, uuid gouuid.UUID, typ byte, data []byte) {
+	buf := xmitBuf.Get().([]byte)[:pathFrameSize]
+	for i := range buf {
+		buf[i] = 0
+	}
+	copy(buf, uuid[:])
+	buf[gouuid.Size] = FV2<<4 | FRAME_FLAG_PATH
+	buf[FrameHeaderSize] = typ
+	copy(buf[FrameHeaderSize+1:], data)
+	tunnel.output([]ipv4.Message{{Buffers: [][]byte{buf}, Addr: addr}})
+}
+
+// checkPath challenges addr if a packet accepted by KCP came from it by tunnel while the path
+// of tunnel sends elsewhere, only if the peer issued or received a path key in the DialInfo DV2
+// handshake, it is called with the lock held
+func (s *UDPStream) checkPath(tunnel *UDPTunnel, addr net.Addr) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok || s.negotiated == nil || len(s.pathKey) == 0 {
+		return
+	}
+	path := -1
+	for i, t := range s.tunnels {
+		if t != tunnel {
+			continue
+		}
+		if udpAddrEqual(s.remotes[i], uaddr) {
+			return
+		}
+		if path < 0 {
+			path = i
+		}
+	}
+	if path < 0 {
+		return
+	}
+	if probe, ok := s.pathProbes[path]; ok && time.Since(probe.sentAt) < PathChallengeTimeout {
+		return
+	} else if ok { // expirePath not run yet
+		s.failProbe(path, probe)
+	}
+
+	probe := &pathProbe{addr: uaddr, sentAt: time.Now()}
+	if _, err := rand.Read(probe.data[:]); err != nil {
+		s.log.Log(ERROR, "UDPStream::checkPath", "err", err)
+		return
+	}
+	if s.pathProbes == nil {
+		s.pathProbes = make(map[int]*pathProbe)
+	}
+	s.pathProbes[path] = probe
+	if s.timers.sched != nil {
+		s.timers.sched.Put(func() { s.expirePath(path, probe) }, probe.sentAt.Add(PathChallengeTimeout))
+	}
+
+	s.log.Log(INFO, "UDPStream::checkPath challenge", "path", path, "remote", s.remotes[path], "addr", uaddr)
+	atomic.AddUint64(&s.stats.pathChallenges, 1)
+	atomic.AddUint64(&DefaultSnmp.PathChallenges, 1)
+	sendPathFrame(tunnel, uaddr, s.uuid, pathChallenge, probe.data[:])
+}
+
+// expirePath fails the challenge probe of path if it is still unanswered
+func (s *UDPStream) expirePath(path int, probe *pathProbe) {
+	s.mu.Lock()
+	s.failProbe(path, probe)
+	s.mu.Unlock()
+}
+
+// failProbe drops the challenge probe of path and counts it failed, with the lock held
+func (s *UDPStream) failProbe(path int, probe *pathProbe) {
+	if s.pathProbes[path] != probe {
+		return
+	}
+	delete(s.pathProbes, path)
+	s.log.Log(INFO, "UDPStream::failProbe", "path", path, "addr", probe.addr)
+	atomic.AddUint64(&DefaultSnmp.PathChallengeFails, 1)
+}
+
+// inputPath handles a path frame received from addr by tunnel
+func (s *UDPStream) inputPath(data []byte, tunnel *UDPTunnel, addr net.Addr) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok || tunnel == nil || len(data) < pathFrameSize {
+		return
+	}
+	typ, pathData := data[FrameHeaderSize], data[FrameHeaderSize+1:FrameHeaderSize+1+pathDataSize]
+
+	switch typ {
+	case pathChallenge:
+		s.mu.Lock()
+		key := s.pathKey
+		s.mu.Unlock()
+		if len(key) == 0 {
+			return
+		}
+		resp := append(append(make([]byte, 0, pathDataSize+pathMacSize), pathData...), pathMac(key, s.uuid, pathData)...)
+		sendPathFrame(tunnel, uaddr, s.uuid, pathResponse, resp)
+	case pathPing:
+		sendPathFrame(tunnel, uaddr, s.uuid, pathPong, pathData)
+	case pathPong:
+		s.mu.Lock()
+		if path := s.pathIndex(tunnel.LocalAddr(), uaddr, true); path >= 0 {
+			ps, now := s.pathStat(path), time.Now()
+			ps.heard(tunnel, now)
+			if ps.pings.ack(decodeProbeSeq(pathData), now) {
+				s.rankPaths()
+				if s.stripe != nil {
+					s.stripe.heard(path)
+				}
+			}
+		}
+		s.mu.Unlock()
+	case pathResponse:
+		mac := data[FrameHeaderSize+1+pathDataSize : FrameHeaderSize+1+pathDataSize+pathMacSize]
+		s.mu.Lock()
+		if len(s.pathKey) == 0 || !hmac.Equal(mac, pathMac(s.pathKey, s.uuid, pathData)) {
+			s.mu.Unlock()
+			s.log.Log(WARN, "UDPStream::inputPath response", "addr", uaddr, "err", errPathMac)
+			return
+		}
+		for path, probe := range s.pathProbes {
+			if !bytes.Equal(probe.data[:], pathData) || !udpAddrEqual(probe.addr, uaddr) {
+				continue
+			}
+			delete(s.pathProbes, path)
+			from := s.remotes[path]
+			// the slice may be read by pingPaths or shared with the selector, so it is replaced
+			remotes := append([]*net.UDPAddr(nil), s.remotes...)
+			remotes[path] = probe.addr
+			s.remotes = remotes
+			onMigrate := s.onMigrate
+			s.mu.Unlock()
+
+			s.log.Log(INFO, "UDPStream::inputPath migrate", "path", path, "from", from, "to", probe.addr)
+			atomic.AddUint64(&s.stats.pathMigrations, 1)
+			atomic.AddUint64(&DefaultSnmp.PathMigrations, 1)
+			if onMigrate != nil {
+				onMigrate(s, path, from, probe.addr)
+			}
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// pathStat is the accounting of a path of a stream
+type pathStat struct {
+	pings          *probePath
+	outPkts        uint64
+	outReplicaPkts uint64
+	inPkts         uint64
+	inReplicaPkts  uint64
+	copies         CopyStats
+
+	// since the path was last heard from, see pathFailed
+	lastInput time.Time
+	unacked   int    // packets sent
+	outErrs   uint64 // write errors of the tunnel when heard from
+}
+
+// resetPaths starts the state kept by path over after the paths changed, with the lock held
+func (s *UDPStream) resetPaths() {
+	s.pathProbes = nil
+	s.pathStats = nil
+	s.replicaOrder = nil
+	s.resetStripe()
+}
+
+// pathStat returns the accounting of path, with the lock held
+func (s *UDPStream) pathStat(path int) *pathStat {
+	if len(s.pathStats) != len(s.tunnels) {
+		s.pathStats = make([]pathStat, len(s.tunnels))
+		now := time.Now()
+		for i := range s.pathStats {
+			s.pathStats[i].pings = newProbePath()
+			s.pathStats[i].heard(s.tunnels[i], now)
+		}
+	}
+	return &s.pathStats[path]
+}
+
+// pathAlive returns false if ProbeDeadCount pings in a row are lost on path
+func (s *UDPStream) pathAlive(path int) bool {
+	return path >= len(s.pathStats) || s.pathStats[path].pings.lostInRow < ProbeDeadCount
+}
+
+// rankPaths orders the paths but the first one for the replicas, the alive ones first then by
+// loss and RTT, the ones not measured yet last, all of them in order if the peer answers no ping
+func (s *UDPStream) rankPaths() {
+	order := make([]int, 0, len(s.tunnels))
+	for i := 1; i < len(s.tunnels); i++ {
+		order = append(order, i)
+	}
+	healths := make([]PathHealth, len(s.tunnels))
+	for i := range healths {
+		healths[i] = s.pathStat(i).pings.health(probeKey{})
+		if healths[i].Acked == 0 {
+			healths[i].Rtt = time.Duration(math.MaxInt64)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := healths[order[i]], healths[order[j]]
+		if a.Alive != b.Alive {
+			return a.Alive
+		} else if a.Loss != b.Loss {
+			return a.Loss < b.Loss
+		}
+		return a.Rtt < b.Rtt
+	})
+	s.replicaOrder = order
+}
+
+// replicaPath returns the path of the i-th copy of a packet, the first one on path 0
+func (s *UDPStream) replicaPath(i int) int {
+	if i > 0 && len(s.replicaOrder) == len(s.tunnels)-1 {
+		return s.replicaOrder[i-1]
+	}
+	return i
+}
+
+// pathsFirst returns paths with first moved to the head, in place of the last one if it is not
+// in paths, with the lock held
+func (s *UDPStream) pathsFirst(paths []int, first int) []int {
+	s.firstPaths = append(s.firstPaths[:0], first)
+	for _, path := range paths {
+		if path != first && len(s.firstPaths) < len(paths) {
+			s.firstPaths = append(s.firstPaths, path)
+		}
+	}
+	return s.firstPaths
+}
+
+// ack paths of a stream, see SetAckPath
+const (
+	AckPathPrimary = iota // the acks are packed with the data and sent on the first path, the default
+	AckPathFastest        // the acks are sent alone on the path of the lowest RTT, and on all paths while parallel
+)
+
+// SetAckPath sets how the acks and the window probes are sent. With AckPathFastest they leave
+// in packets of their own on the alive path of the lowest RTT measured by the pings, and are
+// replicated on the other parallel paths whatever the redundancy mode
+func (s *UDPStream) SetAckPath(mode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackPath = mode
+	s.kcp.ackAlone = mode == AckPathFastest
+}
+
+// fastestPath returns the alive path of the lowest RTT measured by the pings, or by the data
+// when striping, the first path if none is measured
+func (s *UDPStream) fastestPath() int {
+	best := -1
+	if len(s.pathStats) == len(s.tunnels) {
+		for i := range s.pathStats {
+			pings := s.pathStats[i].pings
+			if pings.acked == 0 || pings.lostInRow >= ProbeDeadCount {
+				continue
+			}
+			if best < 0 || pings.srtt < s.pathStats[best].pings.srtt {
+				best = i
+			}
+		}
+	}
+	if best >= 0 {
+		return best
+	} else if s.stripe != nil {
+		return s.stripe.ackPath()
+	}
+	return 0
+}
+
+// aliveReplicas returns the number of paths alive but the first one
+func (s *UDPStream) aliveReplicas() (n int) {
+	for i := 1; i < len(s.tunnels); i++ {
+		if s.pathAlive(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// pingPaths sends a ping on each path every PathPingInterval, it is called on flush so the
+// streams idle are not pinged. The peer must have negotiated DialInfo DV2 to answer
+func (s *UDPStream) pingPaths() {
+	now := time.Now()
+	s.mu.Lock()
+	if s.state != StateEstablish || s.negotiated == nil || now.Sub(s.lastPing) < PathPingInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPing = now
+	tunnels, remotes := s.tunnels, s.remotes
+	seqs := make([]uint64, len(tunnels))
+	for i := range tunnels {
+		pings := s.pathStat(i).pings
+		pings.expire(now, PathChallengeTimeout)
+		s.pingSeq++
+		pings.send(s.pingSeq, now)
+		seqs[i] = s.pingSeq
+	}
+	s.rankPaths()
+	s.mu.Unlock()
+
+	for i, tunnel := range tunnels {
+		var data [pathDataSize]byte
+		encodeProbeSeq(data[:], seqs[i])
+		sendPathFrame(tunnel, remotes[i], s.uuid, pathPing, data[:])
+	}
+}
+
+// inputPathStat returns the accounting of the path a packet came on from addr by tunnel and
+// counts it, nil if the path is unknown, with the lock held
+func (s *UDPStream) inputPathStat(tunnel *UDPTunnel, addr net.Addr, replica bool) *pathStat {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok || tunnel == nil {
+		return nil
+	}
+	path := s.pathIndex(tunnel.LocalAddr(), uaddr, false)
+	if path < 0 {
+		return nil
+	}
+	ps := s.pathStat(path)
+	ps.heard(tunnel, time.Now())
+	ps.inPkts++
+	if replica {
+		ps.inReplicaPkts++
+	}
+	return ps
+}
+
+// ---path message---
+// op uint8 + local addr (8u string) + remote addr (8u string), in the view of the sender
+const (
+	pathAdd byte = iota + 1
+	pathRemove
+	pathPrimary // the path carries the primary copies, see checkPrimary
+)
+
+var (
+	errPathExist      = errors.New("err path exist")
+	errPathNotFound   = errors.New("err path not found")
+	errPathLast       = errors.New("err path last")
+	errPathNotSupport = errors.New("err path not support")
+	errPathMac        = errors.New("err path response mac")
+)
+
+// AddPath adds the path from the tunnel bound to local to remote, the peer is told with a PTH
+// message and sends back on the reverse path. The stream must have negotiated DialInfo DV2
+func (s *UDPStream) AddPath(local, remote string) error {
+	s.log.Log(INFO, "UDPStream::AddPath", "local", local, "remote", remote)
+
+	remoteAddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return err
+	}
+	var tunnel *UDPTunnel
+	if s.tunnelByAddr != nil {
+		tunnel = s.tunnelByAddr(local)
+	}
+	if tunnel == nil {
+		return errTunnelPick
+	}
+
+	s.mu.Lock()
+	if s.negotiated == nil {
+		s.mu.Unlock()
+		return errPathNotSupport
+	} else if s.pathIndex(tunnel.LocalAddr(), remoteAddr, true) >= 0 {
+		s.mu.Unlock()
+		return errPathExist
+	}
+	s.addPath(tunnel, remoteAddr)
+	s.mu.Unlock()
+	return s.writePath(pathAdd, tunnel.LocalAddr().String(), remoteAddr.String())
+}
+
+// RemovePath removes the path from local to remote and tells the peer, the last path is kept
+func (s *UDPStream) RemovePath(local, remote string) error {
+	s.log.Log(INFO, "UDPStream::RemovePath", "local", local, "remote", remote)
+
+	localAddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return err
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.negotiated == nil {
+		s.mu.Unlock()
+		return errPathNotSupport
+	}
+	path := s.pathIndex(localAddr, remoteAddr, true)
+	if path < 0 {
+		s.mu.Unlock()
+		return errPathNotFound
+	} else if len(s.tunnels) == 1 {
+		s.mu.Unlock()
+		return errPathLast
+	}
+	s.removePath(path)
+	s.mu.Unlock()
+	return s.writePath(pathRemove, localAddr.String(), remoteAddr.String())
+}
+
+func (s *UDPStream) writePath(op byte, local, remote string) error {
+	buf := make([]byte, 3+len(local)+len(remote))
+	p := encode8u(buf, op)
+	p = encode8uString(p, local)
+	encode8uString(p, remote)
+	_, err := s.WriteFlag(PTH, buf)
+	return err
+}
+
+// pathIndex returns the index of the path from local to remote, any path to remote
+// if strict is false and none matches both, -1 if not found
+func (s *UDPStream) pathIndex(local, remote *net.UDPAddr, strict bool) int {
+	candidate := -1
+	for i := range s.tunnels {
+		if !udpAddrEqual(s.remotes[i], remote) {
+			continue
+		}
+		if udpAddrEqual(s.locals[i], local) {
+			return i
+		} else if candidate < 0 {
+			candidate = i
+		}
+	}
+	if strict {
+		return -1
+	}
+	return candidate
+}
+
+// addPath appends a path, the slices may be shared with the selector so they are copied
+func (s *UDPStream) addPath(tunnel *UDPTunnel, remote *net.UDPAddr) {
+	n := len(s.tunnels)
+	s.tunnels = append(s.tunnels[:n:n], tunnel)
+	s.locals = append(s.locals[:n:n], tunnel.LocalAddr())
+	s.remotes = append(s.remotes[:n:n], remote)
+	s.resetPaths()
+}
+
+func (s *UDPStream) removePath(path int) {
+	tunnels := make([]*UDPTunnel, 0, len(s.tunnels)-1)
+	locals := make([]*net.UDPAddr, 0, len(s.tunnels)-1)
+	remotes := make([]*net.UDPAddr, 0, len(s.tunnels)-1)
+	for i := range s.tunnels {
+		if i != path {
+			tunnels = append(tunnels, s.tunnels[i])
+			locals = append(locals, s.locals[i])
+			remotes = append(remotes, s.remotes[i])
+		}
+	}
+	s.tunnels, s.locals, s.remotes = tunnels, locals, remotes
+	s.resetPaths()
+}
+
+// recvPth applies the path message of the peer, an invalid one is ignored
+func (s *UDPStream) recvPth(data []byte) (n int, err error) {
+	var op byte
+	var peerLocal, peerRemote string
+	p, err := decode8u(data, &op)
+	if err == nil {
+		p, err = decode8uString(p, &peerLocal)
+	}
+	if err == nil {
+		_, err = decode8uString(p, &peerRemote)
+	}
+	var local, remote *net.UDPAddr
+	if err == nil {
+		local, err = net.ResolveUDPAddr("udp", peerRemote)
+	}
+	if err == nil {
+		remote, err = net.ResolveUDPAddr("udp", peerLocal)
+	}
+	if err != nil {
+		s.log.Log(WARN, "UDPStream::recvPth", "err", err)
+		return len(data), nil
+	}
+
+	switch op {
+	case pathAdd:
+		var tunnel *UDPTunnel
+		if s.tunnelByAddr != nil {
+			tunnel = s.tunnelByAddr(local.String())
+		}
+		if tunnel == nil {
+			if tunnels := s.sel.Pick([]string{remote.String()}); len(tunnels) == 1 {
+				tunnel = tunnels[0]
+			}
+		}
+		if tunnel == nil {
+			s.log.Log(WARN, "UDPStream::recvPth add", "local", local, "remote", remote, "err", errTunnelPick)
+			return len(data), nil
+		}
+		if s.pathIndex(tunnel.LocalAddr(), remote, true) < 0 {
+			s.addPath(tunnel, remote)
+		}
+		s.log.Log(INFO, "UDPStream::recvPth add", "local", tunnel.LocalAddr(), "remote", remote)
+	case pathRemove:
+		// strict as another path may share the address or the port
+		path := s.pathIndex(local, remote, true)
+		if path < 0 || len(s.tunnels) == 1 {
+			s.log.Log(WARN, "UDPStream::recvPth remove", "local", local, "remote", remote, "path", path)
+			return len(data), nil
+		}
+		s.removePath(path)
+		s.log.Log(INFO, "UDPStream::recvPth remove", "local", local, "remote", remote)
+	case pathPrimary:
+		path := s.pathIndex(local, remote, true)
+		if path < 0 {
+			s.log.Log(WARN, "UDPStream::recvPth primary", "local", local, "remote", remote, "path", path)
+			return len(data), nil
+		} else if path > 0 {
+			s.promotePath(path)
+		}
+		s.log.Log(INFO, "UDPStream::recvPth primary", "local", local, "remote", remote, "path", path)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,181 @@
+package kcp
+
+import "errors"
+
+var errNotParallelPolicy = errors.New("err not parallel policy")
+
+// RedundancyPolicy decides the paths each packet of a stream is sent on when it is not striped,
+// the first one carries the primary copy and the others the replicas. A policy serves a single
+// stream, see SetRedundancyPolicy, and is called with the stream lock held
+type RedundancyPolicy interface {
+	// Output returns the paths of the packet told by ctx, at least one, and whether to set
+	// FRAME_FLAG_REPLICA_TRIGGER to have the peer replicate too. The paths are not kept after
+	// the call so the slice can be reused
+	Output(ctx *RedundancyContext) (paths []int, trigger bool)
+	// Input is told a frame received from the peer before its flags are recorded, it returns
+	// true if a parallel period starts
+	Input(ctx *RedundancyContext) (trigger bool)
+}
+
+// RedundancyContext is what a RedundancyPolicy decides on, the packet to send or the frame
+// received and the state of the stream, it is valid during the call only
+type RedundancyContext struct {
+	Now     uint64 // ms of the monotonic clock
+	XmitMax uint32 // the most transmissions of a segment of the packet, 0 on input
+	Delayts uint32 // the longest ms since the first transmission of a segment of the packet, 0 on input
+	Trigger bool   // on input, FRAME_FLAG_REPLICA_TRIGGER of the frame
+	Replica bool   // on input, FRAME_FLAG_REPLICA of the frame
+
+	s *UDPStream
+}
+
+// redundancyContext returns the context of a packet to send, with the lock held
+func (s *UDPStream) redundancyContext(current64 uint64, xmitMax, delayts uint32) *RedundancyContext {
+	if current64 == 0 {
+		_, current64 = currentMs()
+	}
+	s.policyCtx = RedundancyContext{Now: current64, XmitMax: xmitMax, Delayts: delayts, s: s}
+	return &s.policyCtx
+}
+
+// Paths returns the number of paths of the stream
+func (ctx *RedundancyContext) Paths() int {
+	return len(ctx.s.tunnels)
+}
+
+// PathAlive returns false if ProbeDeadCount pings in a row are lost on path
+func (ctx *RedundancyContext) PathAlive(path int) bool {
+	return ctx.s.pathAlive(path)
+}
+
+// ReplicaPath returns the path of the i-th copy of a packet, path 0 first then the others
+// ranked by the pings, the alive ones first then by loss and RTT
+func (ctx *RedundancyContext) ReplicaPath(i int) int {
+	return ctx.s.replicaPath(i)
+}
+
+// PathStats returns the statistics of the paths, it allocates so it is better not called on
+// every packet
+func (ctx *RedundancyContext) PathStats() []PathStats {
+	return ctx.s.collectPathStats()
+}
+
+// PrimaryReceived returns whether the peer told by FRAME_FLAG_PRIMARY_RECEIVED it received
+// primary copies since the feedback was reset
+func (ctx *RedundancyContext) PrimaryReceived() bool {
+	return ctx.s.primaryReceived
+}
+
+// PrimaryReceivedTell returns whether primary copies of the peer were received since the
+// feedback was reset, which the packets sent tell by FRAME_FLAG_PRIMARY_RECEIVED
+func (ctx *RedundancyContext) PrimaryReceivedTell() bool {
+	return ctx.s.primaryReceivedTell
+}
+
+// ResetFeedback forgets the primary copies received on both sides, they are learned again
+// from the frames received next
+func (ctx *RedundancyContext) ResetFeedback() {
+	ctx.s.primaryReceived = false
+	ctx.s.primaryReceivedTell = false
+}
+
+// ParallelPolicy is the default RedundancyPolicy. A packet delayed DelayMs starts a parallel
+// period of DurationMs, asking the peer to do the same, in which the packets are replicated on
+// one more path for every IntervalMs of delay above DelayMs. Out of the periods the packets are
+// replicated until both sides received primary copies, and always if Always is set
+type ParallelPolicy struct {
+	DelayMs    uint32
+	IntervalMs uint32
+	DurationMs uint32
+	Always     bool
+
+	expireMs   uint64
+	delaytsMax uint32
+	paths      []int
+}
+
+// NewParallelPolicy creates a ParallelPolicy with the defaults
+func NewParallelPolicy() *ParallelPolicy {
+	return &ParallelPolicy{
+		DelayMs:    DefaultParallelDelayMs,
+		IntervalMs: DefaultParallelIntervalMs,
+		DurationMs: DefaultParallelDurationMs,
+	}
+}
+
+func (p *ParallelPolicy) Output(ctx *RedundancyContext) (paths []int, trigger bool) {
+	if ctx.Delayts >= p.DelayMs {
+		trigger = p.try(ctx)
+	}
+	p.paths = append(p.paths[:0], 0)
+	if ctx.Now >= p.expireMs && ctx.PrimaryReceived() && ctx.PrimaryReceivedTell() && !p.Always && ctx.PathAlive(0) {
+		return p.paths, trigger
+	}
+	if ctx.Delayts > p.delaytsMax {
+		p.delaytsMax = ctx.Delayts
+	}
+	parallel := 2
+	if p.delaytsMax > p.DelayMs {
+		parallel += int((p.delaytsMax - p.DelayMs) / p.IntervalMs)
+	}
+	// no replicas on the paths found dead by the pings
+	for i := 1; i < ctx.Paths() && len(p.paths) < parallel; i++ {
+		if path := ctx.ReplicaPath(i); ctx.PathAlive(path) {
+			p.paths = append(p.paths, path)
+		}
+	}
+	return p.paths, trigger
+}
+
+func (p *ParallelPolicy) Input(ctx *RedundancyContext) (trigger bool) {
+	if ctx.Trigger {
+		trigger = p.try(ctx)
+	}
+	return trigger
+}
+
+// try starts a parallel period or extends the current one, true if it starts
+func (p *ParallelPolicy) try(ctx *RedundancyContext) bool {
+	var trigger bool
+	if ctx.Now >= p.expireMs {
+		trigger = true
+		p.delaytsMax = 0
+	}
+	ctx.ResetFeedback()
+	p.expireMs = ctx.Now + uint64(p.DurationMs)
+	return trigger
+}
+
+// SetRedundancyPolicy sets the policy deciding the paths of the packets, a new ParallelPolicy
+// if nil. The SetParallel methods and SetUseParallel only apply to a ParallelPolicy, they log a
+// warning and do nothing with another policy
+func (s *UDPStream) SetRedundancyPolicy(policy RedundancyPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+// redundancyPolicy returns the policy of the stream, a ParallelPolicy unless set, with the
+// lock held
+func (s *UDPStream) redundancyPolicy() RedundancyPolicy {
+	if s.policy == nil {
+		s.policy = NewParallelPolicy()
+	}
+	return s.policy
+}
+
+// parallelPolicy returns the policy of the stream if it is a ParallelPolicy, with the lock held
+func (s *UDPStream) parallelPolicy() (*ParallelPolicy, bool) {
+	p, ok := s.redundancyPolicy().(*ParallelPolicy)
+	return p, ok
+}
+
+// parallelPolicyToSet returns the ParallelPolicy changed by the setter caller, nil with a
+// warning if another policy is set, with the lock held
+func (s *UDPStream) parallelPolicyToSet(caller string) *ParallelPolicy {
+	p, ok := s.parallelPolicy()
+	if !ok {
+		s.log.Log(WARN, caller, "err", errNotParallelPolicy)
+	}
+	return p
+}
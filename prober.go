@@ -0,0 +1,309 @@
+package kcp
+
+import (
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// ProbeDeadCount is the number of probes in a row lost before a path is not alive
+var ProbeDeadCount = 3
+
+// PathHealth is the probing result of a (tunnel, remote) pair
+type PathHealth struct {
+	Local  string
+	Remote string
+	Rtt    time.Duration // smoothed, 0 until the first ack
+	Loss   float64       // ratio of the last 32 probes at most lost
+	Sent   uint64
+	Acked  uint64
+	Alive  bool // false once ProbeDeadCount probes in a row are lost
+}
+
+// Prober sends a probe on each (tunnel, remote) pair of a transport every interval and records
+// their RTT and loss for the selectors, it is set by TransportOption.Prober. A probe is a path
+// frame of uuid.Nil answered by the transport of the remote, it is lost if not answered in timeout
+type Prober struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	t       *UDPTransport
+	remotes []*net.UDPAddr
+	paths   map[probeKey]*probePath
+	seq     uint64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+type probeKey struct {
+	local  string
+	remote string
+}
+
+// probePath is the probing state of a path, also kept by the streams for their pings
+type probePath struct {
+	pending   map[uint64]time.Time // sent time by seq
+	srtt      time.Duration
+	rttvar    time.Duration
+	history   uint32 // 1 bit per probe, set if acked, the latest in the lowest bit
+	results   int    // number of probes in history
+	lostInRow int
+	sent      uint64
+	acked     uint64
+}
+
+// NewProber creates a prober of the remotes, started by the transport it is set to
+func NewProber(remotes []string, interval, timeout time.Duration) (*Prober, error) {
+	p := &Prober{
+		interval: interval,
+		timeout:  timeout,
+		paths:    make(map[probeKey]*probePath),
+		die:      make(chan struct{}),
+	}
+	if err := p.SetRemotes(remotes); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetRemotes replaces the remotes probed, the results of the others are dropped
+func (p *Prober) SetRemotes(remotes []string) error {
+	addrs := make([]*net.UDPAddr, len(remotes))
+	for i, remote := range remotes {
+		addr, err := net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return err
+		}
+		addrs[i] = addr
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remotes = addrs
+	return nil
+}
+
+// Close stops probing
+func (p *Prober) Close() error {
+	p.dieOnce.Do(func() {
+		close(p.die)
+	})
+	return nil
+}
+
+func (p *Prober) start(t *UDPTransport) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.t != nil {
+		return errInvalidOperation
+	}
+	p.t = t
+	go p.loop()
+	return nil
+}
+
+func (p *Prober) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probe()
+		select {
+		case <-ticker.C:
+		case <-p.die:
+			return
+		}
+	}
+}
+
+// probe expires the probes unanswered in timeout and sends a new one on each pair
+func (p *Prober) probe() {
+	tunnels := p.t.Tunnels()
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paths := make(map[probeKey]*probePath, len(tunnels)*len(p.remotes))
+	for _, tunnel := range tunnels {
+		local := tunnel.LocalAddr().String()
+		for _, remote := range p.remotes {
+			key := probeKey{local, remote.String()}
+			path, ok := p.paths[key]
+			if !ok {
+				path = newProbePath()
+			}
+			paths[key] = path
+			path.expire(now, p.timeout)
+
+			p.seq++
+			path.send(p.seq, now)
+			var data [pathDataSize]byte
+			encodeProbeSeq(data[:], p.seq)
+			sendPathFrame(tunnel, remote, gouuid.Nil, pathProbeReq, data[:])
+		}
+	}
+	p.paths = paths
+}
+
+// ack records the answer to the probe seq received from remote by tunnel
+func (p *Prober) ack(tunnel *UDPTunnel, remote *net.UDPAddr, data []byte) {
+	seq := decodeProbeSeq(data)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if path, ok := p.paths[probeKey{tunnel.LocalAddr().String(), remote.String()}]; ok {
+		path.ack(seq, time.Now())
+	}
+}
+
+func encodeProbeSeq(data []byte, seq uint64) {
+	encode32u(data, uint32(seq))
+	encode32u(data[4:], uint32(seq>>32))
+}
+
+func decodeProbeSeq(data []byte) uint64 {
+	var lo, hi uint32
+	decode32u(data, &lo)
+	decode32u(data[4:], &hi)
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+func newProbePath() *probePath {
+	return &probePath{pending: make(map[uint64]time.Time)}
+}
+
+// send records the probe seq sent at now
+func (path *probePath) send(seq uint64, now time.Time) {
+	path.pending[seq] = now
+	path.sent++
+}
+
+// expire records the probes unanswered in timeout as lost
+func (path *probePath) expire(now time.Time, timeout time.Duration) {
+	for seq, sent := range path.pending {
+		if now.Sub(sent) >= timeout {
+			delete(path.pending, seq)
+			path.record(false)
+		}
+	}
+}
+
+// ack records the answer to the probe seq, false if it is not pending
+func (path *probePath) ack(seq uint64, now time.Time) bool {
+	sent, ok := path.pending[seq]
+	if !ok {
+		return false
+	}
+	delete(path.pending, seq)
+	rtt := now.Sub(sent)
+	if path.acked == 0 {
+		path.srtt = rtt
+		path.rttvar = rtt / 2
+	} else {
+		delta := rtt - path.srtt
+		path.srtt += delta / 8
+		if delta < 0 {
+			delta = -delta
+		}
+		path.rttvar += (delta - path.rttvar) / 4
+	}
+	path.acked++
+	path.record(true)
+	return true
+}
+
+func (path *probePath) record(acked bool) {
+	path.history <<= 1
+	if acked {
+		path.history |= 1
+		path.lostInRow = 0
+	} else {
+		path.lostInRow++
+	}
+	if path.results < 32 {
+		path.results++
+	}
+}
+
+func (path *probePath) health(key probeKey) PathHealth {
+	h := PathHealth{
+		Local:  key.local,
+		Remote: key.remote,
+		Rtt:    path.srtt,
+		Sent:   path.sent,
+		Acked:  path.acked,
+		Alive:  path.lostInRow < ProbeDeadCount,
+	}
+	if path.results > 0 {
+		mask := uint32(1<<uint(path.results) - 1)
+		if path.results == 32 {
+			mask = ^uint32(0)
+		}
+		h.Loss = float64(path.results-bits.OnesCount32(path.history&mask)) / float64(path.results)
+	}
+	return h
+}
+
+// Health returns the probing result of the pair from the tunnel bound to local to remote,
+// false if the pair is not probed yet
+func (p *Prober) Health(local, remote string) (PathHealth, bool) {
+	return p.health(local, normalizeAddr(remote))
+}
+
+func (p *Prober) health(local, remote string) (PathHealth, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := probeKey{local, remote}
+	path, ok := p.paths[key]
+	if !ok {
+		return PathHealth{}, false
+	}
+	return path.health(key), true
+}
+
+// Healths returns the probing results of all pairs, sorted by local and remote
+func (p *Prober) Healths() []PathHealth {
+	p.mu.Lock()
+	hs := make([]PathHealth, 0, len(p.paths))
+	for key, path := range p.paths {
+		hs = append(hs, path.health(key))
+	}
+	p.mu.Unlock()
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].Local != hs[j].Local {
+			return hs[i].Local < hs[j].Local
+		}
+		return hs[i].Remote < hs[j].Remote
+	})
+	return hs
+}
+
+// normalizeAddr returns addr in the form of net.UDPAddr.String()
+func normalizeAddr(addr string) string {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return addr
+	}
+	return udpAddr.String()
+}
+
+// handleProbe answers a probe of a Prober or passes the answer to ours
+func (t *UDPTransport) handleProbe(data []byte, tunnel *UDPTunnel, addr net.Addr) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok || tunnel == nil || len(data) < pathFrameSize {
+		return
+	}
+	typ, probeData := data[FrameHeaderSize], data[FrameHeaderSize+1:FrameHeaderSize+1+pathDataSize]
+	switch typ {
+	case pathProbeReq:
+		sendPathFrame(tunnel, uaddr, gouuid.Nil, pathProbeAck, probeData)
+	case pathProbeAck:
+		if t.prober != nil {
+			t.prober.ack(tunnel, uaddr, probeData)
+		}
+	}
+}
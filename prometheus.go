@@ -0,0 +1,375 @@
+package kcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// buckets of the per-stream distributions
+var (
+	PrometheusLatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	PrometheusWindowBuckets  = []float64{1, 4, 16, 64, 256, 1024, 4096}
+)
+
+type snmpMetric struct {
+	header string
+	name   string
+	typ    string
+	help   string
+}
+
+// snmpMetrics describes the Snmp fields in the order of Snmp.Header()
+var snmpMetrics = []snmpMetric{
+	{"BytesSent", "kcp_bytes_sent_total", "counter", "bytes sent from upper level"},
+	{"BytesReceived", "kcp_bytes_received_total", "counter", "bytes received to upper level"},
+	{"MaxConn", "kcp_max_conn", "gauge", "max number of connections ever reached"},
+	{"ActiveOpens", "kcp_active_opens_total", "counter", "accumulated active open connections"},
+	{"PassiveOpens", "kcp_passive_opens_total", "counter", "accumulated passive open connections"},
+	{"CurrEstab", "kcp_curr_estab", "gauge", "current number of established connections"},
+	{"DialTimeout", "kcp_dial_timeout_total", "counter", "dial timeout count"},
+	{"InErrs", "kcp_in_errs_total", "counter", "UDP read errors reported from net.PacketConn"},
+	{"InCsumErrors", "kcp_in_csum_errors_total", "counter", "checksum errors from CRC32"},
+	{"KCPInErrors", "kcp_kcp_in_errors_total", "counter", "packet iput errors reported from KCP"},
+	{"InPkts", "kcp_in_pkts_total", "counter", "incoming packets count"},
+	{"OutPkts", "kcp_out_pkts_total", "counter", "outgoing packets count"},
+	{"InSegs", "kcp_in_segs_total", "counter", "incoming KCP segments"},
+	{"OutSegs", "kcp_out_segs_total", "counter", "outgoing KCP segments"},
+	{"InBytes", "kcp_in_bytes_total", "counter", "UDP bytes received"},
+	{"OutBytes", "kcp_out_bytes_total", "counter", "UDP bytes sent"},
+	{"RetransSegs", "kcp_retrans_segs_total", "counter", "accmulated retransmited segments"},
+	{"FastRetransSegs", "kcp_fast_retrans_segs_total", "counter", "accmulated fast retransmitted segments"},
+	{"EarlyRetransSegs", "kcp_early_retrans_segs_total", "counter", "accmulated early retransmitted segments"},
+	{"LostSegs", "kcp_lost_segs_total", "counter", "number of segs infered as lost"},
+	{"RepeatSegs", "kcp_repeat_segs_total", "counter", "number of segs duplicated"},
+	{"Parallels", "kcp_parallels_total", "counter", "parallel count"},
+	{"ParallelStatuss", "kcp_parallel_status", "gauge", "number of streams in parallel status"},
+	{"RtoMax", "kcp_rto_max_ms", "gauge", "rto max"},
+	{"AckCostMax", "kcp_ack_cost_max_ms", "gauge", "ack cost max"},
+	{"PathChallenges", "kcp_path_challenges_total", "counter", "path challenges sent to new remote addresses"},
+	{"PathChallengeFails", "kcp_path_challenge_fails_total", "counter", "path challenges unanswered in time"},
+	{"PathMigrations", "kcp_path_migrations_total", "counter", "paths moved to a validated remote address"},
+	{"PathFailovers", "kcp_path_failovers_total", "counter", "primary paths replaced after they failed"},
+	{"ReplicaDataBytes", "kcp_replica_data_bytes_total", "counter", "bytes of fresh data replicated"},
+	{"ReplicaRetransBytes", "kcp_replica_retrans_bytes_total", "counter", "bytes of retransmissions replicated"},
+	{"ReplicaTailBytes", "kcp_replica_tail_bytes_total", "counter", "bytes of tail segments replicated"},
+	{"ReplicaAckBytes", "kcp_replica_ack_bytes_total", "counter", "bytes of acks replicated"},
+	{"UsefulReplicas", "kcp_useful_replicas_total", "counter", "replica packets received carrying a segment received first"},
+	{"WastedReplicas", "kcp_wasted_replicas_total", "counter", "replica packets received carrying data segments all received before"},
+	{"InputFullDrops", "kcp_input_full_drops_total", "counter", "datagrams received dropped as the input queues are full"},
+	{"InputOldestDrops", "kcp_input_oldest_drops_total", "counter", "datagrams queued dropped for the ones received next"},
+	{"InputOpenDrops", "kcp_input_open_drops_total", "counter", "datagrams of unknown streams dropped above the open limit"},
+	{"InputStreamDrops", "kcp_input_stream_drops_total", "counter", "datagrams of a stream dropped above the stream limit"},
+}
+
+// PrometheusHandler exposes the Snmp counters, the tunnels and the streams of
+// the transports in the Prometheus text exposition format
+type PrometheusHandler struct {
+	snmp       *Snmp
+	transports []*UDPTransport
+}
+
+// NewPrometheusHandler creates a handler exposing snmp, DefaultSnmp if nil, and the given transports
+func NewPrometheusHandler(snmp *Snmp, transports ...*UDPTransport) *PrometheusHandler {
+	if snmp == nil {
+		snmp = DefaultSnmp
+	}
+	return &PrometheusHandler{snmp: snmp, transports: transports}
+}
+
+// ServeHTTP implements http.Handler
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := h.WritePrometheus(w); err != nil {
+		DefaultLogger.Log(WARN, "PrometheusHandler::ServeHTTP", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+// WritePrometheus writes all metrics to w in the Prometheus text exposition format
+func (h *PrometheusHandler) WritePrometheus(w io.Writer) error {
+	pw := &promWriter{w: bufio.NewWriter(w)}
+	h.writeSnmp(pw)
+	var sts []*TunnelStats
+	for _, t := range h.transports {
+		for _, tunnel := range t.Tunnels() {
+			sts = append(sts, tunnel.Stats())
+		}
+	}
+	h.writeTunnels(pw, sts)
+	h.writeStreams(pw)
+	h.writePathHealths(pw)
+	h.writeHistograms(pw)
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
+
+func (h *PrometheusHandler) writeSnmp(pw *promWriter) {
+	snmp := h.snmp.Copy()
+	values := snmp.ToSlice()
+	for i, m := range snmpMetrics {
+		pw.family(m.name, m.typ, m.help)
+		pw.sample(m.name, nil, values[i])
+	}
+
+	pw.family("kcp_xmit_interval_max_ms", "gauge", "max interval from first transmission to the xmit-th one")
+	for i, v := range snmp.XmitIntervalMax {
+		pw.sample("kcp_xmit_interval_max_ms", []string{"xmit", strconv.Itoa(i + 1)}, strconv.FormatUint(v, 10))
+	}
+}
+
+func (h *PrometheusHandler) writePathHealths(pw *promWriter) {
+	var hs []PathHealth
+	for _, t := range h.transports {
+		if t.prober != nil {
+			hs = append(hs, t.prober.Healths()...)
+		}
+	}
+	if len(hs) == 0 {
+		return
+	}
+	pw.family("kcp_path_rtt_ms", "gauge", "smoothed RTT of the probes by tunnel and remote")
+	for _, ph := range hs {
+		pw.sample("kcp_path_rtt_ms", []string{"local", ph.Local, "remote", ph.Remote}, strconv.FormatInt(int64(ph.Rtt/time.Millisecond), 10))
+	}
+	pw.family("kcp_path_loss_ratio", "gauge", "ratio of the recent probes lost by tunnel and remote")
+	for _, ph := range hs {
+		pw.sample("kcp_path_loss_ratio", []string{"local", ph.Local, "remote", ph.Remote}, strconv.FormatFloat(ph.Loss, 'g', -1, 64))
+	}
+	pw.family("kcp_path_alive", "gauge", "1 unless the last probes in a row were lost")
+	for _, ph := range hs {
+		pw.sample("kcp_path_alive", []string{"local", ph.Local, "remote", ph.Remote}, promBool(ph.Alive))
+	}
+}
+
+// writeTunnels writes each tunnel family once with a sample by tunnel, the exposition format
+// does not allow a family to be declared twice or its samples to be split
+func (h *PrometheusHandler) writeTunnels(pw *promWriter, sts []*TunnelStats) {
+	if len(sts) == 0 {
+		return
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(st *TunnelStats) uint64
+	}{
+		{"kcp_tunnel_in_pkts_total", "incoming packets count", func(st *TunnelStats) uint64 { return st.InPkts }},
+		{"kcp_tunnel_in_bytes_total", "UDP bytes received", func(st *TunnelStats) uint64 { return st.InBytes }},
+		{"kcp_tunnel_in_errs_total", "packets too short to be a frame", func(st *TunnelStats) uint64 { return st.InErrs }},
+		{"kcp_tunnel_in_drops_total", "packets dropped by the input queues under overload", func(st *TunnelStats) uint64 { return st.InDrops }},
+		{"kcp_tunnel_out_pkts_total", "outgoing packets count", func(st *TunnelStats) uint64 { return st.OutPkts }},
+		{"kcp_tunnel_out_bytes_total", "UDP bytes sent", func(st *TunnelStats) uint64 { return st.OutBytes }},
+	}
+	for _, c := range counters {
+		pw.family(c.name, "counter", c.help)
+		for _, st := range sts {
+			pw.sample(c.name, []string{"local", st.LocalAddr}, strconv.FormatUint(c.value(st), 10))
+		}
+	}
+
+	pw.family("kcp_tunnel_read_errors_total", "counter", "socket read errors by errno")
+	for _, st := range sts {
+		for en, n := range st.ReadErrors {
+			pw.sample("kcp_tunnel_read_errors_total", []string{"local", st.LocalAddr, "errno", strconv.Itoa(int(en))}, strconv.FormatUint(n, 10))
+		}
+	}
+	pw.family("kcp_tunnel_write_errors_total", "counter", "socket write errors by errno")
+	for _, st := range sts {
+		for en, n := range st.WriteErrors {
+			pw.sample("kcp_tunnel_write_errors_total", []string{"local", st.LocalAddr, "errno", strconv.Itoa(int(en))}, strconv.FormatUint(n, 10))
+		}
+	}
+
+	pw.family("kcp_tunnel_send_queue", "gauge", "packets waiting to be sent on wire")
+	for _, st := range sts {
+		pw.sample("kcp_tunnel_send_queue", []string{"local", st.LocalAddr}, strconv.Itoa(st.SendQueue))
+	}
+	pw.family("kcp_tunnel_read_fallback", "gauge", "1 if recvmmsg is not available")
+	for _, st := range sts {
+		pw.sample("kcp_tunnel_read_fallback", []string{"local", st.LocalAddr}, promBool(st.ReadFallback))
+	}
+	pw.family("kcp_tunnel_write_fallback", "gauge", "1 if sendmmsg is not available")
+	for _, st := range sts {
+		pw.sample("kcp_tunnel_write_fallback", []string{"local", st.LocalAddr}, promBool(st.WriteFallback))
+	}
+
+	pw.family("kcp_tunnel_read_batches_total", "counter", "ReadBatch calls by returned packet count")
+	for _, st := range sts {
+		for i, bound := range BatchSizeBuckets {
+			size := []string{"local", st.LocalAddr, "size_le", strconv.Itoa(bound)}
+			pw.sample("kcp_tunnel_read_batches_total", size, strconv.FormatUint(st.ReadBatchSizes[i], 10))
+		}
+	}
+	pw.family("kcp_tunnel_write_batches_total", "counter", "WriteBatch calls by returned packet count")
+	for _, st := range sts {
+		for i, bound := range BatchSizeBuckets {
+			size := []string{"local", st.LocalAddr, "size_le", strconv.Itoa(bound)}
+			pw.sample("kcp_tunnel_write_batches_total", size, strconv.FormatUint(st.WriteBatchSizes[i], 10))
+		}
+	}
+}
+
+func (h *PrometheusHandler) writeStreams(pw *promWriter) {
+	srtt := newPromHistogram(PrometheusLatencyBuckets)
+	rto := newPromHistogram(PrometheusLatencyBuckets)
+	cwnd := newPromHistogram(PrometheusWindowBuckets)
+	waitsnd := newPromHistogram(PrometheusWindowBuckets)
+	states := make(map[int]int)
+	parallel := 0
+
+	for _, t := range h.transports {
+		t.streamm.IterCb(func(key gouuid.UUID, v interface{}) {
+			st := v.(*UDPStream).Stats()
+			states[st.State]++
+			if st.ParallelStatus {
+				parallel++
+			}
+			srtt.observe(float64(st.Srtt))
+			rto.observe(float64(st.Rto))
+			cwnd.observe(float64(st.Cwnd))
+			waitsnd.observe(float64(st.WaitSnd))
+		})
+	}
+
+	pw.family("kcp_streams", "gauge", "streams by state")
+	for _, state := range []int{StateNone, StateEstablish, StateClosed} {
+		pw.sample("kcp_streams", []string{"state", stateName(state)}, strconv.Itoa(states[state]))
+	}
+	pw.family("kcp_streams_parallel", "gauge", "streams in parallel status")
+	pw.sample("kcp_streams_parallel", nil, strconv.Itoa(parallel))
+
+	srtt.write(pw, "kcp_stream_srtt_ms", "smoothed rtt of the streams")
+	rto.write(pw, "kcp_stream_rto_ms", "rto of the streams")
+	cwnd.write(pw, "kcp_stream_cwnd", "congestion window of the streams")
+	waitsnd.write(pw, "kcp_stream_waitsnd", "segments waiting to be sent or acked of the streams")
+}
+
+func (h *PrometheusHandler) writeHistograms(pw *promWriter) {
+	writeHistogram(pw, "kcp_rtt_ms", "rtt samples taken from acks", nil, DefaultHistograms.Rtt.Snapshot())
+	writeHistogram(pw, "kcp_rto_ms", "rto updated after each rtt sample", nil, DefaultHistograms.Rto.Snapshot())
+	writeHistogram(pw, "kcp_dial_time_ms", "cost from sending or receiving SYN to establish", nil, DefaultHistograms.DialTime.Snapshot())
+	writeHistogram(pw, "kcp_copy_gap_ms", "from the first copy of a segment received to the next one", nil, DefaultHistograms.CopyGap.Snapshot())
+
+	pw.family("kcp_ack_cost_ms", "histogram", "cost from first transmission to ack by xmit count")
+	for i := range DefaultHistograms.AckCost {
+		xmit := []string{"xmit", strconv.Itoa(i + 1)}
+		writeHistogram(pw, "kcp_ack_cost_ms", "", xmit, DefaultHistograms.AckCost[i].Snapshot())
+	}
+}
+
+// writeHistogram writes a HistogramSnapshot with PrometheusLatencyBuckets, the family is
+// skipped when help is empty
+func writeHistogram(pw *promWriter, name, help string, labels []string, hs *HistogramSnapshot) {
+	if help != "" {
+		pw.family(name, "histogram", help)
+	}
+	for _, bound := range PrometheusLatencyBuckets {
+		le := append(labels[:len(labels):len(labels)], "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		pw.sample(name+"_bucket", le, strconv.FormatUint(hs.CountLE(uint64(bound)), 10))
+	}
+	pw.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), strconv.FormatUint(hs.Count, 10))
+	pw.sample(name+"_sum", labels, strconv.FormatUint(hs.Sum, 10))
+	pw.sample(name+"_count", labels, strconv.FormatUint(hs.Count, 10))
+}
+
+func stateName(state int) string {
+	switch state {
+	case StateNone:
+		return "none"
+	case StateEstablish:
+		return "establish"
+	case StateClosed:
+		return "closed"
+	}
+	return strconv.Itoa(state)
+}
+
+func promBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+type promHistogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newPromHistogram(bounds []float64) *promHistogram {
+	return &promHistogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (ph *promHistogram) observe(v float64) {
+	for i, bound := range ph.bounds {
+		if v <= bound {
+			ph.counts[i]++
+		}
+	}
+	ph.count++
+	ph.sum += v
+}
+
+func (ph *promHistogram) write(pw *promWriter, name, help string) {
+	pw.family(name, "histogram", help)
+	for i, bound := range ph.bounds {
+		pw.sample(name+"_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, strconv.FormatUint(ph.counts[i], 10))
+	}
+	pw.sample(name+"_bucket", []string{"le", "+Inf"}, strconv.FormatUint(ph.count, 10))
+	pw.sample(name+"_sum", nil, strconv.FormatFloat(ph.sum, 'g', -1, 64))
+	pw.sample(name+"_count", nil, strconv.FormatUint(ph.count, 10))
+}
+
+// promWriter writes the text exposition format, remembering the first error
+type promWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (pw *promWriter) family(name, typ, help string) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// sample writes a sample, labels are pairs of name and value
+func (pw *promWriter) sample(name string, labels []string, value string) {
+	if pw.err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabel(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(value)
+	b.WriteByte('\n')
+	_, pw.err = pw.w.WriteString(b.String())
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string  { return helpReplacer.Replace(s) }
+func escapeLabel(s string) string { return labelReplacer.Replace(s) }
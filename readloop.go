@@ -1,8 +1,6 @@
 package kcp
 
 import (
-	"sync/atomic"
-
 	gouuid "github.com/satori/go.uuid"
 )
 
@@ -17,10 +15,11 @@ func (t *UDPTunnel) defaultReadLoop() {
 
 		if n, from, err := t.conn.ReadFrom(buf); err == nil {
 			if n >= gouuid.Size+IKCP_OVERHEAD {
+				t.statInput(n)
 				t.input(buf[:n], from)
 				buf = xmitBuf.Get().([]byte)[:mtuLimit]
 			} else {
-				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				t.statInErr()
 			}
 		} else {
 			t.notifyReadError(err)
@@ -33,13 +33,17 @@ func (t *UDPTunnel) readLoop() {
 		}
 
 		if count, err := t.xconn.ReadBatch(msgs, 0); err == nil {
+			if count > 0 {
+				atomic.AddUint64(&t.stats.readBatches[batchBucket(count)], 1)
+			}
 			for i := 0; i < count; i++ {
 				msg := &msgs[i]
 				if msg.N >= gouuid.Size+IKCP_OVERHEAD {
+					t.statInput(msg.N)
 					t.input(msg.Buffers[0][:msg.N], msg.Addr)
 					msg.Buffers[0] = xmitBuf.Get().([]byte)[:mtuLimit]
 				} else {
-					atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+					t.statInErr()
 				}
 			}
 		} else {
@@ -49,6 +53,7 @@ func (t *UDPTunnel) readLoop() {
 			if operr, ok := err.(*net.OpError); ok {
 				if se, ok := operr.Err.(*os.SyscallError); ok {
 					if se.Syscall == "recvmmsg" {
+						atomic.StoreInt32(&t.stats.readFallback, 1)
 						t.defaultReadLoop()
 						return
 					}
@@ -0,0 +1,127 @@
+package kcp
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+)
+
+// redundancy modes of a stream, what is replicated while it is parallel, see SetRedundancy.
+// The modes but RedundancyAll can be combined
+const (
+	RedundancyAll     = 0      // every packet, the default
+	RedundancyRetrans = 1 << 0 // the packets carrying retransmitted segments
+	RedundancyTail    = 1 << 1 // the packets carrying the last segments of each flush
+	RedundancyAcks    = 1 << 2 // the packets carrying acks only
+)
+
+// DefaultRedundancyTailSegs is the number of segments at the tail of a flush replicated by
+// RedundancyTail
+const DefaultRedundancyTailSegs = 2
+
+// categories of the packets replicated, see Snmp.ReplicaDataBytes
+const (
+	replicaData = iota
+	replicaRetrans
+	replicaTail
+	replicaAck
+)
+
+// tailPkt is a packet of fresh data of the flush in progress, replicated if at its tail
+type tailPkt struct {
+	path     int
+	idx      int // in msgss[path]
+	segs     int
+	replicas []int // the paths of its replicas
+}
+
+// SetRedundancy sets what is replicated while the stream is parallel, RedundancyAll or a
+// combination of RedundancyRetrans, RedundancyTail and RedundancyAcks. tailSegs is the number
+// of segments replicated at the tail of each flush, DefaultRedundancyTailSegs if 0
+func (s *UDPStream) SetRedundancy(mode, tailSegs int) {
+	if tailSegs <= 0 {
+		tailSegs = DefaultRedundancyTailSegs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.redundancy = mode
+	s.tailSegs = tailSegs
+}
+
+// packetCategory returns the category of a packet of pushSegs data segments, as counted by flush
+func packetCategory(pushSegs int, xmitMax, delayts uint32) int {
+	if pushSegs == 0 {
+		return replicaAck
+	} else if xmitMax > 1 || delayts > 0 {
+		return replicaRetrans
+	}
+	return replicaData
+}
+
+// redundantCopies returns the number of copies of a packet of category to send out of the
+// parallel ones given by the policy, 1 if it is not replicated by the redundancy mode. The fresh data is left to
+// replicateTail with RedundancyTail, which is told by tail
+func (s *UDPStream) redundantCopies(parallel, category int) (copies int, tail bool) {
+	if parallel <= 1 || s.redundancy == RedundancyAll {
+		return parallel, false
+	}
+	switch {
+	case category == replicaAck && s.redundancy&RedundancyAcks != 0:
+		return parallel, false
+	case category == replicaRetrans && s.redundancy&RedundancyRetrans != 0:
+		return parallel, false
+	case category != replicaAck && s.redundancy&RedundancyTail != 0:
+		return 1, true
+	}
+	return 1, false
+}
+
+// replicate sends replicas of the packet buf on paths
+func (s *UDPStream) replicate(buf []byte, paths []int, category int) {
+	if len(paths) == 0 {
+		return
+	}
+	for _, path := range paths {
+		for j := len(s.msgss); j <= path; j++ {
+			s.msgss = append(s.msgss, make([]ipv4.Message, 0))
+		}
+		msg := ipv4.Message{}
+		bts := xmitBuf.Get().([]byte)[:len(buf)]
+		copy(bts, buf)
+		s.setFrameReplica(bts[:s.headerSize])
+		msg.Buffers = [][]byte{bts}
+		msg.Addr = s.remotes[path]
+		s.msgss[path] = append(s.msgss[path], msg)
+		ps := s.pathStat(path)
+		ps.outPkts++
+		ps.outReplicaPkts++
+		ps.unacked++
+	}
+
+	n := uint64(len(paths))
+	atomic.AddUint64(&s.stats.outPkts, n)
+	atomic.AddUint64(&s.stats.outBytes, n*uint64(len(buf)))
+	atomic.AddUint64(&s.stats.outReplicaPkts, n)
+	switch category {
+	case replicaData:
+		atomic.AddUint64(&DefaultSnmp.ReplicaDataBytes, n*uint64(len(buf)))
+	case replicaRetrans:
+		atomic.AddUint64(&DefaultSnmp.ReplicaRetransBytes, n*uint64(len(buf)))
+	case replicaTail:
+		atomic.AddUint64(&DefaultSnmp.ReplicaTailBytes, n*uint64(len(buf)))
+	case replicaAck:
+		atomic.AddUint64(&DefaultSnmp.ReplicaAckBytes, n*uint64(len(buf)))
+	}
+}
+
+// replicateTail replicates the packets carrying the last tailSegs segments of the flush done,
+// with the lock held
+func (s *UDPStream) replicateTail() {
+	segs := 0
+	for i := len(s.tailPkts) - 1; i >= 0 && segs < s.tailSegs; i-- {
+		pkt := s.tailPkts[i]
+		s.replicate(s.msgss[pkt.path][pkt.idx].Buffers[0], pkt.replicas, replicaTail)
+		segs += pkt.segs
+	}
+	s.tailPkts = s.tailPkts[:0]
+}
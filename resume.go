@@ -0,0 +1,306 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// ---resumption ticket---
+// sealed: version uint8 + uuid [16]byte + id [8]byte + expire uint32 (unix seconds) + mac [16]byte
+// issued: sealed + secret [16]byte
+// presented: sealed + proof [16]byte
+//
+// the mac is the truncated HMAC-SHA256 of the fields ahead keyed by TransportOption.TicketKey,
+// the secret is the one of the sealed part under the same key. The dialer stores the issued
+// ticket and presents the sealed part with the HMAC of the uuid of the presenting stream keyed
+// by the secret, so a presented ticket is of no use to another stream. The id is random, the
+// acceptor takes a ticket of Resume once until it expires
+const (
+	ticketV1         byte = 1
+	ticketIDSize          = 8
+	ticketMacSize         = 16
+	ticketSealedSize      = 1 + gouuid.Size + ticketIDSize + 4 + ticketMacSize
+	ticketSize            = ticketSealedSize + ticketMacSize
+)
+
+var (
+	errTicketInvalid = errors.New("err ticket invalid")
+	errTicketExpired = errors.New("err ticket expired")
+	errTicketUsed    = errors.New("err ticket used")
+	errNoTicket      = errors.New("err no resumption ticket")
+	errRebindRefused = errors.New("err rebind refused")
+)
+
+// the results of the RBD reply of the acceptor, see Rebind
+const (
+	rbdAccepted byte = iota // followed by the DialParams extension with the ticket re-issued
+	rbdRefused
+)
+
+func ticketMac(key []byte, p ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, b := range p {
+		mac.Write(b)
+	}
+	return mac.Sum(nil)[:ticketMacSize]
+}
+
+// sealTicket issues a ticket for the stream uuid valid until expire
+func sealTicket(key []byte, uuid gouuid.UUID, expire time.Time) ([]byte, error) {
+	p := make([]byte, ticketSize)
+	p[0] = ticketV1
+	copy(p[1:], uuid[:])
+	if _, err := rand.Read(p[1+gouuid.Size : 1+gouuid.Size+ticketIDSize]); err != nil {
+		return nil, err
+	}
+	encode32u(p[1+gouuid.Size+ticketIDSize:], uint32(expire.Unix()))
+	copy(p[ticketSealedSize-ticketMacSize:], ticketMac(key, p[:ticketSealedSize-ticketMacSize]))
+	copy(p[ticketSealedSize:], ticketMac(key, p[:ticketSealedSize]))
+	return p, nil
+}
+
+// presentTicket returns the ticket presented by the stream uuid
+func presentTicket(ticket []byte, uuid gouuid.UUID) []byte {
+	if len(ticket) != ticketSize {
+		return ticket
+	}
+	p := append([]byte(nil), ticket[:ticketSealedSize]...)
+	return append(p, ticketMac(ticket[ticketSealedSize:], uuid[:])...)
+}
+
+// openTicket verifies the ticket presented by the stream by, and returns the uuid of the stream
+// it was issued for, its id and expiry
+func openTicket(key, ticket []byte, by gouuid.UUID, now time.Time) (uuid gouuid.UUID, id [ticketIDSize]byte, expire time.Time, err error) {
+	if len(key) == 0 || len(ticket) != ticketSize || ticket[0] != ticketV1 {
+		return uuid, id, expire, errTicketInvalid
+	}
+	sealed := ticket[:ticketSealedSize]
+	if !hmac.Equal(sealed[ticketSealedSize-ticketMacSize:], ticketMac(key, sealed[:ticketSealedSize-ticketMacSize])) {
+		return uuid, id, expire, errTicketInvalid
+	}
+	if !hmac.Equal(ticket[ticketSealedSize:], ticketMac(ticketMac(key, sealed), by[:])) {
+		return uuid, id, expire, errTicketInvalid
+	}
+	var expireUnix uint32
+	if _, err = decode32u(sealed[1+gouuid.Size+ticketIDSize:], &expireUnix); err != nil {
+		return uuid, id, expire, err
+	}
+	expire = time.Unix(int64(expireUnix), 0)
+	if now.After(expire) {
+		return uuid, id, expire, errTicketExpired
+	}
+	copy(uuid[:], sealed[1:])
+	copy(id[:], sealed[1+gouuid.Size:])
+	return uuid, id, expire, nil
+}
+
+// ticketExpire returns the expiry of the ticket issued, readable without the key, zero if the
+// ticket is malformed
+func ticketExpire(ticket []byte) time.Time {
+	var expireUnix uint32
+	if len(ticket) < ticketSealedSize || ticket[0] != ticketV1 {
+		return time.Time{}
+	}
+	decode32u(ticket[1+gouuid.Size+ticketIDSize:], &expireUnix)
+	return time.Unix(int64(expireUnix), 0)
+}
+
+// ticketCache records the ids of the tickets taken by Resume until they expire, shared by the
+// streams of a transport
+type ticketCache struct {
+	mu  sync.Mutex
+	ids map[[ticketIDSize]byte]time.Time
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{ids: make(map[[ticketIDSize]byte]time.Time)}
+}
+
+// take records id until expire, false if it is already taken
+func (c *ticketCache) take(id [ticketIDSize]byte, expire, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	for used, usedExpire := range c.ids {
+		if now.After(usedExpire) {
+			delete(c.ids, used)
+		}
+	}
+	c.ids[id] = expire
+	return true
+}
+
+// issueTicket returns the ticket of the accepted stream, nil if the transport has no TicketKey
+func (s *UDPStream) issueTicket() []byte {
+	if len(s.ticketKey) == 0 {
+		return nil
+	}
+	ticket, err := sealTicket(s.ticketKey, s.uuid, time.Now().Add(s.ticketLifetime))
+	if err != nil {
+		s.log.Log(ERROR, "UDPStream::issueTicket", "err", err)
+		return nil
+	}
+	s.ticket = ticket
+	return s.ticket
+}
+
+// recvResumeTicket verifies the ticket in the SYN of Resume, the stream is accepted as a new
+// one without ResumedFrom if it fails or the ticket was taken before
+func (s *UDPStream) recvResumeTicket(ticket []byte) {
+	now := time.Now()
+	from, id, expire, err := openTicket(s.ticketKey, ticket, s.uuid, now)
+	if err == nil && s.tickets != nil && !s.tickets.take(id, expire, now) {
+		err = errTicketUsed
+	}
+	if err != nil {
+		s.log.Log(WARN, "UDPStream::recvResumeTicket", "err", err)
+		return
+	}
+	s.resumedFrom = from
+	s.log.Log(INFO, "UDPStream::recvResumeTicket", "from", from)
+}
+
+// ResumptionTicket returns the ticket issued by the acceptor in the SYN reply, to be passed to
+// Resume after a restart or to authenticate Rebind, nil if the acceptor issues no tickets
+func (s *UDPStream) ResumptionTicket() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ticket
+}
+
+// ResumedFrom returns the uuid of the stream the dialer resumed with Resume, uuid.Nil if the
+// stream was opened afresh or the ticket was rejected. That stream is closed by the transport
+// before Accept returns this one, once the ticket is verified
+func (s *UDPStream) ResumedFrom() gouuid.UUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumedFrom
+}
+
+// Rebind picks the tunnels to the remotes again, after the tunnels of the selector changed, and
+// tells the acceptor to send to the new locals. The sequence state of the stream is preserved.
+// Only the dialer rebinds, with the ticket of the acceptor, which re-issues it in its reply, see
+// ResumptionTicket. errRebindRefused is returned if the acceptor refuses the ticket, errTimeout
+// if it does not reply in DialTimeout
+func (s *UDPStream) Rebind() error {
+	s.mu.Lock()
+	if s.accepted {
+		s.mu.Unlock()
+		return errInvalidOperation
+	} else if s.ticket == nil {
+		s.mu.Unlock()
+		return errNoTicket
+	} else if time.Now().After(ticketExpire(s.ticket)) {
+		s.mu.Unlock()
+		return errTicketExpired
+	}
+	remotes := make([]string, len(s.remotes))
+	for i, remote := range s.remotes {
+		remotes[i] = remote.String()
+	}
+	if err := s.bindRemotes(remotes); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	locals := make([]string, len(s.locals))
+	for i, local := range s.locals {
+		locals[i] = local.String()
+	}
+	ticket := presentTicket(s.ticket, s.uuid)
+	s.mu.Unlock()
+
+	s.log.Log(INFO, "UDPStream::Rebind", "locals", locals)
+	buf, err := encodeDialAddrs(locals)
+	if err != nil {
+		return err
+	}
+	if buf, err = encodeDialExt(buf, &DialParams{Ticket: ticket}); err != nil {
+		return err
+	}
+	select { // the reply to a former Rebind timed out
+	case <-s.chRbdEvent:
+	default:
+	}
+	if _, err = s.WriteFlag(RBD, buf); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(s.dialTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-s.chRbdEvent:
+		return err
+	case <-s.chClose:
+		return io.ErrClosedPipe
+	case <-s.chRst:
+		return io.ErrUnexpectedEOF
+	case <-timer.C:
+		return errTimeout
+	}
+}
+
+// recvRbd binds the acceptor to the new remotes of Rebind and replies, a rebind failing
+// verification is refused. The ticket presented is taken, the reply carries a new one
+func (s *UDPStream) recvRbd(data []byte) (n int, err error) {
+	if !s.accepted {
+		return s.recvRbdReply(data)
+	}
+	remotes, ext, err := s.decodeDialInfo(data)
+	if err == nil && ext == nil {
+		err = errNoTicket
+	}
+	if err != nil {
+		s.log.Log(WARN, "UDPStream::recvRbd", "err", err)
+		s.kcp.Send([]byte{RBD, rbdRefused})
+		return len(data), nil
+	}
+	now := time.Now()
+	uuid, id, expire, err := openTicket(s.ticketKey, ext.Ticket, s.uuid, now)
+	if err == nil && uuid != s.uuid {
+		err = errTicketInvalid
+	}
+	if err == nil && s.tickets != nil && !s.tickets.take(id, expire, now) {
+		err = errTicketUsed
+	}
+	if err == nil {
+		err = s.bindRemotes(remotes)
+	}
+	if err != nil {
+		s.log.Log(WARN, "UDPStream::recvRbd", "remotes", remotes, "err", err)
+		s.kcp.Send([]byte{RBD, rbdRefused})
+		return len(data), nil
+	}
+	s.log.Log(INFO, "UDPStream::recvRbd", "remotes", remotes)
+	reply, err := encodeDialExt([]byte{RBD, rbdAccepted}, &DialParams{Ticket: s.issueTicket()})
+	if err != nil {
+		return len(data), err
+	}
+	s.kcp.Send(reply)
+	return len(data), nil
+}
+
+// recvRbdReply takes the ticket re-issued by the acceptor and wakes Rebind up
+func (s *UDPStream) recvRbdReply(data []byte) (n int, err error) {
+	err = errRebindRefused
+	if len(data) > 0 && data[0] == rbdAccepted {
+		var ext *DialParams
+		if ext, err = decodeDialExt(data[1:]); err == nil && len(ext.Ticket) > 0 {
+			s.ticket = ext.Ticket
+		}
+	}
+	s.log.Log(INFO, "UDPStream::recvRbdReply", "err", err)
+	select {
+	case s.chRbdEvent <- err:
+	default:
+	}
+	return len(data), nil
+}
@@ -161,31 +161,6 @@ func (poll *TunnelPoll) Pick() (tunnel *kcp.UDPTunnel) {
 	return poll.tunnels[idx]
 }
 
-type TestSelector struct {
-	remoteAddrs []net.Addr
-	tunnels     []*kcp.UDPTunnel
-	idx         uint32
-}
-
-func NewTestSelector() (*TestSelector, error) {
-	return &TestSelector{
-		tunnels: make([]*kcp.UDPTunnel, 0),
-	}, nil
-}
-
-func (sel *TestSelector) Add(tunnel *kcp.UDPTunnel) {
-	sel.tunnels = append(sel.tunnels, tunnel)
-}
-
-func (sel *TestSelector) Pick(remotes []string) (tunnels []*kcp.UDPTunnel) {
-	for i := 0; i < len(remotes); i++ {
-		idx := sel.idx % uint32(len(sel.tunnels))
-		atomic.AddUint32(&sel.idx, 1)
-		tunnels = append(tunnels, sel.tunnels[idx])
-	}
-	return tunnels
-}
-
 // handleClient aggregates connection p1 on mux with 'writeLock'
 func handleClient(s *kcp.UDPStream, conn *net.TCPConn) {
 	kcp.Logf(kcp.INFO, "handleClient start stream:%v remote:%v", s.GetUUID(), conn.RemoteAddr())
@@ -468,19 +443,18 @@ func main() {
 			DialTimeout:     time.Minute,
 			InputQueue:      inputQueueCount,
 			TunnelProcessor: tunnelProcessorCount,
-		}
-
-		sel, err := NewTestSelector()
-		checkError(err)
-		transport, err := kcp.NewUDPTransport(sel, opt)
-		checkError(err)
-		for portS := localPortS; portS <= localPortE; portS++ {
-			tunnel, err := transport.NewTunnel(localIp + ":" + strconv.Itoa(portS))
-			checkError(err)
-			err = tunnel.SetReadBuffer(bufferSize)
-			checkError(err)
-			err = tunnel.SetWriteBuffer(bufferSize)
-			checkError(err)
+			StreamOption: &kcp.StreamOption{
+				Nodelay:  kcp.FastStreamOption.Nodelay,
+				Interval: interval,
+				Resend:   kcp.FastStreamOption.Resend,
+				Nc:       kcp.FastStreamOption.Nc,
+				SndWnd:   wndSize,
+				RcvWnd:   wndSize * 2,
+			},
+			TunnelOption: &kcp.TunnelOption{
+				ReadBuffer:  bufferSize,
+				WriteBuffer: bufferSize,
+			},
 		}
 
 		if transmitTuns > (remotePortE - remotePortS + 1) {
@@ -497,6 +471,17 @@ func main() {
 			remotes = append(remotes, remoteIp+":"+strconv.Itoa(portS))
 		}
 
+		// avoid the local ports losing more than 10% of the probes
+		prober, err := kcp.NewProber(remotes, time.Second, time.Second)
+		checkError(err)
+		opt.Prober = prober
+		transport, err := kcp.NewUDPTransport(kcp.NewHealthSelector(prober, 0.1), opt)
+		checkError(err)
+		for _, local := range locals {
+			_, err := transport.NewTunnel(local)
+			checkError(err)
+		}
+
 		localIdx := 0
 		remoteIdx := 0
 
@@ -517,8 +502,6 @@ func main() {
 				kcp.Logf(kcp.ERROR, "OpenTimeout failed. err:%v \n", err)
 				return nil, err
 			}
-			stream.SetWindowSize(wndSize, wndSize*2)
-			stream.SetNoDelay(kcp.FastStreamOption.Nodelay, interval, kcp.FastStreamOption.Resend, kcp.FastStreamOption.Nc)
 
 			kcp.Logf(kcp.WARN, "Open UDPStream. uuid:%v cost:%v", stream.GetUUID(), time.Since(start))
 			return stream, nil
@@ -614,6 +597,8 @@ func main() {
 			}
 		}()
 
+		http.Handle("/metrics", kcp.NewPrometheusHandler(kcp.DefaultSnmp, transport))
+		http.Handle("/debug/kcp/streams", kcp.NewDebugHandler(transport))
 		go func() {
 			http.ListenAndServe("0.0.0.0:6060", nil)
 		}()
@@ -137,31 +137,6 @@ func (poll *TunnelPoll) Pick() (tunnel *kcp.UDPTunnel) {
 	return poll.tunnels[idx]
 }
 
-type TestSelector struct {
-	remoteAddrs []net.Addr
-	tunnels     []*kcp.UDPTunnel
-	idx         uint32
-}
-
-func NewTestSelector() (*TestSelector, error) {
-	return &TestSelector{
-		tunnels: make([]*kcp.UDPTunnel, 0),
-	}, nil
-}
-
-func (sel *TestSelector) Add(tunnel *kcp.UDPTunnel) {
-	sel.tunnels = append(sel.tunnels, tunnel)
-}
-
-func (sel *TestSelector) Pick(remotes []string) (tunnels []*kcp.UDPTunnel) {
-	for i := 0; i < len(remotes); i++ {
-		idx := sel.idx % uint32(len(sel.tunnels))
-		atomic.AddUint32(&sel.idx, 1)
-		tunnels = append(tunnels, sel.tunnels[idx])
-	}
-	return tunnels
-}
-
 // handleClient aggregates connection p1 on mux with 'writeLock'
 func handleClient(s *kcp.UDPStream, conn *net.TCPConn) {
 	kcp.Logf(kcp.INFO, "handleClient start stream:%v remote:%v", s.GetUUID(), conn.RemoteAddr())
@@ -567,21 +542,29 @@ func main() {
 			DialTimeout:     time.Minute,
 			InputQueue:      inputQueueCount,
 			TunnelProcessor: tunnelProcessorCount,
+			StreamOption: &kcp.StreamOption{
+				Nodelay:  kcp.FastStreamOption.Nodelay,
+				Interval: interval,
+				Resend:   kcp.FastStreamOption.Resend,
+				Nc:       kcp.FastStreamOption.Nc,
+				SndWnd:   wndSize,
+				RcvWnd:   wndSize * 2,
+			},
+			TunnelOption: &kcp.TunnelOption{
+				ReadBuffer:  bufferSize,
+				WriteBuffer: bufferSize,
+			},
 		}
 
-		sel, err := NewTestSelector()
-		checkError(err)
-		transport, err := kcp.NewUDPTransport(sel, opt)
+		transport, err := kcp.NewUDPTransport(kcp.NewRoundRobinSelector(), opt)
 		checkError(err)
 		for portS := localPortS; portS <= localPortE; portS++ {
-			tunnel, err := transport.NewTunnel(localIp + ":" + strconv.Itoa(portS))
-			checkError(err)
-			err = tunnel.SetReadBuffer(bufferSize)
-			checkError(err)
-			err = tunnel.SetWriteBuffer(bufferSize)
+			_, err := transport.NewTunnel(localIp + ":" + strconv.Itoa(portS))
 			checkError(err)
 		}
 
+		http.Handle("/metrics", kcp.NewPrometheusHandler(kcp.DefaultSnmp, transport))
+		http.Handle("/debug/kcp/streams", kcp.NewDebugHandler(transport))
 		go func() {
 			http.ListenAndServe("0.0.0.0:6061", nil)
 		}()
@@ -654,8 +637,6 @@ func main() {
 		for {
 			stream, err := transport.Accept()
 			checkError(err)
-			stream.SetWindowSize(wndSize, wndSize*2)
-			stream.SetNoDelay(kcp.FastStreamOption.Nodelay, interval, kcp.FastStreamOption.Resend, kcp.FastStreamOption.Nc)
 			go func() {
 				switch testType {
 				case DefaultTest:
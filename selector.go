@@ -0,0 +1,208 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tunnelSet is the tunnels of a selector in the order added, the slice is replaced on change
+// so a snapshot can be read without the lock
+type tunnelSet struct {
+	mu      sync.Mutex
+	tunnels []*UDPTunnel
+}
+
+func (ts *tunnelSet) Add(tunnel *UDPTunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.tunnels {
+		if t == tunnel {
+			return
+		}
+	}
+	n := len(ts.tunnels)
+	ts.tunnels = append(ts.tunnels[:n:n], tunnel)
+}
+
+func (ts *tunnelSet) Remove(tunnel *UDPTunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tunnels := make([]*UDPTunnel, 0, len(ts.tunnels))
+	for _, t := range ts.tunnels {
+		if t != tunnel {
+			tunnels = append(tunnels, t)
+		}
+	}
+	ts.tunnels = tunnels
+}
+
+func (ts *tunnelSet) list() []*UDPTunnel {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.tunnels
+}
+
+// RoundRobinSelector picks the tunnels in turn
+type RoundRobinSelector struct {
+	tunnelSet
+	idx uint32
+}
+
+func NewRoundRobinSelector() *RoundRobinSelector {
+	return &RoundRobinSelector{}
+}
+
+func (sel *RoundRobinSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.list()
+	if len(all) == 0 {
+		return nil
+	}
+	for range remotes {
+		idx := atomic.AddUint32(&sel.idx, 1) - 1
+		tunnels = append(tunnels, all[idx%uint32(len(all))])
+	}
+	return tunnels
+}
+
+// WeightedSelector picks the tunnels in proportion to their weights with the smooth weighted
+// round-robin, a tunnel weighs 1 unless set and is never picked with a weight of 0
+type WeightedSelector struct {
+	tunnelSet
+	wmu     sync.Mutex
+	weights map[*UDPTunnel]int
+	current map[*UDPTunnel]int
+}
+
+func NewWeightedSelector() *WeightedSelector {
+	return &WeightedSelector{
+		weights: make(map[*UDPTunnel]int),
+		current: make(map[*UDPTunnel]int),
+	}
+}
+
+// SetWeight sets the weight of the tunnel
+func (sel *WeightedSelector) SetWeight(tunnel *UDPTunnel, weight int) {
+	sel.wmu.Lock()
+	defer sel.wmu.Unlock()
+	sel.weights[tunnel] = weight
+}
+
+func (sel *WeightedSelector) Remove(tunnel *UDPTunnel) {
+	sel.tunnelSet.Remove(tunnel)
+	sel.wmu.Lock()
+	defer sel.wmu.Unlock()
+	delete(sel.weights, tunnel)
+	delete(sel.current, tunnel)
+}
+
+func (sel *WeightedSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.list()
+	sel.wmu.Lock()
+	defer sel.wmu.Unlock()
+	for range remotes {
+		var best *UDPTunnel
+		total := 0
+		for _, tunnel := range all {
+			weight, ok := sel.weights[tunnel]
+			if !ok {
+				weight = 1
+			}
+			if weight <= 0 {
+				continue
+			}
+			sel.current[tunnel] += weight
+			total += weight
+			if best == nil || sel.current[tunnel] > sel.current[best] {
+				best = tunnel
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		sel.current[best] -= total
+		tunnels = append(tunnels, best)
+	}
+	return tunnels
+}
+
+// LowestRttSelector picks for each remote the alive tunnel with the lowest probed RTT to it,
+// the tunnels not probed yet rank after the probed ones and all are candidates if none is alive
+type LowestRttSelector struct {
+	tunnelSet
+	prober *Prober
+}
+
+func NewLowestRttSelector(prober *Prober) *LowestRttSelector {
+	return &LowestRttSelector{prober: prober}
+}
+
+func (sel *LowestRttSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.list()
+	if len(all) == 0 {
+		return nil
+	}
+	for _, remote := range remotes {
+		remote = normalizeAddr(remote)
+		var best *UDPTunnel
+		var bestHealth PathHealth
+		var bestAlive, bestKnown bool
+		for _, tunnel := range all {
+			h, ok := sel.prober.health(tunnel.LocalAddr().String(), remote)
+			alive := !ok || h.Alive
+			known := ok && h.Acked > 0
+			better := best == nil ||
+				(alive && !bestAlive) ||
+				(alive == bestAlive && known && !bestKnown) ||
+				(alive == bestAlive && known && bestKnown && h.Rtt < bestHealth.Rtt)
+			if better {
+				best, bestHealth, bestAlive, bestKnown = tunnel, h, alive, known
+			}
+		}
+		tunnels = append(tunnels, best)
+	}
+	return tunnels
+}
+
+// HealthSelector picks in turn for each remote among the alive tunnels with a probed loss to it
+// up to maxLoss, then among the alive ones, then among all
+type HealthSelector struct {
+	tunnelSet
+	prober  *Prober
+	maxLoss float64
+	idx     uint32
+}
+
+func NewHealthSelector(prober *Prober, maxLoss float64) *HealthSelector {
+	return &HealthSelector{prober: prober, maxLoss: maxLoss}
+}
+
+func (sel *HealthSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.list()
+	if len(all) == 0 {
+		return nil
+	}
+	for _, remote := range remotes {
+		remote = normalizeAddr(remote)
+		var healthy, alive []*UDPTunnel
+		for _, tunnel := range all {
+			h, ok := sel.prober.health(tunnel.LocalAddr().String(), remote)
+			if ok && !h.Alive {
+				continue
+			}
+			alive = append(alive, tunnel)
+			if h.Loss <= sel.maxLoss {
+				healthy = append(healthy, tunnel)
+			}
+		}
+		candidates := healthy
+		if len(candidates) == 0 {
+			candidates = alive
+		}
+		if len(candidates) == 0 {
+			candidates = all
+		}
+		idx := atomic.AddUint32(&sel.idx, 1) - 1
+		tunnels = append(tunnels, candidates[idx%uint32(len(candidates))])
+	}
+	return tunnels
+}
@@ -12,32 +12,46 @@ var (
 
 // Snmp defines network statistics indicator
 type Snmp struct {
-	BytesSent        uint64   // bytes sent from upper level
-	BytesReceived    uint64   // bytes received to upper level
-	MaxConn          uint64   // max number of connections ever reached
-	ActiveOpens      uint64   // accumulated active open connections
-	PassiveOpens     uint64   // accumulated passive open connections
-	CurrEstab        uint64   // current number of established connections
-	DialTimeout      uint64   // dial timeout count
-	InErrs           uint64   // UDP read errors reported from net.PacketConn
-	InCsumErrors     uint64   // checksum errors from CRC32
-	KCPInErrors      uint64   // packet iput errors reported from KCP
-	InPkts           uint64   // incoming packets count
-	OutPkts          uint64   // outgoing packets count
-	InSegs           uint64   // incoming KCP segments
-	OutSegs          uint64   // outgoing KCP segments
-	InBytes          uint64   // UDP bytes received
-	OutBytes         uint64   // UDP bytes sent
-	RetransSegs      uint64   // accmulated retransmited segments
-	FastRetransSegs  uint64   // accmulated fast retransmitted segments
-	EarlyRetransSegs uint64   // accmulated early retransmitted segments
-	LostSegs         uint64   // number of segs infered as lost
-	RepeatSegs       uint64   // number of segs duplicated
-	Parallels        uint64   // parallel count
-	ParallelStatuss  uint64   // parall status count
-	RtoMax           uint64   // rto max
-	AckCostMax       uint64   // ack cost max
-	XmitIntervalMax  []uint64 // xmit interval max
+	BytesSent           uint64   // bytes sent from upper level
+	BytesReceived       uint64   // bytes received to upper level
+	MaxConn             uint64   // max number of connections ever reached
+	ActiveOpens         uint64   // accumulated active open connections
+	PassiveOpens        uint64   // accumulated passive open connections
+	CurrEstab           uint64   // current number of established connections
+	DialTimeout         uint64   // dial timeout count
+	InErrs              uint64   // UDP read errors reported from net.PacketConn
+	InCsumErrors        uint64   // checksum errors from CRC32
+	KCPInErrors         uint64   // packet iput errors reported from KCP
+	InPkts              uint64   // incoming packets count
+	OutPkts             uint64   // outgoing packets count
+	InSegs              uint64   // incoming KCP segments
+	OutSegs             uint64   // outgoing KCP segments
+	InBytes             uint64   // UDP bytes received
+	OutBytes            uint64   // UDP bytes sent
+	RetransSegs         uint64   // accmulated retransmited segments
+	FastRetransSegs     uint64   // accmulated fast retransmitted segments
+	EarlyRetransSegs    uint64   // accmulated early retransmitted segments
+	LostSegs            uint64   // number of segs infered as lost
+	RepeatSegs          uint64   // number of segs duplicated
+	Parallels           uint64   // parallel count
+	ParallelStatuss     uint64   // parall status count
+	RtoMax              uint64   // rto max
+	AckCostMax          uint64   // ack cost max
+	PathChallenges      uint64   // path challenges sent to new remote addresses
+	PathChallengeFails  uint64   // path challenges unanswered in PathChallengeTimeout
+	PathMigrations      uint64   // paths moved to a validated remote address
+	PathFailovers       uint64   // primary paths replaced after they failed
+	ReplicaDataBytes    uint64   // bytes of fresh data replicated, see SetRedundancy
+	ReplicaRetransBytes uint64   // bytes of retransmissions replicated, see SetRedundancy
+	ReplicaTailBytes    uint64   // bytes of tail segments replicated, see SetRedundancy
+	ReplicaAckBytes     uint64   // bytes of acks replicated, see SetRedundancy
+	UsefulReplicas      uint64   // replica packets received carrying a segment received first
+	WastedReplicas      uint64   // replica packets received carrying data segments all received before
+	InputFullDrops      uint64   // datagrams received dropped as the input queues are full
+	InputOldestDrops    uint64   // datagrams queued dropped for the ones received next, see InputDropOldest
+	InputOpenDrops      uint64   // datagrams of unknown streams dropped above InputOpenLimit
+	InputStreamDrops    uint64   // datagrams of a stream dropped above InputStreamLimit
+	XmitIntervalMax     []uint64 // xmit interval max
 }
 
 func newSnmp() *Snmp {
@@ -74,6 +88,20 @@ func (s *Snmp) Header() []string {
 		"ParallelStatuss",
 		"RtoMax",
 		"AckCostMax",
+		"PathChallenges",
+		"PathChallengeFails",
+		"PathMigrations",
+		"PathFailovers",
+		"ReplicaDataBytes",
+		"ReplicaRetransBytes",
+		"ReplicaTailBytes",
+		"ReplicaAckBytes",
+		"UsefulReplicas",
+		"WastedReplicas",
+		"InputFullDrops",
+		"InputOldestDrops",
+		"InputOpenDrops",
+		"InputStreamDrops",
 	}
 	headers = append(headers, sliceHeaders1("XmitIntervalMax", s.XmitIntervalMax)...)
 	return headers
@@ -108,6 +136,20 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.ParallelStatuss),
 		fmt.Sprint(snmp.RtoMax),
 		fmt.Sprint(snmp.AckCostMax),
+		fmt.Sprint(snmp.PathChallenges),
+		fmt.Sprint(snmp.PathChallengeFails),
+		fmt.Sprint(snmp.PathMigrations),
+		fmt.Sprint(snmp.PathFailovers),
+		fmt.Sprint(snmp.ReplicaDataBytes),
+		fmt.Sprint(snmp.ReplicaRetransBytes),
+		fmt.Sprint(snmp.ReplicaTailBytes),
+		fmt.Sprint(snmp.ReplicaAckBytes),
+		fmt.Sprint(snmp.UsefulReplicas),
+		fmt.Sprint(snmp.WastedReplicas),
+		fmt.Sprint(snmp.InputFullDrops),
+		fmt.Sprint(snmp.InputOldestDrops),
+		fmt.Sprint(snmp.InputOpenDrops),
+		fmt.Sprint(snmp.InputStreamDrops),
 	}
 	vs = append(vs, sliceValues1(snmp.XmitIntervalMax)...)
 	return vs
@@ -141,6 +183,20 @@ func (s *Snmp) Copy() *Snmp {
 	d.ParallelStatuss = atomic.LoadUint64(&s.ParallelStatuss)
 	d.RtoMax = atomic.LoadUint64(&s.RtoMax)
 	d.AckCostMax = atomic.LoadUint64(&s.AckCostMax)
+	d.PathChallenges = atomic.LoadUint64(&s.PathChallenges)
+	d.PathChallengeFails = atomic.LoadUint64(&s.PathChallengeFails)
+	d.PathMigrations = atomic.LoadUint64(&s.PathMigrations)
+	d.PathFailovers = atomic.LoadUint64(&s.PathFailovers)
+	d.ReplicaDataBytes = atomic.LoadUint64(&s.ReplicaDataBytes)
+	d.ReplicaRetransBytes = atomic.LoadUint64(&s.ReplicaRetransBytes)
+	d.ReplicaTailBytes = atomic.LoadUint64(&s.ReplicaTailBytes)
+	d.ReplicaAckBytes = atomic.LoadUint64(&s.ReplicaAckBytes)
+	d.UsefulReplicas = atomic.LoadUint64(&s.UsefulReplicas)
+	d.WastedReplicas = atomic.LoadUint64(&s.WastedReplicas)
+	d.InputFullDrops = atomic.LoadUint64(&s.InputFullDrops)
+	d.InputOldestDrops = atomic.LoadUint64(&s.InputOldestDrops)
+	d.InputOpenDrops = atomic.LoadUint64(&s.InputOpenDrops)
+	d.InputStreamDrops = atomic.LoadUint64(&s.InputStreamDrops)
 	sliceCopy1(d.XmitIntervalMax, s.XmitIntervalMax)
 	return d
 }
@@ -172,6 +228,20 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.ParallelStatuss, 0)
 	atomic.StoreUint64(&s.RtoMax, 0)
 	atomic.StoreUint64(&s.AckCostMax, 0)
+	atomic.StoreUint64(&s.PathChallenges, 0)
+	atomic.StoreUint64(&s.PathChallengeFails, 0)
+	atomic.StoreUint64(&s.PathMigrations, 0)
+	atomic.StoreUint64(&s.PathFailovers, 0)
+	atomic.StoreUint64(&s.ReplicaDataBytes, 0)
+	atomic.StoreUint64(&s.ReplicaRetransBytes, 0)
+	atomic.StoreUint64(&s.ReplicaTailBytes, 0)
+	atomic.StoreUint64(&s.ReplicaAckBytes, 0)
+	atomic.StoreUint64(&s.UsefulReplicas, 0)
+	atomic.StoreUint64(&s.WastedReplicas, 0)
+	atomic.StoreUint64(&s.InputFullDrops, 0)
+	atomic.StoreUint64(&s.InputOldestDrops, 0)
+	atomic.StoreUint64(&s.InputOpenDrops, 0)
+	atomic.StoreUint64(&s.InputStreamDrops, 0)
 	sliceReset1(s.XmitIntervalMax)
 }
 
@@ -227,12 +297,23 @@ func atomicSetMax(pv *uint64, nv uint64) {
 	atomic.CompareAndSwapUint64(pv, maxv, nv)
 }
 
-func statRto(rto int) {
+func statRto(h *Histograms, rto int) {
 	atomicSetMax(&DefaultSnmp.RtoMax, uint64(rto))
+	DefaultHistograms.Rto.Record(int64(rto))
+	if h != nil {
+		h.Rto.Record(int64(rto))
+	}
 }
 
-func statAckCost(xmit int, cost int) {
-	if xmit < STAT_XMIT_MIN || xmit > STAT_XMIT_MAX {
+func statAckCost(h *Histograms, xmit int, cost int) {
+	if xmit < 1 || xmit > STAT_XMIT_MAX {
+		return
+	}
+	DefaultHistograms.AckCost[xmit-1].Record(int64(cost))
+	if h != nil {
+		h.AckCost[xmit-1].Record(int64(cost))
+	}
+	if xmit < STAT_XMIT_MIN {
 		return
 	}
 	atomicSetMax(&DefaultSnmp.AckCostMax, uint64(cost))
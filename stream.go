@@ -19,6 +19,7 @@ var (
 	errSynInfo      = errors.New("err syn info")
 	errDialParam    = errors.New("err dial param")
 	errRemoteStream = errors.New("err remote stream")
+	errSynPending   = errors.New("err syn pending")
 
 	errDialVersionNotSupport = errors.New("err dial version not support")
 )
@@ -46,12 +47,15 @@ const (
 	FIN = '3'
 	HRT = '4'
 	RST = '5'
+	RBD = '6' // rebind the remotes, see Rebind
+	PTH = '7' // add or remove a path, see AddPath
 )
 
 const (
 	FRAME_FLAG_REPLICA_TRIGGER  = 0x08
 	FRAME_FLAG_REPLICA          = 0x04
 	FRAME_FLAG_PRIMARY_RECEIVED = 0x02
+	FRAME_FLAG_PATH             = 0x01 // path frame, see pathFrameSize
 )
 
 // FRAME versions
@@ -66,6 +70,9 @@ const (
 	DV1
 )
 
+// FrameHeaderSize is the size of the frame header ahead of the KCP segments
+const FrameHeaderSize = gouuid.Size + 1
+
 type clean_callback func(uuid gouuid.UUID)
 
 type (
@@ -88,8 +95,7 @@ type (
 		bufptr  []byte
 
 		// settings
-		hrtTicker  *time.Ticker // heart beat ticker
-		cleanTimer *time.Timer  // clean timer
+		timers     streamTimers // flush, heart beat and clean timers
 		rd         time.Time    // read deadline
 		wd         time.Time    // write deadline
 		headerSize int          // the header size additional to a KCP frame
@@ -107,33 +113,83 @@ type (
 		closeOnce      sync.Once
 		chClose        chan struct{} // notify stream has Closed
 		chDialEvent    chan struct{} // notify Dial() has finished
+		chRbdEvent     chan error    // notify the acceptor replied to Rebind
 		chReadEvent    chan struct{} // notify Read() can be called without blocking
 		chWriteEvent   chan struct{} // notify Write() can be called without blocking
-		chFlushImmed   chan struct{} // notify start flush timer
-		chFlushDelay   chan struct{} // notify start flush timer
 
 		// packets waiting to be sent on wire
 		msgss [][]ipv4.Message
 		mu    sync.Mutex
 
-		parallelDelayMs    uint32
-		parallelIntervalMs uint32
-		parallelDurationMs uint32
-		parallelExpireMs   uint64
-		parallelDelaytsMax uint32
-		parallelStatus     bool // whether current status is parallel or not
+		policy         RedundancyPolicy // decides the paths of the packets, see SetRedundancyPolicy
+		policyCtx      RedundancyContext
+		parallelStatus bool // whether current status is parallel or not
 
-		useParallel         bool // set parallel or not
 		primaryReceived     bool // received primary data by target
 		primaryReceivedTell bool // received primary data from target
 
 		ackNoDelayRatio float32
 		ackNoDelayCount uint32
+
+		// statistics of this stream, DefaultSnmp holds the global ones
+		stats     streamCounters
+		dialStart time.Time
+		dialTime  time.Duration
+		hist      *Histograms
+		dedupe    dedupe // of the segments received, see CopyStats
+
+		inputPending int32 // datagrams queued by the transport to input, see InputStreamLimit
+
+		// SYN handshake negotiation
+		features     uint32      // features supported
+		dialPayload  []byte      // opaque payload sent in the SYN or the SYN reply
+		negotiated   *DialParams // nil until agreed
+		synReplyWait bool        // dialer waiting for the SYN reply
+		openMeta     []byte      // metadata of OpenWithPayload, sent or received in the SYN
+		onSyn        func()      // acceptor waiting for the SYN behind the packets following it, see accept
+
+		// session resumption, see Resume and Rebind
+		ticketKey      []byte        // acceptor only, no ticket issued if nil
+		ticketLifetime time.Duration // acceptor only
+		ticket         []byte        // issued by the acceptor, presented in the SYN of Resume
+		resumedFrom    gouuid.UUID   // acceptor only, the stream resumed by this one
+		tickets        *ticketCache  // set by the transport, the tickets taken by Resume and Rebind
+		dialTimeout    time.Duration // of the RBD reply
+
+		// path validation, see checkPath
+		pathProbes map[int]*pathProbe // pending challenges by path
+		pathKey    []byte             // issued by the acceptor in the SYN reply, no challenge if nil
+		onMigrate  MigrateCallback
+
+		stripe *stripe // nil unless the packets are striped across the paths, see SetMultipath
+
+		ackPath    int   // see SetAckPath
+		firstPaths []int // of the acks sent on the fastest path, see pathsFirst
+
+		// what is replicated while parallel, see SetRedundancy
+		redundancy int
+		tailSegs   int
+		tailPkts   []tailPkt // of the flush in progress with RedundancyTail
+
+		// per path accounting, see PathStats
+		pathStats    []pathStat
+		replicaOrder []int // the paths of the replicas by rank, see rankPaths
+		pingSeq      uint64
+		lastPing     time.Time
+
+		tunnelByAddr func(local string) *UDPTunnel // set by the transport, see AddPath
+
+		log    Logger       // carries the uuid and accepted fields
+		tracer StreamTracer // nil if not traced
 	}
 )
 
 // newUDPSession create a new udp session for client or server
 func NewUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, sel TunnelSelector, cleancb clean_callback) (stream *UDPStream, err error) {
+	return newUDPStream(uuid, accepted, remotes, sel, cleancb, new(TransportOption).SetDefault())
+}
+
+func newUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, sel TunnelSelector, cleancb clean_callback, opt *TransportOption) (stream *UDPStream, err error) {
 	tunnels := sel.Pick(remotes)
 	if len(tunnels) == 0 || len(tunnels) != len(remotes) {
 		return nil, errTunnelPick
@@ -159,42 +215,59 @@ func NewUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, sel TunnelS
 	stream.chSendFinEvent = make(chan struct{})
 	stream.chRecvFinEvent = make(chan struct{})
 	stream.chDialEvent = make(chan struct{}, 1)
+	stream.chRbdEvent = make(chan error, 1)
 	stream.chReadEvent = make(chan struct{}, 1)
 	stream.chWriteEvent = make(chan struct{}, 1)
-	stream.chFlushImmed = make(chan struct{}, 1)
-	stream.chFlushDelay = make(chan struct{}, 1)
 	stream.sendbuf = make([]byte, mtuLimit)
 	stream.recvbuf = make([]byte, mtuLimit)
 	stream.uuid = uuid
+	stream.stats.lastInput = time.Now().UnixNano()
+	stream.log = opt.Logger.With("uuid", uuid, "accepted", accepted)
 	stream.sel = sel
 	stream.cleancb = cleancb
-	stream.headerSize = gouuid.Size + 1
+	stream.headerSize = FrameHeaderSize
 	stream.msgss = make([][]ipv4.Message, 0)
 	stream.accepted = accepted
 	stream.tunnels = tunnels
 	stream.locals = locals
 	stream.remotes = remoteAddrs
-	stream.hrtTicker = time.NewTicker(HeartbeatInterval)
-	stream.cleanTimer = time.NewTimer(CleanTimeout)
-	stream.parallelDelayMs = DefaultParallelDelayMs
-	stream.parallelIntervalMs = DefaultParallelIntervalMs
-	stream.parallelDurationMs = DefaultParallelDurationMs
 	stream.ackNoDelayRatio = DefaultAckNoDelayRatio
 	stream.ackNoDelayCount = DefaultAckNoDelayCount
+	stream.ticketKey = opt.TicketKey
+	stream.ticketLifetime = opt.TicketLifetime
+	stream.dialTimeout = opt.DialTimeout
+	stream.onMigrate = opt.OnMigrate
+	stream.tailSegs = DefaultRedundancyTailSegs
+	if opt.NewRedundancyPolicy != nil {
+		stream.policy = opt.NewRedundancyPolicy(uuid, accepted)
+	}
 
-	stream.kcp = NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32) {
+	stream.kcp = NewKCP(1, func(buf []byte, size int, current uint64, xmitMax, delayts uint32, pushSegs int) {
 		if size >= IKCP_OVERHEAD+stream.headerSize {
-			stream.output(buf[:size], current, xmitMax, delayts)
+			stream.output(buf[:size], current, xmitMax, delayts, pushSegs)
 		}
 	})
 	stream.kcp.ReserveBytes(stream.headerSize)
+	if opt.StreamHistograms {
+		stream.hist = newHistograms()
+		stream.kcp.hist = stream.hist
+		stream.dedupe.hist = stream.hist
+	}
+	stream.kcp.dedupe = &stream.dedupe
+	if opt.Tracer != nil {
+		stream.tracer = opt.Tracer.NewStream(uuid, accepted)
+		stream.kcp.tracer = stream.tracer
+	}
 	stream.kcp.dead_link = DefaultDeadLink
 	stream.kcp.cwnd = 1
 
-	stream.cleanTimer.Stop()
-	go stream.update()
+	if opt.StreamOption != nil {
+		stream.SetOption(opt.StreamOption)
+	}
 
-	Logf(INFO, "NewUDPStream uuid:%v accepted:%v locals:%v remotes:%v", uuid, accepted, locals, remotes)
+	stream.startTimers(opt.Sched)
+
+	stream.log.Log(INFO, "NewUDPStream", "locals", locals, "remotes", remotes)
 	return stream, nil
 }
 
@@ -314,7 +387,9 @@ func (s *UDPStream) SetParallelDelayMs(delayMs uint32) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.parallelDelayMs = delayMs
+	if p := s.parallelPolicyToSet("UDPStream::SetParallelDelayMs"); p != nil {
+		p.DelayMs = delayMs
+	}
 }
 
 func (s *UDPStream) SetParallelIntervalMs(intervalMs uint32) {
@@ -323,7 +398,9 @@ func (s *UDPStream) SetParallelIntervalMs(intervalMs uint32) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.parallelIntervalMs = intervalMs
+	if p := s.parallelPolicyToSet("UDPStream::SetParallelIntervalMs"); p != nil {
+		p.IntervalMs = intervalMs
+	}
 }
 
 func (s *UDPStream) SetParallelDurationMs(durationMs uint32) {
@@ -332,13 +409,76 @@ func (s *UDPStream) SetParallelDurationMs(durationMs uint32) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.parallelDurationMs = durationMs
+	if p := s.parallelPolicyToSet("UDPStream::SetParallelDurationMs"); p != nil {
+		p.DurationMs = durationMs
+	}
 }
 
 func (s *UDPStream) SetUseParallel(useParallel bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.useParallel = useParallel
+	if p := s.parallelPolicyToSet("UDPStream::SetUseParallel"); p != nil {
+		p.Always = useParallel
+	}
+}
+
+// SetOption applies opt, the fields left zero are not changed
+func (s *UDPStream) SetOption(opt *StreamOption) {
+	s.SetNoDelay(noDelayArg(opt.Nodelay), noDelayArg(opt.Interval), noDelayArg(opt.Resend), noDelayArg(opt.Nc))
+	s.SetWindowSize(opt.SndWnd, opt.RcvWnd)
+	if opt.Mtu != 0 {
+		s.SetMtu(opt.Mtu)
+	}
+	if opt.DeadLink != 0 {
+		s.SetDeadLink(opt.DeadLink)
+	}
+	s.SetParallelDelayMs(opt.ParallelDelayMs)
+	s.SetParallelIntervalMs(opt.ParallelIntervalMs)
+	s.SetParallelDurationMs(opt.ParallelDurationMs)
+	if opt.UseParallel {
+		s.SetUseParallel(true)
+	}
+	if opt.AckNoDelay {
+		s.SetACKNoDelay(true)
+	}
+	if opt.AckNoDelayRatio != 0 || opt.AckNoDelayCount != 0 {
+		s.mu.Lock()
+		if opt.AckNoDelayRatio != 0 {
+			s.ackNoDelayRatio = opt.AckNoDelayRatio
+		}
+		if opt.AckNoDelayCount != 0 {
+			s.ackNoDelayCount = opt.AckNoDelayCount
+		}
+		s.mu.Unlock()
+	}
+	if opt.WriteDelay {
+		s.SetWriteDelay(true)
+	}
+	if opt.Multipath != MultipathReplicate {
+		s.SetMultipath(opt.Multipath)
+	}
+	if opt.AckPath != AckPathPrimary {
+		s.SetAckPath(opt.AckPath)
+	}
+	if opt.Redundancy != RedundancyAll {
+		s.SetRedundancy(opt.Redundancy, opt.RedundancyTailSegs)
+	}
+	s.mu.Lock()
+	s.features = opt.Features
+	s.dialPayload = opt.DialPayload
+	s.mu.Unlock()
+}
+
+// noDelayArg returns the argument of SetNoDelay for a field of StreamOption, -1 to keep the
+// current value for 0 and 0 for -1
+func noDelayArg(v int) int {
+	switch v {
+	case 0:
+		return -1
+	case -1:
+		return 0
+	}
+	return v
 }
 
 func (s *UDPStream) WaitSnd() int {
@@ -377,6 +517,7 @@ func (s *UDPStream) Read(b []byte) (n int, err error) {
 				copyn := copy(b[n:], s.bufptr)
 				s.bufptr = s.bufptr[copyn:]
 				n += copyn
+				atomic.AddUint64(&s.stats.bytesReceived, uint64(copyn))
 				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(copyn))
 				if n == len(b) {
 					s.notifyFlushEvent(s.kcp.probe_ask_tell())
@@ -400,6 +541,7 @@ func (s *UDPStream) Read(b []byte) (n int, err error) {
 				if flag == PSH {
 					n += copyn
 				}
+				atomic.AddUint64(&s.stats.bytesReceived, uint64(copyn))
 				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(copyn))
 				if n == len(b) || err != nil {
 					s.notifyFlushEvent(s.kcp.probe_ask_tell())
@@ -455,7 +597,11 @@ func (s *UDPStream) Write(b []byte) (n int, err error) {
 
 // Write implements net.Conn
 func (s *UDPStream) WriteFlag(flag byte, b []byte) (n int, err error) {
-	return s.WriteBuffer(flag, b, flag == HRT)
+	n, err = s.WriteBuffer(flag, b, flag == HRT)
+	if s.tracer != nil && err == nil {
+		s.tracer.ControlSent(flag)
+	}
+	return n, err
 }
 
 // WriteBuffers write a vector of byte slices to the underlying connection
@@ -495,9 +641,10 @@ func (s *UDPStream) WriteBuffer(flag byte, b []byte, heartbeat bool) (n int, err
 
 			waitsnd = s.kcp.WaitSnd()
 			immediately := waitsnd >= int(s.kcp.snd_wnd) || waitsnd >= int(s.kcp.rmt_wnd) || !s.writeDelay
-			s.mu.Unlock()
 			s.notifyFlushEvent(immediately)
+			s.mu.Unlock()
 
+			atomic.AddUint64(&s.stats.bytesSent, uint64(n))
 			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
 
 			// cost := time.Since(start)
@@ -546,15 +693,17 @@ func (s *UDPStream) Close() error {
 		once = true
 	})
 
-	Logf(INFO, "UDPStream::Close uuid:%v accepted:%v once:%v", s.uuid, s.accepted, once)
+	s.log.Log(INFO, "UDPStream::Close", "once", once)
 	if !once {
 		return io.ErrClosedPipe
 	}
 
 	s.WriteFlag(RST, nil)
 	close(s.chClose)
-	s.hrtTicker.Stop()
-	s.cleanTimer.Reset(CleanTimeout)
+	if s.tracer != nil {
+		s.tracer.Closed()
+	}
+	s.timers.sched.Put(s.clean, time.Now().Add(CleanTimeout))
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -571,7 +720,7 @@ func (s *UDPStream) CloseWrite() error {
 	s.sendFinOnce.Do(func() {
 		once = true
 	})
-	Logf(INFO, "UDPStream::CloseWrite uuid:%v accepted:%v once:%v", s.uuid, s.accepted, once)
+	s.log.Log(INFO, "UDPStream::CloseWrite", "once", once)
 	if !once {
 		return nil
 	}
@@ -582,11 +731,20 @@ func (s *UDPStream) CloseWrite() error {
 }
 
 func (s *UDPStream) dial(locals []string, timeout time.Duration) error {
-	Logf(INFO, "UDPStream::dial uuid:%v accepted:%v locals:%v timeout:%v", s.uuid, s.accepted, locals, timeout)
+	s.log.Log(INFO, "UDPStream::dial", "locals", locals, "timeout", timeout)
 
 	if s.accepted {
 		return nil
-	} else if len(locals) == 0 {
+	}
+	if err := s.sendSyn(locals, timeout); err != nil {
+		return err
+	}
+	return s.waitDial(timeout)
+}
+
+// sendSyn queues the SYN carrying locals, the acceptor must get it in a single segment
+func (s *UDPStream) sendSyn(locals []string, timeout time.Duration) error {
+	if len(locals) == 0 {
 		return errDialParam
 	}
 
@@ -594,8 +752,23 @@ func (s *UDPStream) dial(locals []string, timeout time.Duration) error {
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if len(dialBuf)+1 > int(s.kcp.mss) {
+		s.mu.Unlock()
+		return errSynInfo
+	}
+	s.dialStart = time.Now()
+	s.synReplyWait = true
+	s.mu.Unlock()
 	s.WriteFlag(SYN, dialBuf)
+	if s.tracer != nil {
+		s.tracer.DialStarted(locals, timeout)
+	}
+	return nil
+}
 
+// waitDial waits for the SYN to be acknowledged and establishes the stream
+func (s *UDPStream) waitDial(timeout time.Duration) error {
 	dialTimer := time.NewTimer(timeout)
 	defer dialTimer.Stop()
 
@@ -611,12 +784,18 @@ func (s *UDPStream) dial(locals []string, timeout time.Duration) error {
 		return nil
 	case <-dialTimer.C:
 		atomic.AddUint64(&DefaultSnmp.DialTimeout, 1)
+		if s.tracer != nil {
+			s.tracer.DialTimeout()
+		}
 		return errTimeout
 	}
 }
 
-func (s *UDPStream) accept() (err error) {
-	Logf(INFO, "UDPStream::accept uuid:%v accepted:%v", s.uuid, s.accepted)
+// accept establishes the stream opened by the SYN received. The packets written after the SYN
+// may arrive before it, then errSynPending is returned and onSyn is called by input once the SYN
+// is delivered, the stream is closed if it is not in DialTimeout
+func (s *UDPStream) accept(onSyn func()) (err error) {
+	s.log.Log(INFO, "UDPStream::accept")
 
 	select {
 	case <-s.chClose:
@@ -629,8 +808,15 @@ func (s *UDPStream) accept() (err error) {
 	}
 
 	s.mu.Lock()
+	if s.dialStart.IsZero() {
+		s.dialStart = time.Now()
+	}
 	size := s.kcp.PeekSize()
-	if size <= 0 {
+	if size <= 0 && onSyn != nil {
+		s.onSyn = onSyn
+		s.mu.Unlock()
+		return errSynPending
+	} else if size <= 0 {
 		s.mu.Unlock()
 		return errRemoteStream
 	}
@@ -655,8 +841,20 @@ func (s *UDPStream) accept() (err error) {
 	return err
 }
 
+// acceptTimeout closes the stream if its SYN is still pending
+func (s *UDPStream) acceptTimeout() {
+	s.mu.Lock()
+	pending := s.onSyn != nil
+	s.onSyn = nil
+	s.mu.Unlock()
+	if pending {
+		s.log.Log(INFO, "UDPStream::acceptTimeout")
+		s.Close()
+	}
+}
+
 func (s *UDPStream) establish() {
-	Logf(INFO, "UDPStream::establish uuid:%v accepted:%v", s.uuid, s.accepted)
+	s.log.Log(INFO, "UDPStream::establish")
 
 	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
 	atomicSetMax(&DefaultSnmp.MaxConn, currestab)
@@ -664,6 +862,12 @@ func (s *UDPStream) establish() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.state = StateEstablish
+	s.recvControls()
+	s.dialTime = time.Since(s.dialStart)
+	statDialTime(s.hist, int64(s.dialTime/time.Millisecond))
+	if s.tracer != nil {
+		s.tracer.Established(s.dialTime)
+	}
 }
 
 func (s *UDPStream) reset() {
@@ -672,7 +876,7 @@ func (s *UDPStream) reset() {
 		once = true
 	})
 
-	Logf(INFO, "UDPStream::reset uuid:%v accepted:%v once:%v", s.uuid, s.accepted, once)
+	s.log.Log(INFO, "UDPStream::reset", "once", once)
 	if !once {
 		return
 	}
@@ -681,68 +885,20 @@ func (s *UDPStream) reset() {
 	s.kcp.ReleaseTX()
 }
 
-// sess update to trigger protocol
-func (s *UDPStream) update() {
-	var flushTimer *time.Timer
-	var flushTimerCh <-chan time.Time
-
-	for {
-		select {
-		case <-s.cleanTimer.C:
-			Logf(INFO, "UDPStream::clean uuid:%v accepted:%v", s.uuid, s.accepted)
-			s.mu.Lock()
-			s.kcp.ReleaseTX()
-			if s.parallelStatus {
-				s.parallelStatus = false
-				atomic.AddUint64(&DefaultSnmp.ParallelStatuss, ^uint64(0))
-			}
-			s.mu.Unlock()
-			if flushTimer != nil {
-				flushTimer.Stop()
-			}
-			s.cleancb(s.uuid)
-			return
-		case <-s.hrtTicker.C:
-			Logf(DEBUG, "UDPStream::heartbeat uuid:%v accepted:%v", s.uuid, s.accepted)
-			s.WriteFlag(HRT, nil)
-		case <-s.chFlushDelay:
-			if flushTimer == nil {
-				flushTimer = time.NewTimer(time.Duration(s.kcp.interval) * time.Millisecond)
-				flushTimerCh = flushTimer.C
-			}
-		case <-s.chFlushImmed:
-			if flushTimer != nil {
-				flushTimer.Stop()
-			}
-			if interval := s.flush(); interval != 0 {
-				flushTimer = time.NewTimer(time.Duration(interval) * time.Millisecond)
-				flushTimerCh = flushTimer.C
-			} else {
-				flushTimer = nil
-				flushTimerCh = nil
-			}
-		case <-flushTimerCh:
-			if interval := s.flush(); interval != 0 {
-				flushTimer = time.NewTimer(time.Duration(interval) * time.Millisecond)
-				flushTimerCh = flushTimer.C
-			} else {
-				flushTimer = nil
-				flushTimerCh = nil
-			}
-		}
-	}
-}
-
 // flush sends data in txqueue if there is any
 // return if interval means next flush interval
 func (s *UDPStream) flush() (interval uint32) {
 	s.mu.Lock()
+	outSegs := s.kcp.outSegs
 	if s.kcp.state != 0xFFFFFFFF {
 		interval = s.kcp.flush(false)
 		if s.kcp.state == 0xFFFFFFFF {
 			s.reset()
 		}
 	}
+	if len(s.tailPkts) > 0 {
+		s.replicateTail()
+	}
 
 	waitsnd := s.kcp.WaitSnd()
 	notifyWrite := waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd)
@@ -757,6 +913,9 @@ func (s *UDPStream) flush() (interval uint32) {
 	msgss := s.msgss
 	tunnels := s.tunnels[:len(msgss)]
 	s.msgss = make([][]ipv4.Message, 0)
+	if s.tracer != nil && s.kcp.outSegs != outSegs {
+		s.tracer.Flushed(s.kcp.outSegs-outSegs, len(msgss[0]))
+	}
 	s.mu.Unlock()
 
 	if notifyWrite {
@@ -771,62 +930,71 @@ func (s *UDPStream) flush() (interval uint32) {
 			tunnels[i].output(msgs)
 		}
 	}
+	s.pingPaths()
+	s.checkPrimary()
 	return
 }
 
-func (s *UDPStream) tryParallel(current64 uint64) bool {
-	if current64 == 0 {
-		_, current64 = currentMs()
+// getParallel returns the paths of a packet to send and whether to set the replica trigger
+// of the frame, as decided by the policy
+func (s *UDPStream) getParallel(current64 uint64, xmitMax, delayts uint32) (paths []int, trigger bool) {
+	received, tell := s.primaryReceived, s.primaryReceivedTell
+	paths, trigger = s.redundancyPolicy().Output(s.redundancyContext(current64, xmitMax, delayts))
+	if trigger {
+		s.countParallel()
 	}
-	var trigger bool
-	if current64 >= s.parallelExpireMs {
-		Logf(INFO, "UDPStream::tryParallel uuid:%v accepted:%v", s.uuid, s.accepted)
-		atomic.AddUint64(&DefaultSnmp.Parallels, 1)
-		trigger = true
-		s.parallelDelaytsMax = 0
+	if s.tracer != nil {
+		if trigger {
+			s.tracer.ParallelTriggered(false)
+		}
+		s.tracePrimaryReceived(received, tell)
 	}
-	s.primaryReceived = false
-	s.primaryReceivedTell = false
-	s.parallelExpireMs = current64 + uint64(s.parallelDurationMs)
-	return trigger
+	return paths, trigger
 }
 
-func (s *UDPStream) getParallel(current64 uint64, xmitMax, delayts uint32) (parallel int, trigger bool) {
-	if delayts >= s.parallelDelayMs {
-		trigger = s.tryParallel(current64)
-	}
-	if current64 >= s.parallelExpireMs && s.primaryReceived && s.primaryReceivedTell && !s.useParallel {
-		return 1, trigger
-	}
-	if delayts > s.parallelDelaytsMax {
-		s.parallelDelaytsMax = delayts
-	}
-	parallel = 2
-	if s.parallelDelaytsMax > s.parallelDelayMs {
-		parallel += int((s.parallelDelaytsMax - s.parallelDelayMs) / s.parallelIntervalMs)
-	}
-	if parallel > len(s.tunnels) {
-		parallel = len(s.tunnels)
+// countParallel counts a parallel period started
+func (s *UDPStream) countParallel() {
+	s.log.Log(INFO, "UDPStream::countParallel")
+	atomic.AddUint64(&s.stats.parallels, 1)
+	atomic.AddUint64(&DefaultSnmp.Parallels, 1)
+}
+
+// tracePrimaryReceived traces the flip of primaryReceived or primaryReceivedTell from received and tell
+func (s *UDPStream) tracePrimaryReceived(received, tell bool) {
+	if received != s.primaryReceived || tell != s.primaryReceivedTell {
+		s.tracer.PrimaryReceivedChanged(s.primaryReceived, s.primaryReceivedTell)
 	}
-	return parallel, trigger
 }
 
-func (s *UDPStream) output(buf []byte, current64 uint64, xmitMax, delayts uint32) {
-	appendCount, trigger := s.getParallel(current64, xmitMax, delayts)
-	for i := len(s.msgss); i < appendCount; i++ {
+func (s *UDPStream) output(buf []byte, current64 uint64, xmitMax, delayts uint32, pushSegs int) {
+	if s.stripe != nil {
+		s.outputStripe(buf, current64)
+		return
+	}
+	paths, trigger := s.getParallel(current64, xmitMax, delayts)
+	category := packetCategory(pushSegs, xmitMax, delayts)
+	fastest := s.ackPath == AckPathFastest && category == replicaAck
+	if fastest {
+		paths = s.pathsFirst(paths, s.fastestPath())
+	}
+	first := paths[0]
+	for i := len(s.msgss); i < len(paths) || i <= first; i++ {
 		s.msgss = append(s.msgss, make([]ipv4.Message, 0))
 	}
+	ps := s.pathStat(first)
+	ps.outPkts++
+	ps.unacked++
 
-	if appendCount > 1 && !s.parallelStatus {
+	if len(paths) > 1 && !s.parallelStatus {
 		s.parallelStatus = true
 		atomic.AddUint64(&DefaultSnmp.ParallelStatuss, 1)
-	} else if appendCount == 1 && s.parallelStatus {
+	} else if len(paths) == 1 && s.parallelStatus {
 		s.parallelStatus = false
 		atomic.AddUint64(&DefaultSnmp.ParallelStatuss, ^uint64(0))
 	}
 
-	// Logf(DEBUG, "UDPStream::output uuid:%v accepted:%v len:%v xmitMax:%v delayts:%v appendCount:%v",
-	// 	s.uuid, s.accepted, len(buf), xmitMax, delayts, appendCount)
+	// Logf(DEBUG, "UDPStream::output uuid:%v accepted:%v len:%v xmitMax:%v delayts:%v paths:%v",
+	// 	s.uuid, s.accepted, len(buf), xmitMax, delayts, paths)
 
 	msg := ipv4.Message{}
 	copy(buf, s.uuid[:])
@@ -838,37 +1006,64 @@ func (s *UDPStream) output(buf []byte, current64 uint64, xmitMax, delayts uint32
 		s.setFramePrimaryReceived(buf)
 	}
 	msg.Buffers = [][]byte{buf}
-	msg.Addr = s.remotes[0]
-	s.msgss[0] = append(s.msgss[0], msg)
+	msg.Addr = s.remotes[first]
+	s.msgss[first] = append(s.msgss[first], msg)
 
-	for i := 1; i < appendCount; i++ {
-		msg := ipv4.Message{}
-		bts := xmitBuf.Get().([]byte)[:len(buf)]
-		copy(bts, buf)
-		s.setFrameReplica(bts[:s.headerSize])
-		msg.Buffers = [][]byte{bts}
-		msg.Addr = s.remotes[i]
-		s.msgss[i] = append(s.msgss[i], msg)
+	atomic.AddUint64(&s.stats.outPkts, 1)
+	atomic.AddUint64(&s.stats.outBytes, uint64(len(buf)))
+
+	copies, tail := s.redundantCopies(len(paths), category)
+	if fastest {
+		copies, tail = len(paths), false // the acks on all parallel paths
+	}
+	if tail {
+		s.tailPkts = append(s.tailPkts, tailPkt{path: first, idx: len(s.msgss[first]) - 1, segs: pushSegs, replicas: append([]int(nil), paths[1:]...)})
 	}
+	s.replicate(buf, paths[1:copies], category)
 }
 
-func (s *UDPStream) input(data []byte) {
+// input handles a frame received from addr by tunnel
+func (s *UDPStream) input(data []byte, tunnel *UDPTunnel, addr net.Addr) {
 	var kcpInErrors uint64
 
+	if isPathFrame(data) {
+		s.inputPath(data, tunnel, addr)
+		return
+	}
 	_, trigger, replica, primaryReceived := s.decodeFrameHeader(data)
 
 	s.mu.Lock()
-	if trigger {
-		_, current64 := currentMs()
-		s.tryParallel(current64)
+	received, tell := s.primaryReceived, s.primaryReceivedTell
+	ctx := s.redundancyContext(0, 0, 0)
+	ctx.Trigger, ctx.Replica = trigger, replica
+	if s.redundancyPolicy().Input(ctx) {
+		s.countParallel()
+		if s.tracer != nil {
+			s.tracer.ParallelTriggered(true)
+		}
 	}
 	if !replica {
 		s.primaryReceivedTell = true
 	}
 	s.primaryReceived = primaryReceived
+	if s.tracer != nil {
+		s.tracePrimaryReceived(received, tell)
+	}
 
+	current, _ := currentMs()
+	s.dedupe.begin(replica, current)
 	if ret := s.kcp.Input(data[s.headerSize:], !replica, false); ret != 0 {
 		kcpInErrors++
+	} else if tunnel != nil && s.state == StateEstablish {
+		s.checkPath(tunnel, addr)
+	}
+	s.dedupe.end(s.inputPathStat(tunnel, addr, replica))
+	if s.stripe != nil {
+		s.stripe.input(data[s.headerSize:], current, _imin_(s.kcp.snd_wnd, s.kcp.rmt_wnd))
+		s.kcp.pathCwnd = s.stripe.cwnd()
+	}
+	if s.synReplyWait {
+		s.recvSynReply()
 	}
 
 	if n := s.kcp.PeekSize(); n > 0 {
@@ -884,14 +1079,29 @@ func (s *UDPStream) input(data []byte) {
 		s.notifyDialEvent()
 	}
 
+	s.recvControls()
+	var onSyn func()
+	if s.onSyn != nil && s.kcp.PeekSize() > 0 {
+		onSyn, s.onSyn = s.onSyn, nil
+	}
+
 	acklen := len(s.kcp.acklist)
 	immediately := (s.ackNoDelay && acklen > 0) || uint32(acklen) > s.ackNoDelayCount || (float32(acklen)/float32(s.kcp.snd_wnd) > s.ackNoDelayRatio)
-	s.mu.Unlock()
 	s.notifyFlushEvent(immediately)
+	s.mu.Unlock()
+	if onSyn != nil {
+		onSyn()
+	}
 
 	// Logf(DEBUG, "UDPStream::input uuid:%v accepted:%v len:%v mmediately:%v trigger:%v replica:%v primaryReceived:%v",
 	// 	s.uuid, s.accepted, len(data), immediately, trigger, replica, primaryReceived)
 
+	atomic.AddUint64(&s.stats.inPkts, 1)
+	atomic.StoreInt64(&s.stats.lastInput, time.Now().UnixNano())
+	atomic.AddUint64(&s.stats.inBytes, uint64(len(data)))
+	if replica {
+		atomic.AddUint64(&s.stats.inReplicaPkts, 1)
+	}
 	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
 	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
 	if kcpInErrors > 0 {
@@ -920,21 +1130,10 @@ func (s *UDPStream) notifyWriteEvent() {
 	}
 }
 
-func (s *UDPStream) notifyFlushEvent(immediately bool) {
-	if immediately {
-		select {
-		case s.chFlushImmed <- struct{}{}:
-		default:
-		}
-	} else {
-		select {
-		case s.chFlushDelay <- struct{}{}:
-		default:
-		}
-	}
-}
-
 func (s *UDPStream) cmdRead(flag byte, data []byte, b []byte) (n int, err error) {
+	if s.tracer != nil && flag != PSH {
+		s.tracer.ControlReceived(flag)
+	}
 	switch flag {
 	case PSH:
 		return s.recvPsh(data, b)
@@ -946,17 +1145,39 @@ func (s *UDPStream) cmdRead(flag byte, data []byte, b []byte) (n int, err error)
 		return s.recvHrt(data)
 	case RST:
 		return s.recvRst(data)
+	case RBD:
+		return s.recvRbd(data)
+	case PTH:
+		return s.recvPth(data)
 	default:
 		return 0, errStreamFlag
 	}
 }
 
+// isPathControl tells the messages applied as they are received rather than when read
+func isPathControl(flag byte) bool {
+	return flag == RBD || flag == PTH
+}
+
+// recvControls applies the path messages received once the stream is established, the peer
+// sends on the new paths without waiting for the messages to be read, with the lock held
+func (s *UDPStream) recvControls() {
+	if s.state != StateEstablish {
+		return
+	}
+	s.kcp.RecvControls(isPathControl, func(msg []byte) {
+		if _, err := s.cmdRead(msg[0], msg[1:], nil); err != nil {
+			s.log.Log(WARN, "UDPStream::recvControls", "flag", msg[0], "err", err)
+		}
+	})
+}
+
 func (s *UDPStream) recvPsh(data []byte, b []byte) (n int, err error) {
 	return copy(b, data), nil
 }
 
 func (s *UDPStream) recvSyn(data []byte) (n int, err error) {
-	Logf(INFO, "UDPStream::recvSyn uuid:%v accepted:%v", s.uuid, s.accepted)
+	s.log.Log(INFO, "UDPStream::recvSyn")
 
 	var once bool
 	s.recvSynOnce.Do(func() {
@@ -966,22 +1187,54 @@ func (s *UDPStream) recvSyn(data []byte) (n int, err error) {
 		return len(data), nil
 	}
 
-	remotes, err := s.decodeDialInfo(data)
+	remotes, ext, err := s.decodeDialInfo(data)
 	if err != nil {
 		return len(data), err
 	}
+	if err = s.bindRemotes(remotes); err != nil {
+		return len(data), err
+	}
+
+	s.log.Log(INFO, "UDPStream::recvSyn", "locals", s.locals, "remotes", remotes)
+
+	if ext != nil {
+		agreed := negotiate(ext, s.localDialParams())
+		s.applyDialParams(agreed, ext.Payload)
+		s.openMeta = ext.Metadata
+		if ext.Ticket != nil {
+			s.recvResumeTicket(ext.Ticket)
+		}
+		agreed.Payload = s.dialPayload
+		agreed.Ticket = s.issueTicket()
+		if agreed.pathKey, err = newPathKey(); err != nil {
+			return len(data), err
+		}
+		s.pathKey = agreed.pathKey
+		reply, err := encodeDialExt([]byte{SYN}, agreed)
+		if err != nil {
+			return len(data), err
+		}
+		s.kcp.Send(reply)
+		s.log.Log(INFO, "UDPStream::recvSyn negotiated", "mtu", agreed.Mtu, "sndwnd", agreed.SndWnd, "rcvwnd", agreed.RcvWnd,
+			"interval", agreed.Interval, "features", agreed.Features)
+	}
+	return len(data), nil
+}
+
+// bindRemotes picks the tunnels to remotes and sends to them from now on
+func (s *UDPStream) bindRemotes(remotes []string) error {
 	if len(remotes) == 0 {
-		return len(data), errSynInfo
+		return errSynInfo
 	}
 	tunnels := s.sel.Pick(remotes)
 	if len(tunnels) == 0 || len(tunnels) != len(remotes) {
-		return len(data), errSynInfo
+		return errSynInfo
 	}
 	remoteAddrs := make([]*net.UDPAddr, len(remotes))
 	for i, remote := range remotes {
 		remoteAddr, err := net.ResolveUDPAddr("udp", remote)
 		if err != nil {
-			return len(data), err
+			return err
 		}
 		remoteAddrs[i] = remoteAddr
 	}
@@ -994,13 +1247,12 @@ func (s *UDPStream) recvSyn(data []byte) (n int, err error) {
 	s.tunnels = tunnels
 	s.locals = locals
 	s.remotes = remoteAddrs
-
-	Logf(INFO, "UDPStream::recvSyn uuid:%v accepted:%v locals:%v remotes:%v", s.uuid, s.accepted, locals, remotes)
-	return len(data), nil
+	s.resetPaths()
+	return nil
 }
 
 func (s *UDPStream) recvFin(data []byte) (n int, err error) {
-	Logf(INFO, "UDPStream::recvFin uuid:%v accepted:%v", s.uuid, s.accepted)
+	s.log.Log(INFO, "UDPStream::recvFin")
 
 	s.recvFinOnce.Do(func() {
 		close(s.chRecvFinEvent)
@@ -1009,12 +1261,12 @@ func (s *UDPStream) recvFin(data []byte) (n int, err error) {
 }
 
 func (s *UDPStream) recvHrt(data []byte) (n int, err error) {
-	Logf(DEBUG, "UDPStream::recvHrt uuid:%v accepted:%v", s.uuid, s.accepted)
+	s.log.Log(DEBUG, "UDPStream::recvHrt")
 	return len(data), nil
 }
 
 func (s *UDPStream) recvRst(data []byte) (n int, err error) {
-	Logf(INFO, "UDPStream::recvRst uuid:%v accepted:%v", s.uuid, s.accepted)
+	s.log.Log(INFO, "UDPStream::recvRst")
 	s.reset()
 	return len(data), io.ErrUnexpectedEOF
 }
@@ -1023,6 +1275,15 @@ func (s *UDPStream) recvRst(data []byte) (n int, err error) {
 // version uint8
 // locals uint8 (len) + (uint8 + addr) + (uint8 + addr)...
 func (s *UDPStream) encodeDialInfo(locals []string) ([]byte, error) {
+	buf, err := encodeDialAddrs(locals)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDialExt(buf, s.localDialParams())
+}
+
+// encodeDialAddrs encodes the DV1 dial info
+func encodeDialAddrs(locals []string) ([]byte, error) {
 	addrLen := 1
 	for _, local := range locals {
 		_, err := net.ResolveUDPAddr("udp", local)
@@ -1040,26 +1301,31 @@ func (s *UDPStream) encodeDialInfo(locals []string) ([]byte, error) {
 	return buf, nil
 }
 
-func (s *UDPStream) decodeDialInfo(buf []byte) ([]string, error) {
-	var err error
+func (s *UDPStream) decodeDialInfo(buf []byte) (remotes []string, ext *DialParams, err error) {
 	var version byte
 	var addrs byte
 	if buf, err = decode8u(buf, &version); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if version != DV1 {
-		return nil, errDialVersionNotSupport
+		return nil, nil, errDialVersionNotSupport
 	}
 	if buf, err = decode8u(buf, &addrs); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	remotes := make([]string, addrs)
+	remotes = make([]string, addrs)
 	for i := 0; i < int(addrs); i++ {
 		if buf, err = decode8uString(buf, &remotes[i]); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	return remotes, nil
+	if len(buf) == 0 { // DV1
+		return remotes, nil, nil
+	}
+	if ext, err = decodeDialExt(buf); err != nil {
+		return nil, nil, err
+	}
+	return remotes, ext, nil
 }
 
 // uuid + version(4bit) + replica_trigger(1 bit) + replica(1 bit) + none_use(2 bit)
@@ -1084,9 +1350,34 @@ func (s *UDPStream) decodeFrameHeader(buf []byte) (fv byte, trigger, replica, pr
 	if len(buf) <= gouuid.Size {
 		return
 	}
-	verFlag := buf[gouuid.Size]
+	return decodeFrameFlag(buf[gouuid.Size])
+}
+
+func decodeFrameFlag(verFlag byte) (fv byte, trigger, replica, primaryReceived bool) {
 	return verFlag >> 4,
 		verFlag&FRAME_FLAG_REPLICA_TRIGGER != 0,
 		verFlag&FRAME_FLAG_REPLICA != 0,
 		verFlag&FRAME_FLAG_PRIMARY_RECEIVED != 0
 }
+
+// FrameHeader is the decoded form of the header in front of the KCP segments of a frame
+type FrameHeader struct {
+	UUID            gouuid.UUID
+	Version         byte
+	Trigger         bool
+	Replica         bool
+	PrimaryReceived bool
+	Path            bool // a path frame, carrying no KCP segments
+}
+
+// DecodeFrameHeader parses the frame header written by encodeFrameHeader,
+// it returns the header and the KCP segments following it
+func DecodeFrameHeader(buf []byte) (hdr FrameHeader, payload []byte, err error) {
+	if len(buf) < FrameHeaderSize {
+		return hdr, nil, io.ErrUnexpectedEOF
+	}
+	copy(hdr.UUID[:], buf)
+	hdr.Version, hdr.Trigger, hdr.Replica, hdr.PrimaryReceived = decodeFrameFlag(buf[gouuid.Size])
+	hdr.Path = buf[gouuid.Size]&FRAME_FLAG_PATH != 0
+	return hdr, buf[FrameHeaderSize:], nil
+}
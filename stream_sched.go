@@ -0,0 +1,120 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamTimers schedules the flushes, heartbeats and cleanup of a stream on a TimedSched shared
+// by the streams, so that a stream costs no goroutine nor runtime timer of its own. A scheduled
+// task can not be cancelled, the flushes replaced are skipped by their seq when they run.
+// A flush, with the writes to the tunnels, runs on a worker of the TimedSched, a slow one delays
+// the tasks of the other streams on that worker, see TransportOption.Sched
+type streamTimers struct {
+	sched *TimedSched
+
+	mu         sync.Mutex
+	flushSeq   uint64    // of the flush scheduled
+	flushAt    time.Time // of the flush scheduled, zero if none
+	flushing   bool      // a flush is running
+	flushAgain bool      // a flush is due once the running one is done
+	cleaned    bool
+}
+
+// startTimers starts the heartbeats of the stream on sched, SystemTimedSched if nil
+func (s *UDPStream) startTimers(sched *TimedSched) {
+	if sched == nil {
+		sched = SystemTimedSched
+	}
+	s.timers.sched = sched
+	sched.Put(s.heartbeat, time.Now().Add(HeartbeatInterval))
+}
+
+// notifyFlushEvent schedules a flush now or after the interval of KCP, with the lock held
+func (s *UDPStream) notifyFlushEvent(immediately bool) {
+	now := time.Now()
+	if !immediately {
+		now = now.Add(time.Duration(s.kcp.interval) * time.Millisecond)
+	}
+	s.timers.mu.Lock()
+	s.scheduleFlush(now)
+	s.timers.mu.Unlock()
+}
+
+// scheduleFlush schedules a flush at deadline unless one is scheduled before or the timers are
+// not started, with the timers lock held
+func (s *UDPStream) scheduleFlush(deadline time.Time) {
+	t := &s.timers
+	if t.sched == nil || t.cleaned || (!t.flushAt.IsZero() && !t.flushAt.After(deadline)) {
+		return
+	}
+	t.flushSeq++
+	t.flushAt = deadline
+	seq := t.flushSeq
+	t.sched.Put(func() { s.runFlush(seq) }, deadline)
+}
+
+// runFlush runs the flush seq unless it is replaced, and schedules the next one by the interval
+// returned. The flushes of a stream do not run concurrently, one due while another runs follows it
+func (s *UDPStream) runFlush(seq uint64) {
+	t := &s.timers
+	t.mu.Lock()
+	if seq != t.flushSeq || t.cleaned {
+		t.mu.Unlock()
+		return
+	}
+	t.flushAt = time.Time{}
+	if t.flushing {
+		t.flushAgain = true
+		t.mu.Unlock()
+		return
+	}
+	t.flushing = true
+	t.mu.Unlock()
+
+	for {
+		interval := s.flush()
+		t.mu.Lock()
+		if t.flushAgain {
+			t.flushAgain = false
+			t.mu.Unlock()
+			continue
+		}
+		t.flushing = false
+		if interval != 0 {
+			s.scheduleFlush(time.Now().Add(time.Duration(interval) * time.Millisecond))
+		}
+		t.mu.Unlock()
+		return
+	}
+}
+
+// heartbeat sends a HRT every HeartbeatInterval until the stream is closed
+func (s *UDPStream) heartbeat() {
+	select {
+	case <-s.chClose:
+		return
+	default:
+	}
+	s.log.Log(DEBUG, "UDPStream::heartbeat")
+	s.WriteFlag(HRT, nil)
+	s.timers.sched.Put(s.heartbeat, time.Now().Add(HeartbeatInterval))
+}
+
+// clean releases the stream CleanTimeout after it is closed, the flushes stop
+func (s *UDPStream) clean() {
+	s.log.Log(INFO, "UDPStream::clean")
+	s.timers.mu.Lock()
+	s.timers.cleaned = true
+	s.timers.mu.Unlock()
+
+	s.mu.Lock()
+	s.kcp.ReleaseTX()
+	if s.parallelStatus {
+		s.parallelStatus = false
+		atomic.AddUint64(&DefaultSnmp.ParallelStatuss, ^uint64(0))
+	}
+	s.mu.Unlock()
+	s.cleancb(s.uuid)
+}
@@ -0,0 +1,183 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// streamCounters are the counters of a single stream updated outside the stream lock
+type streamCounters struct {
+	bytesSent      uint64
+	bytesReceived  uint64
+	inPkts         uint64
+	inBytes        uint64
+	inReplicaPkts  uint64
+	outPkts        uint64
+	outBytes       uint64
+	outReplicaPkts uint64
+	parallels      uint64
+	pathChallenges uint64
+	pathMigrations uint64
+	pathFailovers  uint64
+	lastInput      int64 // unix nano of the last packet received
+}
+
+// StreamStats is a snapshot of the statistics of a single stream
+type StreamStats struct {
+	UUID     gouuid.UUID
+	Accepted bool
+	State    int
+
+	BytesSent      uint64 // bytes sent from upper level
+	BytesReceived  uint64 // bytes received to upper level
+	InPkts         uint64 // incoming packets count, replicas included
+	InBytes        uint64 // UDP bytes received, replicas included
+	InReplicaPkts  uint64 // incoming replica packets count
+	OutPkts        uint64 // outgoing packets count, replicas included
+	OutBytes       uint64 // UDP bytes sent, replicas included
+	OutReplicaPkts uint64 // outgoing replica packets count
+	InSegs         uint64 // incoming KCP segments
+	OutSegs        uint64 // outgoing KCP segments
+
+	RetransSegs      uint64 // accmulated retransmited segments
+	FastRetransSegs  uint64 // accmulated fast retransmitted segments
+	EarlyRetransSegs uint64 // accmulated early retransmitted segments
+	LostSegs         uint64 // number of segs infered as lost, retransmitted by RTO
+	RepeatSegs       uint64 // number of segs duplicated
+
+	Srtt   int32  // smoothed rtt in ms
+	Rttvar int32  // rtt variation in ms
+	Rto    uint32 // current rto in ms
+
+	Cwnd     uint32
+	Ssthresh uint32
+	SndWnd   uint32
+	RcvWnd   uint32
+	RmtWnd   uint32
+	WaitSnd  int
+
+	ParallelStatus bool   // whether current status is parallel or not
+	Parallels      uint64 // parallel trigger count
+
+	PathChallenges uint64 // path challenges sent to new remote addresses
+	PathMigrations uint64 // paths moved to a validated remote address
+	PathFailovers  uint64 // primary paths replaced after they failed, see PathFailoverUnacked
+
+	CopyStats // of the data segments received, the gaps are in Histograms().CopyGap if kept
+
+	DialTime time.Duration // cost from sending or receiving SYN to establish
+}
+
+// Stats returns a snapshot of the statistics of the stream, it is safe to call concurrently
+func (s *UDPStream) Stats() *StreamStats {
+	st := &StreamStats{
+		UUID:           s.uuid,
+		Accepted:       s.accepted,
+		BytesSent:      atomic.LoadUint64(&s.stats.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&s.stats.bytesReceived),
+		InPkts:         atomic.LoadUint64(&s.stats.inPkts),
+		InBytes:        atomic.LoadUint64(&s.stats.inBytes),
+		InReplicaPkts:  atomic.LoadUint64(&s.stats.inReplicaPkts),
+		OutPkts:        atomic.LoadUint64(&s.stats.outPkts),
+		OutBytes:       atomic.LoadUint64(&s.stats.outBytes),
+		OutReplicaPkts: atomic.LoadUint64(&s.stats.outReplicaPkts),
+		Parallels:      atomic.LoadUint64(&s.stats.parallels),
+		PathChallenges: atomic.LoadUint64(&s.stats.pathChallenges),
+		PathMigrations: atomic.LoadUint64(&s.stats.pathMigrations),
+		PathFailovers:  atomic.LoadUint64(&s.stats.pathFailovers),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.State = s.state
+	st.InSegs = s.kcp.inSegs
+	st.OutSegs = s.kcp.outSegs
+	st.FastRetransSegs = s.kcp.fastRetransSegs
+	st.EarlyRetransSegs = s.kcp.earlyRetransSegs
+	st.LostSegs = s.kcp.lostSegs
+	st.RetransSegs = st.FastRetransSegs + st.EarlyRetransSegs + st.LostSegs
+	st.RepeatSegs = s.kcp.repeatSegs
+	st.Srtt = s.kcp.rx_srtt
+	st.Rttvar = s.kcp.rx_rttvar
+	st.Rto = s.kcp.rx_rto
+	st.Cwnd = s.kcp.cwnd
+	if s.kcp.pathCwnd != 0 {
+		st.Cwnd = s.kcp.pathCwnd
+	}
+	st.Ssthresh = s.kcp.ssthresh
+	st.SndWnd = s.kcp.snd_wnd
+	st.RcvWnd = s.kcp.rcv_wnd
+	st.RmtWnd = s.kcp.rmt_wnd
+	st.WaitSnd = s.kcp.WaitSnd()
+	st.ParallelStatus = s.parallelStatus
+	st.CopyStats = s.dedupe.CopyStats
+	st.DialTime = s.dialTime
+	return st
+}
+
+// PathStats is a snapshot of the statistics of a path of a stream. The RTT and loss are measured
+// by the pings sent on each path every PathPingInterval while the stream sends, they rank the
+// paths of the replicas and AckPathFastest but KCP keeps a single RTO for the stream. No ping is
+// sent unless the peer negotiated DialInfo DV2, the paths then stay Alive with no RTT and the
+// replicas follow the order of the paths
+type PathStats struct {
+	Local  net.Addr
+	Remote net.Addr
+
+	Rtt   time.Duration // smoothed RTT of the pings, 0 until the first pong
+	Loss  float64       // ratio of the last 32 pings at most lost
+	Alive bool          // false once ProbeDeadCount pings in a row are lost, no replica is sent then
+	Pings uint64
+	Pongs uint64
+
+	OutPkts        uint64 // outgoing packets count, replicas included
+	OutReplicaPkts uint64 // outgoing replica packets count
+	InPkts         uint64 // incoming packets count, replicas included
+	InReplicaPkts  uint64 // incoming replica packets count
+
+	CopyStats // of the data segments received on the path
+
+	// of the striping modes only, see SetMultipath
+	Cwnd     uint32
+	Inflight uint32
+	LostSegs uint64 // segments sent again on another path
+}
+
+// PathStats returns a snapshot of the statistics of each path, in the order of LocalAddrs
+func (s *UDPStream) PathStats() []PathStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.collectPathStats()
+}
+
+// collectPathStats returns the statistics of the paths, with the lock held
+func (s *UDPStream) collectPathStats() []PathStats {
+	stats := make([]PathStats, len(s.tunnels))
+	for i := range stats {
+		ps := s.pathStat(i)
+		h := ps.pings.health(probeKey{})
+		st := &stats[i]
+		st.Local = s.locals[i]
+		st.Remote = s.remotes[i]
+		st.Rtt = h.Rtt
+		st.Loss = h.Loss
+		st.Alive = h.Alive
+		st.Pings = h.Sent
+		st.Pongs = h.Acked
+		st.OutPkts = ps.outPkts
+		st.OutReplicaPkts = ps.outReplicaPkts
+		st.InPkts = ps.inPkts
+		st.InReplicaPkts = ps.inReplicaPkts
+		st.CopyStats = ps.copies
+		if s.stripe != nil && i < len(s.stripe.paths) {
+			sp := &s.stripe.paths[i]
+			st.Cwnd = sp.cwnd
+			st.Inflight = sp.inflight
+			st.LostSegs = sp.lostSegs
+		}
+	}
+	return stats
+}
@@ -0,0 +1,176 @@
+package kcp
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// Tracer is set by TransportOption.Tracer to follow the timeline of the streams of a transport,
+// streams of a transport without Tracer pay nothing but a nil check
+type Tracer interface {
+	// NewStream is called once for each stream, returning nil disables tracing of that stream
+	NewStream(uuid gouuid.UUID, accepted bool) StreamTracer
+}
+
+// StreamTracer receives the events of a single stream, the methods are called with the stream
+// lock held or from the stream goroutines, so they must not call back into the stream
+type StreamTracer interface {
+	// DialStarted is called when the SYN carrying locals is sent
+	DialStarted(locals []string, timeout time.Duration)
+	// DialTimeout is called when no SYN ack is received before the dial timeout
+	DialTimeout()
+	// Established is called when the stream is established, cost is from the SYN
+	Established(cost time.Duration)
+	// ControlSent is called when a SYN, FIN, HRT, RST, RBD or PTH is queued
+	ControlSent(flag byte)
+	// ControlReceived is called when a SYN, FIN, HRT, RST, RBD or PTH is read
+	ControlReceived(flag byte)
+	// Flushed is called after each flush which sent segments, pkts excludes the replicas
+	Flushed(segs uint64, pkts int)
+	// RtoFired is called when the segment sn is retransmitted on timeout, xmit is the
+	// transmission count before the retransmission and rto is the new one
+	RtoFired(sn, xmit, rto uint32)
+	// ParallelTriggered is called when a parallel period starts, byPeer if asked by the peer
+	ParallelTriggered(byPeer bool)
+	// PrimaryReceivedChanged is called when received, the peer received our primary
+	// packets, or tell, we received primary packets from the peer, flips
+	PrimaryReceivedChanged(received, tell bool)
+	// Closed is called when the stream is closed locally
+	Closed()
+}
+
+// flagName is the name of a command byte of WriteBuffer
+func flagName(flag byte) string {
+	switch flag {
+	case PSH:
+		return "psh"
+	case SYN:
+		return "syn"
+	case FIN:
+		return "fin"
+	case HRT:
+		return "hrt"
+	case RST:
+		return "rst"
+	case RBD:
+		return "rbd"
+	case PTH:
+		return "pth"
+	}
+	return "unknown"
+}
+
+// QlogTracer writes the events as JSON lines following the qlog NDJSON format, a header line
+// first then one event per line with the stream uuid as group_id, time is in ms since the
+// reference_time of the header
+type QlogTracer struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	start   time.Time
+	vantage string
+	err     error
+}
+
+type qlogEvent struct {
+	Time    float64     `json:"time"`
+	Name    string      `json:"name"`
+	GroupID string      `json:"group_id"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// NewQlogTracer creates a QlogTracer writing to w, vantage is the vantage_point type
+// of qlog, "client" or "server"
+func NewQlogTracer(w io.Writer, vantage string) *QlogTracer {
+	qt := &QlogTracer{enc: json.NewEncoder(w), start: time.Now(), vantage: vantage}
+	qt.err = qt.enc.Encode(map[string]interface{}{
+		"qlog_version": "draft-02",
+		"qlog_format":  "NDJSON",
+		"title":        "kcp-go",
+		"trace": map[string]interface{}{
+			"vantage_point": map[string]string{"type": vantage},
+			"common_fields": map[string]interface{}{
+				"protocol_type":  "KCP",
+				"reference_time": float64(qt.start.UnixNano()) / 1e6,
+				"time_format":    "relative",
+			},
+		},
+	})
+	return qt
+}
+
+// Err returns the first error writing the events, the following events are dropped
+func (qt *QlogTracer) Err() error {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	return qt.err
+}
+
+// NewStream implements Tracer
+func (qt *QlogTracer) NewStream(uuid gouuid.UUID, accepted bool) StreamTracer {
+	st := &qlogStreamTracer{qt: qt, groupID: uuid.String()}
+	st.event("kcp:stream_created", map[string]interface{}{"accepted": accepted})
+	return st
+}
+
+func (qt *QlogTracer) write(ev *qlogEvent) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	if qt.err != nil {
+		return
+	}
+	ev.Time = float64(time.Since(qt.start)) / float64(time.Millisecond)
+	qt.err = qt.enc.Encode(ev)
+}
+
+type qlogStreamTracer struct {
+	qt      *QlogTracer
+	groupID string
+}
+
+func (st *qlogStreamTracer) event(name string, data interface{}) {
+	st.qt.write(&qlogEvent{Name: name, GroupID: st.groupID, Data: data})
+}
+
+func (st *qlogStreamTracer) DialStarted(locals []string, timeout time.Duration) {
+	st.event("kcp:dial_started", map[string]interface{}{"locals": locals, "timeout": timeout.Seconds() * 1000})
+}
+
+func (st *qlogStreamTracer) DialTimeout() {
+	st.event("kcp:dial_timeout", nil)
+}
+
+func (st *qlogStreamTracer) Established(cost time.Duration) {
+	st.event("kcp:established", map[string]interface{}{"cost": cost.Seconds() * 1000})
+}
+
+func (st *qlogStreamTracer) ControlSent(flag byte) {
+	st.event("kcp:control_sent", map[string]interface{}{"type": flagName(flag)})
+}
+
+func (st *qlogStreamTracer) ControlReceived(flag byte) {
+	st.event("kcp:control_received", map[string]interface{}{"type": flagName(flag)})
+}
+
+func (st *qlogStreamTracer) Flushed(segs uint64, pkts int) {
+	st.event("kcp:flushed", map[string]interface{}{"segments": segs, "packets": pkts})
+}
+
+func (st *qlogStreamTracer) RtoFired(sn, xmit, rto uint32) {
+	st.event("recovery:rto_fired", map[string]interface{}{"sn": sn, "xmit": xmit, "rto": rto})
+}
+
+func (st *qlogStreamTracer) ParallelTriggered(byPeer bool) {
+	st.event("kcp:parallel_triggered", map[string]interface{}{"by_peer": byPeer})
+}
+
+func (st *qlogStreamTracer) PrimaryReceivedChanged(received, tell bool) {
+	st.event("kcp:primary_received_changed", map[string]interface{}{"received": received, "tell": tell})
+}
+
+func (st *qlogStreamTracer) Closed() {
+	st.event("kcp:closed", nil)
+}
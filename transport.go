@@ -16,6 +16,7 @@ var (
 	DefaultInputQueue      = 128
 	DefaultTunnelProcessor = 5
 	DefaultInputTime       = 3
+	DefaultTicketLifetime  = time.Hour * 24
 )
 
 type LogLevel int
@@ -28,26 +29,30 @@ const (
 	FATAL
 )
 
-var Logf = func(lvl LogLevel, f string, args ...interface{}) {}
+// Logf is where DefaultLogger writes to, nothing is logged nor formatted while it is nil
+var Logf func(lvl LogLevel, f string, args ...interface{})
 
 func (l LogLevel) String() string {
 	switch l {
-	case 1:
+	case DEBUG:
 		return "DEBUG"
-	case 2:
+	case INFO:
 		return "INFO"
-	case 3:
+	case WARN:
 		return "WARNING"
-	case 4:
+	case ERROR:
 		return "ERROR"
-	case 5:
+	case FATAL:
 		return "FATAL"
 	}
 	panic("invalid LogLevel")
 }
 
+// TunnelSelector picks the tunnels of the streams, one per remote, see the built-in
+// RoundRobinSelector, WeightedSelector, LowestRttSelector and HealthSelector
 type TunnelSelector interface {
 	Add(tunnel *UDPTunnel)
+	Remove(tunnel *UDPTunnel)
 	Pick(remotes []string) (tunnels []*UDPTunnel)
 }
 
@@ -57,6 +62,34 @@ type TransportOption struct {
 	InputQueue      int
 	TunnelProcessor int
 	InputTime       int
+	Logger          Logger // DefaultLogger if nil
+	Tracer          Tracer // streams are not traced if nil
+	TicketKey       []byte // key of the resumption tickets issued by the accepted streams, none if nil
+	TicketLifetime  time.Duration
+	OnMigrate       MigrateCallback // called when a path of a stream moves to a validated remote
+	Prober          *Prober         // started and closed by the transport, set to a single transport
+
+	// runs the flushes, heart beats and cleanup of the streams, SystemTimedSched if nil. The
+	// flushes output on its workers, give the transport a Sched of its own with enough workers
+	// if the tunnels may block the writes
+	Sched *TimedSched
+
+	// each stream keeps its own Histograms, about 16KB a stream, only DefaultHistograms if false
+	StreamHistograms bool
+
+	// how a tunnel spreads the datagrams received over its queues and what it does with them under
+	// overload, see InputDispatch and InputOverload
+	InputDispatch    InputDispatch
+	InputOverload    InputOverload
+	InputOpenLimit   int // length of an input queue above which the datagrams of unknown streams are dropped, no limit if 0
+	InputStreamLimit int // datagrams of a stream pending input above which its next ones are dropped, no limit if 0
+
+	// creates the redundancy policy of each stream, a ParallelPolicy if nil, see SetRedundancyPolicy
+	NewRedundancyPolicy func(uuid gouuid.UUID, accepted bool) RedundancyPolicy
+
+	// defaults applied in NewStream and NewTunnel before any data flows, nothing is applied if nil
+	StreamOption *StreamOption
+	TunnelOption *TunnelOption
 }
 
 func (opt *TransportOption) SetDefault() *TransportOption {
@@ -75,16 +108,47 @@ func (opt *TransportOption) SetDefault() *TransportOption {
 	if opt.InputTime == 0 {
 		opt.InputTime = DefaultInputTime
 	}
+	if opt.TicketLifetime == 0 {
+		opt.TicketLifetime = DefaultTicketLifetime
+	}
+	if opt.Logger == nil {
+		opt.Logger = DefaultLogger
+	}
 	return opt
 }
 
+// StreamOption holds the settings of a stream, the ones left zero keep their defaults
 type StreamOption struct {
-	Nodelay  int
+	Nodelay  int // -1 for an explicit zero, as Interval, Resend and Nc, see SetNoDelay
 	Interval int
 	Resend   int
 	Nc       int
+
+	SndWnd   int
+	RcvWnd   int
+	Mtu      int
+	DeadLink int
+
+	ParallelDelayMs    uint32
+	ParallelIntervalMs uint32
+	ParallelDurationMs uint32
+	UseParallel        bool
+	Multipath          int // MultipathReplicate by default, see SetMultipath
+	Redundancy         int // RedundancyAll by default, see SetRedundancy
+	AckPath            int // AckPathPrimary by default, see SetAckPath
+	RedundancyTailSegs int
+
+	AckNoDelay      bool
+	AckNoDelayRatio float32
+	AckNoDelayCount uint32
+	WriteDelay      bool
+
+	// negotiated in the SYN handshake, see DialParams
+	Features    uint32
+	DialPayload []byte
 }
 
+// TunnelOption holds the socket settings of a tunnel, the ones left zero keep the system defaults
 type TunnelOption struct {
 	ReadBuffer  int
 	WriteBuffer int
@@ -102,11 +166,6 @@ var DefaultTunOption = &TunnelOption{
 	WriteBuffer: 4 * 1024 * 1024,
 }
 
-type inputMsg struct {
-	data []byte
-	addr net.Addr
-}
-
 type inputTest struct {
 	t    time.Time
 	addr net.Addr
@@ -118,11 +177,15 @@ type UDPTransport struct {
 	startAccept   int32
 	preAcceptChan chan chan *UDPStream
 	tunnelHostM   map[string]*UDPTunnel
+	tunnelMu      sync.RWMutex // guards tunnelHostM
 	sel           TunnelSelector
 	die           chan struct{} // notify the listener has closed
 	dieOnce       sync.Once
-	inputQueues   []chan *inputMsg
+	inputQueues   []chan *inputMsg // shared by the tunnels with InputByStream
 	makeUUID      func() (gouuid.UUID, error)
+	log           Logger
+	prober        *Prober
+	tickets       *ticketCache
 }
 
 func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport, err error) {
@@ -139,59 +202,127 @@ func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport,
 		die:             make(chan struct{}),
 		inputQueues:     make([]chan *inputMsg, 0),
 		makeUUID:        gouuid.NewV4,
+		log:             opt.Logger,
+		prober:          opt.Prober,
+		tickets:         newTicketCache(),
+	}
+	if t.prober != nil {
+		if err = t.prober.start(t); err != nil {
+			return nil, err
+		}
 	}
 	return t, nil
 }
 
 func (t *UDPTransport) NewTunnel(lAddr string) (tunnel *UDPTunnel, err error) {
-	Logf(INFO, "UDPTransport::NewTunnel lAddr:%v", lAddr)
+	t.log.Log(INFO, "UDPTransport::NewTunnel", "lAddr", lAddr)
 
+	t.tunnelMu.Lock()
+	defer t.tunnelMu.Unlock()
 	tunnel, ok := t.tunnelHostM[lAddr]
 	if ok {
 		return tunnel, nil
 	}
 
-	tunnelIdx := len(t.inputQueues)
-	for i := 0; i < t.TunnelProcessor; i++ {
-		t.inputQueues = append(t.inputQueues, make(chan *inputMsg, t.InputQueue))
-		go t.processInput(tunnelIdx + i)
-	}
-
+	queues := t.tunnelQueues()
 	inputPoll := 0
-	tunnel, err = NewUDPTunnel(lAddr, func(tun *UDPTunnel, data []byte, addr net.Addr) {
-		msg := &inputMsg{data: data, addr: addr}
-		for i := 0; i < t.InputTime-1; i++ {
-			idx := inputPoll%t.TunnelProcessor + tunnelIdx
-			inputPoll++
-			select {
-			case t.inputQueues[idx] <- msg:
-				return
-			default:
-			}
-		}
-		t.inputQueues[inputPoll%t.TunnelProcessor+tunnelIdx] <- msg
+	tunnel, err = newUDPTunnel(lAddr, t.TransportOption, func(tun *UDPTunnel, data []byte, addr net.Addr) {
+		t.queueInput(queues, &inputPoll, data, tun, addr)
 	})
 
 	if err != nil {
-		Logf(ERROR, "UDPTransport::NewTunnel lAddr:%v err:%v", lAddr, err)
+		t.log.Log(ERROR, "UDPTransport::NewTunnel", "lAddr", lAddr, "err", err)
 		return nil, err
 	}
+	if t.InputDispatch != InputByStream {
+		for _, queue := range queues {
+			go t.processInput(queue, tunnel.die)
+		}
+	}
 
 	t.sel.Add(tunnel)
 	t.tunnelHostM[lAddr] = tunnel
 	return tunnel, nil
 }
 
+// CloseTunnel removes the tunnel created by NewTunnel with lAddr from the selector and closes it,
+// the streams sending on it should move away first with RemovePath
+func (t *UDPTransport) CloseTunnel(lAddr string) error {
+	t.log.Log(INFO, "UDPTransport::CloseTunnel", "lAddr", lAddr)
+
+	t.tunnelMu.Lock()
+	tunnel, ok := t.tunnelHostM[lAddr]
+	if !ok {
+		t.tunnelMu.Unlock()
+		return errInvalidOperation
+	}
+	delete(t.tunnelHostM, lAddr)
+	t.tunnelMu.Unlock()
+
+	t.sel.Remove(tunnel)
+	return tunnel.Close()
+}
+
+// Close stops the transport, Accept returns io.ErrClosedPipe, the tunnels and the Prober of
+// TransportOption are closed, the streams are left to their own timeouts
+func (t *UDPTransport) Close() error {
+	t.log.Log(INFO, "UDPTransport::Close")
+
+	var once bool
+	t.dieOnce.Do(func() {
+		once = true
+		close(t.die)
+	})
+	if !once {
+		return io.ErrClosedPipe
+	}
+	if t.prober != nil {
+		t.prober.Close()
+	}
+	for _, tunnel := range t.Tunnels() {
+		t.CloseTunnel(tunnel.LocalAddr().String())
+	}
+	return nil
+}
+
+// Tunnels returns the tunnels created by NewTunnel
+func (t *UDPTransport) Tunnels() []*UDPTunnel {
+	t.tunnelMu.RLock()
+	defer t.tunnelMu.RUnlock()
+	tunnels := make([]*UDPTunnel, 0, len(t.tunnelHostM))
+	for _, tunnel := range t.tunnelHostM {
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels
+}
+
+// tunnelByAddr returns the tunnel bound to local, nil if none
+func (t *UDPTransport) tunnelByAddr(local string) *UDPTunnel {
+	t.tunnelMu.RLock()
+	defer t.tunnelMu.RUnlock()
+	if tunnel, ok := t.tunnelHostM[local]; ok {
+		return tunnel
+	}
+	for _, tunnel := range t.tunnelHostM {
+		if tunnel.LocalAddr().String() == local {
+			return tunnel
+		}
+	}
+	return nil
+}
+
 func (t *UDPTransport) NewStream(uuid gouuid.UUID, accepted bool, remotes []string) (stream *UDPStream, err error) {
-	Logf(INFO, "UDPTransport::NewStream uuid:%v accepted:%v remotes:%v", uuid, accepted, remotes)
+	t.log.Log(INFO, "UDPTransport::NewStream", "uuid", uuid, "accepted", accepted, "remotes", remotes)
 
-	stream, err = NewUDPStream(uuid, accepted, remotes, t.sel, func(uuid gouuid.UUID) {
+	stream, err = newUDPStream(uuid, accepted, remotes, t.sel, func(uuid gouuid.UUID) {
 		t.handleClose(uuid)
-	})
+	}, t.TransportOption)
 	if err != nil {
-		Logf(ERROR, "UDPTransport::NewStream uuid:%v accepted:%v remotes:%v err:%v", uuid, accepted, remotes, err)
+		t.log.Log(ERROR, "UDPTransport::NewStream", "uuid", uuid, "accepted", accepted, "remotes", remotes, "err", err)
 		return nil, err
 	}
+	stream.tunnelByAddr = t.tunnelByAddr
+	stream.tickets = t.tickets
 	return stream, err
 }
 
@@ -201,32 +332,90 @@ func (t *UDPTransport) Open(locals, remotes []string) (stream *UDPStream, err er
 }
 
 func (t *UDPTransport) OpenTimeout(locals, remotes []string, timeout time.Duration) (stream *UDPStream, err error) {
-	Logf(INFO, "UDPTransport::OpenTimeout locals:%v remotes:%v timeout:%v", locals, remotes, timeout)
+	t.log.Log(INFO, "UDPTransport::OpenTimeout", "locals", locals, "remotes", remotes, "timeout", timeout)
+	return t.openDial(locals, remotes, timeout, nil)
+}
 
+// Resume opens a stream presenting the ticket of ResumptionTicket, typically kept by the dialer
+// across a restart. The acceptor takes a ticket once, then closes the stream it was issued for
+// and exposes its uuid by ResumedFrom, a rejected ticket leaves a fresh stream. The resumed stream
+// is a fresh one too, no data, sequence nor option of the old stream carries over, the
+// application restores its own state by ResumedFrom
+func (t *UDPTransport) Resume(locals, remotes []string, ticket []byte) (stream *UDPStream, err error) {
+	t.log.Log(INFO, "UDPTransport::Resume", "locals", locals, "remotes", remotes)
+	if len(ticket) == 0 {
+		return nil, errNoTicket
+	}
+	return t.openDial(locals, remotes, t.DialTimeout, ticket)
+}
+
+func (t *UDPTransport) openDial(locals, remotes []string, timeout time.Duration, ticket []byte) (stream *UDPStream, err error) {
 	uuid, err := t.makeUUID()
 	if err != nil {
-		Logf(ERROR, "UDPTransport::OpenTimeout NewV4 failed. locals:%v remotes:%v err:%v", locals, remotes, err)
+		t.log.Log(ERROR, "UDPTransport::openDial NewV4 failed", "locals", locals, "remotes", remotes, "err", err)
 		return nil, err
 	}
 
 	stream, err = t.NewStream(uuid, false, remotes)
 	if err != nil {
-		Logf(ERROR, "UDPTransport::OpenTimeout NewStream failed. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		t.log.Log(ERROR, "UDPTransport::openDial NewStream failed", "uuid", uuid, "locals", locals, "remotes", remotes, "err", err)
 		return nil, err
 	}
+	stream.mu.Lock()
+	stream.ticket = ticket
+	stream.mu.Unlock()
 	t.streamm.Set(uuid, stream)
 	if timeout == 0 {
 		timeout = t.DialTimeout
 	}
 	err = stream.dial(locals, timeout)
 	if err != nil {
-		Logf(INFO, "UDPTransport::OpenTimeout dial timeout. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		t.log.Log(INFO, "UDPTransport::openDial dial timeout", "uuid", uuid, "locals", locals, "remotes", remotes, "err", err)
 		stream.Close()
 		return nil, err
 	}
 	return stream, nil
 }
 
+// OpenWithPayload opens a stream carrying meta in the SYN, read by OpenMetadata of the accepted
+// stream. It returns once the SYN is queued without waiting for the round trip, writes follow
+// the SYN on the wire; the stream is closed if the SYN is not acknowledged in DialTimeout.
+// The acceptor holds the packets arriving before a SYN lost or delayed until it is retransmitted.
+func (t *UDPTransport) OpenWithPayload(locals, remotes []string, meta []byte) (stream *UDPStream, err error) {
+	t.log.Log(INFO, "UDPTransport::OpenWithPayload", "locals", locals, "remotes", remotes, "meta", len(meta))
+
+	if len(meta) > OpenMetadataMax {
+		return nil, errOpenMetadata
+	}
+	uuid, err := t.makeUUID()
+	if err != nil {
+		t.log.Log(ERROR, "UDPTransport::OpenWithPayload NewV4 failed", "locals", locals, "remotes", remotes, "err", err)
+		return nil, err
+	}
+
+	stream, err = t.NewStream(uuid, false, remotes)
+	if err != nil {
+		t.log.Log(ERROR, "UDPTransport::OpenWithPayload NewStream failed", "uuid", uuid, "locals", locals, "remotes", remotes, "err", err)
+		return nil, err
+	}
+	stream.mu.Lock()
+	stream.openMeta = meta
+	stream.mu.Unlock()
+	t.streamm.Set(uuid, stream)
+	if err = stream.sendSyn(locals, t.DialTimeout); err != nil {
+		t.log.Log(ERROR, "UDPTransport::OpenWithPayload sendSyn failed", "uuid", uuid, "locals", locals, "remotes", remotes, "err", err)
+		stream.Close()
+		return nil, err
+	}
+	go func() {
+		if err := stream.waitDial(t.DialTimeout); err != nil {
+			t.log.Log(INFO, "UDPTransport::OpenWithPayload dial failed", "uuid", uuid, "locals", locals, "remotes", remotes, "err", err)
+			stream.Close()
+		}
+	}()
+	return stream, nil
+}
+
 func (t *UDPTransport) Accept() (*UDPStream, error) {
 	atomic.StoreInt32(&t.startAccept, 1)
 	for {
@@ -234,7 +423,7 @@ func (t *UDPTransport) Accept() (*UDPStream, error) {
 		case acceptChan := <-t.preAcceptChan:
 			stream := <-acceptChan
 			if stream != nil {
-				Logf(INFO, "UDPTransport::Accept uuid:%v", stream.GetUUID())
+				t.log.Log(INFO, "UDPTransport::Accept", "uuid", stream.GetUUID())
 				return stream, nil
 			}
 		case <-t.die:
@@ -243,24 +432,22 @@ func (t *UDPTransport) Accept() (*UDPStream, error) {
 	}
 }
 
-func (t *UDPTransport) processInput(queue int) {
-	for {
-		msg := <-t.inputQueues[queue]
-		t.handleInput(msg.data, msg.addr)
-		xmitBuf.Put(msg.data)
-	}
-}
-
-func (t *UDPTransport) handleInput(data []byte, rAddr net.Addr) {
+func (t *UDPTransport) handleInput(data []byte, tunnel *UDPTunnel, rAddr net.Addr) {
 	var uuid gouuid.UUID
 	copy(uuid[:], data)
 
+	if uuid == gouuid.Nil {
+		if isPathFrame(data) {
+			t.handleProbe(data, tunnel, rAddr)
+		}
+		return
+	}
 	s, ok := t.streamm.Get(uuid)
 	if ok {
-		s.(*UDPStream).input(data)
+		s.(*UDPStream).input(data, tunnel, rAddr)
 		return
 	}
-	if atomic.LoadInt32(&t.startAccept) == 0 {
+	if atomic.LoadInt32(&t.startAccept) == 0 || isPathFrame(data) {
 		return
 	}
 
@@ -271,14 +458,14 @@ func (t *UDPTransport) handleInput(data []byte, rAddr net.Addr) {
 	default:
 		return
 	}
-	stream := t.handleOpen(uuid, []string{rAddr.String()}, data)
+	stream := t.handleOpen(uuid, []string{rAddr.String()}, tunnel, data)
 	acceptChan <- stream
 }
 
-func (t *UDPTransport) handleOpen(uuid gouuid.UUID, remotes []string, data []byte) *UDPStream {
+func (t *UDPTransport) handleOpen(uuid gouuid.UUID, remotes []string, tunnel *UDPTunnel, data []byte) *UDPStream {
 	// start := time.Now()
 	// defer Logf(INFO, "UDPTransport::handleOpen cost uuid:%v remotes:%v cost:%v", uuid, remotes, time.Since(start))
-	Logf(INFO, "UDPTransport::handleOpen start uuid:%v remotes:%v", uuid, remotes)
+	t.log.Log(INFO, "UDPTransport::handleOpen start", "uuid", uuid, "remotes", remotes)
 
 	var stream *UDPStream
 	t.streamm.SetIfAbsent(uuid, func() (interface{}, bool) {
@@ -290,17 +477,53 @@ func (t *UDPTransport) handleOpen(uuid gouuid.UUID, remotes []string, data []byt
 		return stream, true
 	})
 	// ignore conflict stream
-	if stream != nil {
-		stream.input(data)
-		if err := stream.accept(); err != nil {
-			Logf(INFO, "UDPTransport::handleOpen failed. uuid:%v err:%v", stream.GetUUID(), err)
-			stream.Close()
-			return nil
-		}
+	if stream == nil {
+		return nil
 	}
+	stream.input(data, tunnel, nil)
+	err := stream.accept(func() { t.acceptLate(stream) })
+	if err == errSynPending {
+		t.log.Log(INFO, "UDPTransport::handleOpen syn pending", "uuid", uuid)
+		stream.timers.sched.Put(stream.acceptTimeout, time.Now().Add(t.DialTimeout))
+		return nil
+	} else if err != nil {
+		t.log.Log(INFO, "UDPTransport::handleOpen failed", "uuid", uuid, "err", err)
+		stream.Close()
+		return nil
+	}
+	t.accepted(stream)
 	return stream
 }
 
+// acceptLate accepts the stream whose SYN is delivered after the packets following it, it takes
+// a place in the backlog then
+func (t *UDPTransport) acceptLate(stream *UDPStream) {
+	if err := stream.accept(nil); err != nil {
+		t.log.Log(INFO, "UDPTransport::acceptLate failed", "uuid", stream.GetUUID(), "err", err)
+		stream.Close()
+		return
+	}
+	t.accepted(stream)
+	acceptChan := make(chan *UDPStream, 1)
+	acceptChan <- stream
+	select {
+	case t.preAcceptChan <- acceptChan:
+	default:
+		t.log.Log(INFO, "UDPTransport::acceptLate backlog full", "uuid", stream.GetUUID())
+		stream.Close()
+	}
+}
+
+// accepted closes the stream the accepted one resumes
+func (t *UDPTransport) accepted(stream *UDPStream) {
+	if from := stream.ResumedFrom(); from != gouuid.Nil {
+		if old, ok := t.streamm.Get(from); ok {
+			t.log.Log(INFO, "UDPTransport::handleOpen resumed", "uuid", stream.GetUUID(), "from", from)
+			old.(*UDPStream).Close()
+		}
+	}
+}
+
 func (t *UDPTransport) handleClose(uuid gouuid.UUID) {
 	t.streamm.Remove(uuid)
 }
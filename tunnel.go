@@ -34,6 +34,7 @@ type (
 		conn    *net.UDPConn // the underlying packet connection
 		addr    *net.UDPAddr
 		inputcb input_callback
+		log     Logger // carries the tunnel field
 
 		// notifications
 		die     chan struct{} // notify tunnel has Closed
@@ -47,6 +48,9 @@ type (
 		xconn           batchConn // for x/net
 		xconnWriteError error
 
+		// statistics of this tunnel, DefaultSnmp holds the global ones
+		stats tunnelCounters
+
 		//simulate
 		loss     int
 		delayMin int
@@ -56,6 +60,10 @@ type (
 
 // newUDPSession create a new udp session for client or server
 func NewUDPTunnel(laddr string, inputcb input_callback) (tunnel *UDPTunnel, err error) {
+	return newUDPTunnel(laddr, new(TransportOption).SetDefault(), inputcb)
+}
+
+func newUDPTunnel(laddr string, opt *TransportOption, inputcb input_callback) (tunnel *UDPTunnel, err error) {
 	// network type detection
 	addr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
@@ -75,6 +83,7 @@ func NewUDPTunnel(laddr string, inputcb input_callback) (tunnel *UDPTunnel, err
 	tunnel.conn = conn
 	tunnel.inputcb = inputcb
 	tunnel.addr = addr
+	tunnel.log = opt.Logger.With("tunnel", addr.String())
 	tunnel.die = make(chan struct{})
 	tunnel.chFlush = make(chan struct{}, 1)
 	tunnel.msgqs = make([]*MsgQueue, DefaultMsgQueueCount)
@@ -89,25 +98,47 @@ func NewUDPTunnel(laddr string, inputcb input_callback) (tunnel *UDPTunnel, err
 		tunnel.xconn = ipv6.NewPacketConn(conn)
 	}
 
+	if opt.TunnelOption != nil {
+		if err = tunnel.SetOption(opt.TunnelOption); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	go tunnel.readLoop()
 	go tunnel.writeLoop()
 
-	Logf(INFO, "NewUDPTunnel addr:%v", addr)
+	tunnel.log.Log(INFO, "NewUDPTunnel")
 	return tunnel, nil
 }
 
 func (t *UDPTunnel) SetReadBuffer(bytes int) error {
-	Logf(INFO, "UDPTunnel::SetReadBuffer addr:%v bytes:%v", t.addr, bytes)
+	t.log.Log(INFO, "UDPTunnel::SetReadBuffer", "bytes", bytes)
 	return t.conn.SetReadBuffer(bytes)
 }
 
 func (t *UDPTunnel) SetWriteBuffer(bytes int) error {
-	Logf(INFO, "UDPTunnel::SetWriteBuffer addr:%v bytes:%v", t.addr, bytes)
+	t.log.Log(INFO, "UDPTunnel::SetWriteBuffer", "bytes", bytes)
 	return t.conn.SetWriteBuffer(bytes)
 }
 
+// SetOption applies opt, the fields left zero are not changed
+func (t *UDPTunnel) SetOption(opt *TunnelOption) error {
+	if opt.ReadBuffer != 0 {
+		if err := t.SetReadBuffer(opt.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opt.WriteBuffer != 0 {
+		if err := t.SetWriteBuffer(opt.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *UDPTunnel) Close() error {
-	Logf(INFO, "UDPTunnel::Close addr:%v", t.addr)
+	t.log.Log(INFO, "UDPTunnel::Close")
 
 	var once bool
 	t.dieOnce.Do(func() {
@@ -127,13 +158,23 @@ func (t *UDPTunnel) Close() error {
 	return nil
 }
 
+// isClosed returns whether the tunnel is closed
+func (t *UDPTunnel) isClosed() bool {
+	select {
+	case <-t.die:
+		return true
+	default:
+		return false
+	}
+}
+
 func (t *UDPTunnel) LocalAddr() (addr *net.UDPAddr) {
 	return t.addr
 }
 
 // for test
 func (t *UDPTunnel) Simulate(loss float64, delayMin, delayMax int) {
-	Logf(WARN, "UDPTunnel::Simulate addr:%v loss:%v delayMin:%v delayMax:%v", t.addr, loss, delayMin, delayMax)
+	t.log.Log(WARN, "UDPTunnel::Simulate", "loss", loss, "delayMin", delayMin, "delayMax", delayMax)
 
 	t.loss = int(loss * 100)
 	t.delayMin = delayMin
@@ -218,9 +259,12 @@ func (t *UDPTunnel) notifyFlush() {
 }
 
 func (t *UDPTunnel) notifyReadError(err error) {
-	Logf(ERROR, "UDPTunnel::notifyReadError addr:%v err:%v", t.addr, err)
+	t.log.Log(ERROR, "UDPTunnel::notifyReadError", "err", err)
+	t.stats.addError(&t.stats.readErrs, err)
 }
 
 func (t *UDPTunnel) notifyWriteError(err error) {
-	Logf(ERROR, "UDPTunnel::notifyWriteError addr:%v err:%v", t.addr, err)
+	t.log.Log(ERROR, "UDPTunnel::notifyWriteError", "err", err)
+	t.stats.addError(&t.stats.writeErrs, err)
+	atomic.AddUint64(&t.stats.outErrs, 1)
 }
@@ -0,0 +1,138 @@
+package kcp
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// BatchSizeBuckets are the upper bounds of the batch size histogram buckets,
+// the last bucket also counts the batches larger than its bound
+var BatchSizeBuckets = [...]int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// tunnelCounters are the counters of a single tunnel
+type tunnelCounters struct {
+	inPkts        uint64
+	inBytes       uint64
+	inErrs        uint64
+	inDrops       uint64 // datagrams dropped by the input queues under overload
+	outPkts       uint64
+	outBytes      uint64
+	outErrs       uint64 // write errors, as told by notifyWriteError
+	readFallback  int32
+	writeFallback int32
+	readBatches   [len(BatchSizeBuckets)]uint64
+	writeBatches  [len(BatchSizeBuckets)]uint64
+
+	errMu     sync.Mutex
+	readErrs  map[syscall.Errno]uint64
+	writeErrs map[syscall.Errno]uint64
+}
+
+// TunnelStats is a snapshot of the statistics of a single tunnel
+type TunnelStats struct {
+	LocalAddr string
+
+	InPkts   uint64 // incoming packets count
+	InBytes  uint64 // UDP bytes received
+	InErrs   uint64 // packets too short to be a frame
+	InDrops  uint64 // packets dropped by the input queues under overload, see InputOverload
+	OutPkts  uint64 // outgoing packets count
+	OutBytes uint64 // UDP bytes sent
+
+	// errors returned by the socket keyed by errno, errors not carrying an errno are keyed by 0
+	ReadErrors  map[syscall.Errno]uint64
+	WriteErrors map[syscall.Errno]uint64
+
+	SendQueue int // packets waiting in msgqs to be sent on wire
+
+	// packet count returned by ReadBatch and WriteBatch, bucketed by BatchSizeBuckets
+	ReadBatchSizes  [len(BatchSizeBuckets)]uint64
+	WriteBatchSizes [len(BatchSizeBuckets)]uint64
+
+	ReadFallback  bool // recvmmsg not available, reading packets one by one
+	WriteFallback bool // sendmmsg not available, writing packets one by one
+}
+
+func batchBucket(n int) int {
+	for i, bound := range BatchSizeBuckets {
+		if n <= bound {
+			return i
+		}
+	}
+	return len(BatchSizeBuckets) - 1
+}
+
+func errno(err error) syscall.Errno {
+	var en syscall.Errno
+	if errors.As(err, &en) {
+		return en
+	}
+	return 0
+}
+
+func (c *tunnelCounters) addError(m *map[syscall.Errno]uint64, err error) {
+	c.errMu.Lock()
+	if *m == nil {
+		*m = make(map[syscall.Errno]uint64)
+	}
+	(*m)[errno(err)]++
+	c.errMu.Unlock()
+}
+
+func copyErrors(m map[syscall.Errno]uint64) map[syscall.Errno]uint64 {
+	d := make(map[syscall.Errno]uint64, len(m))
+	for k, v := range m {
+		d[k] = v
+	}
+	return d
+}
+
+// Stats returns a snapshot of the statistics of the tunnel, it is safe to call concurrently
+func (t *UDPTunnel) Stats() *TunnelStats {
+	st := &TunnelStats{
+		LocalAddr:     t.addr.String(),
+		InPkts:        atomic.LoadUint64(&t.stats.inPkts),
+		InBytes:       atomic.LoadUint64(&t.stats.inBytes),
+		InErrs:        atomic.LoadUint64(&t.stats.inErrs),
+		InDrops:       atomic.LoadUint64(&t.stats.inDrops),
+		OutPkts:       atomic.LoadUint64(&t.stats.outPkts),
+		OutBytes:      atomic.LoadUint64(&t.stats.outBytes),
+		ReadFallback:  atomic.LoadInt32(&t.stats.readFallback) != 0,
+		WriteFallback: atomic.LoadInt32(&t.stats.writeFallback) != 0,
+	}
+	for i := range BatchSizeBuckets {
+		st.ReadBatchSizes[i] = atomic.LoadUint64(&t.stats.readBatches[i])
+		st.WriteBatchSizes[i] = atomic.LoadUint64(&t.stats.writeBatches[i])
+	}
+
+	t.stats.errMu.Lock()
+	st.ReadErrors = copyErrors(t.stats.readErrs)
+	st.WriteErrors = copyErrors(t.stats.writeErrs)
+	t.stats.errMu.Unlock()
+
+	for _, msgq := range t.msgqs {
+		msgq.mu.Lock()
+		st.SendQueue += len(msgq.msgss[msgq.wIdx])
+		msgq.mu.Unlock()
+	}
+	return st
+}
+
+func (t *UDPTunnel) statInput(n int) {
+	atomic.AddUint64(&t.stats.inPkts, 1)
+	atomic.AddUint64(&t.stats.inBytes, uint64(n))
+}
+
+func (t *UDPTunnel) statInErr() {
+	atomic.AddUint64(&t.stats.inErrs, 1)
+	atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+}
+
+func (t *UDPTunnel) statOutput(npkts, nbytes int) {
+	atomic.AddUint64(&t.stats.outPkts, uint64(npkts))
+	atomic.AddUint64(&t.stats.outBytes, uint64(nbytes))
+	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
+	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"sync/atomic"
+	"syscall"
 
 	"golang.org/x/net/ipv4"
 )
@@ -17,6 +18,9 @@ func (t *UDPTunnel) writeBatch(msgs []ipv4.Message) {
 
 	for len(msgs) > 0 {
 		if n, err := t.xconn.WriteBatch(msgs, 0); err == nil {
+			if n > 0 {
+				atomic.AddUint64(&t.stats.writeBatches[batchBucket(n)], 1)
+			}
 			for k := range msgs[:n] {
 				nbytes += len(msgs[k].Buffers[0])
 			}
@@ -25,22 +29,25 @@ func (t *UDPTunnel) writeBatch(msgs []ipv4.Message) {
 		} else {
 			// compatibility issue:
 			// for linux kernel<=2.6.32, support for sendmmsg is not available
-			// an error of type os.SyscallError will be returned
+			// an os.SyscallError of ENOSYS will be returned
 			if operr, ok := err.(*net.OpError); ok {
 				if se, ok := operr.Err.(*os.SyscallError); ok {
-					if se.Syscall == "sendmmsg" {
+					if se.Syscall == "sendmmsg" && se.Err == syscall.ENOSYS {
 						t.xconnWriteError = se
+						atomic.StoreInt32(&t.stats.writeFallback, 1)
+						t.statOutput(npkts, nbytes)
 						t.writeSingle(msgs)
 						return
 					}
 				}
 			}
+			// the rest of the batch is dropped, the next flush batches again
 			t.notifyWriteError(err)
+			break
 		}
 	}
 
-	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
-	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	t.statOutput(npkts, nbytes)
 }
 
 func (t *UDPTunnel) writeLoop() {
@@ -60,7 +67,11 @@ func (t *UDPTunnel) writeLoop() {
 
 		t.popMsgss(&msgss)
 		for _, msgs := range msgss {
-			t.writeBatch(msgs)
+			if t.xconnWriteError != nil {
+				t.writeSingle(msgs)
+			} else {
+				t.writeBatch(msgs)
+			}
 		}
 		t.releaseMsgss(msgss)
 		msgss = msgss[:0]